@@ -0,0 +1,244 @@
+package proxytv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceCache holds the last successfully parsed body of each source, so that
+// it can be reused when only the other kind of source is due for a refresh.
+type sourceCache struct {
+	lock sync.Mutex
+	data map[string][]byte
+}
+
+func (sc *sourceCache) get(uri string) []byte {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.data[uri]
+}
+
+func (sc *sourceCache) set(uri string, data []byte) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.data == nil {
+		sc.data = make(map[string][]byte)
+	}
+	sc.data[uri] = data
+}
+
+// sourceReader reads the body of a source, recording it for the caches while
+// it is read. The recordings are only stored by commit, once the body has
+// parsed, so that a partial download is never cached.
+type sourceReader struct {
+	io.Reader
+	body io.Closer
+	// cached is set if the body comes from the memory or disk cache.
+	cached bool
+	// raw records the body for the memory cache, and file for the disk cache.
+	raw  *bytes.Buffer
+	file *os.File
+}
+
+func (sr *sourceReader) Close() error {
+	if sr.file != nil {
+		sr.file.Close()
+		os.Remove(sr.file.Name())
+		sr.file = nil
+	}
+	if sr.body == nil {
+		return nil
+	}
+	err := sr.body.Close()
+	sr.body = nil
+	return err
+}
+
+// cachePath returns the file in cacheDir that holds the body of uri. Only
+// remote sources are cached on disk.
+func (p *Provider) cachePath(uri string) (string, bool) {
+	if len(p.config.CacheDir) == 0 || !isURL(uri) {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(uri))
+	return filepath.Join(p.config.CacheDir, hex.EncodeToString(sum[:16])), true
+}
+
+// sourceHeader returns the header sent with the requests for the source at
+// uri, which carries the credentials of its kind of source.
+func (p *Provider) sourceHeader(uri string) http.Header {
+	if header, ok := p.sourceHeaders[uri]; ok {
+		return header
+	}
+	return p.header
+}
+
+// openSource returns a reader for the body of uri. Unless reload is set, the
+// body cached in memory is used if there is one, and unless download is set, a
+// copy in cacheDir younger than cacheTtl is used next. Standard input can only
+// be read once, so its body is always kept in memory and reused.
+func (p *Provider) openSource(uri string, reload bool, download bool) (*sourceReader, error) {
+	if !reload && !download || uri == stdinURI {
+		if data := p.sources.get(uri); data != nil {
+			log.WithField("url", uri).Debug("reusing cached source")
+			return &sourceReader{Reader: bytes.NewReader(data), body: io.NopCloser(nil), cached: true}, nil
+		}
+	}
+
+	sr := &sourceReader{}
+	path, onDisk := p.cachePath(uri)
+	if onDisk && !download {
+		if info, err := os.Stat(path); err == nil && p.now().Sub(info.ModTime()) < p.config.CacheTTL {
+			if file, err := os.Open(path); err == nil {
+				log.WithFields(log.Fields{"url": uri, "path": path}).Debug("reading source from disk cache")
+				sr.Reader, sr.body, sr.cached = file, file, true
+			}
+		}
+	}
+	if sr.body == nil {
+		reader, err := loadReader(p.client, uri, p.sourceHeader(uri), p.config.HTTPRetries)
+		if err != nil {
+			return nil, err
+		}
+		sr.Reader, sr.body = reader, reader
+		if onDisk {
+			if file, err := os.CreateTemp(p.config.CacheDir, filepath.Base(path)+".*.tmp"); err != nil {
+				log.WithError(err).Warn("unable to create cache file")
+			} else {
+				sr.file = file
+				sr.Reader = io.TeeReader(sr.Reader, file)
+			}
+		}
+	}
+
+	if p.m3uInterval() != p.epgInterval() || uri == stdinURI {
+		sr.raw = &bytes.Buffer{}
+		sr.Reader = io.TeeReader(sr.Reader, sr.raw)
+	}
+
+	return sr, nil
+}
+
+// commit stores the recorded body of uri into the caches.
+func (p *Provider) commit(uri string, sr *sourceReader) {
+	if sr.raw != nil {
+		p.sources.set(uri, sr.raw.Bytes())
+	}
+	if sr.file == nil {
+		return
+	}
+
+	file := sr.file
+	sr.file = nil
+	path, _ := p.cachePath(uri)
+	if err := file.Close(); err != nil {
+		log.WithError(err).Warn("unable to write cache file")
+		os.Remove(file.Name())
+		return
+	}
+	// The copy's age is measured with the provider's clock.
+	now := p.now()
+	if err := os.Chtimes(file.Name(), now, now); err != nil {
+		log.WithError(err).Warn("unable to write cache file")
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		log.WithError(err).Warn("unable to write cache file")
+		os.Remove(file.Name())
+	}
+}
+
+// prefetchedSource is the body of a source read ahead of parsing, or the
+// error reading it. readFailed is set if the source opened but its body could
+// not be read in full.
+type prefetchedSource struct {
+	sr         *sourceReader
+	err        error
+	readFailed bool
+}
+
+// prefetch opens uri as by openSource and reads its whole body into memory,
+// so that it can be downloaded before it can be parsed.
+func (p *Provider) prefetch(uri string, reload bool) *prefetchedSource {
+	sr, err := p.openSource(uri, reload, false)
+	if err != nil {
+		return &prefetchedSource{err: err}
+	}
+	data, err := io.ReadAll(sr)
+	if err != nil {
+		sr.Close()
+		return &prefetchedSource{err: err, readFailed: true}
+	}
+	sr.Reader = bytes.NewReader(data)
+	if sr.raw != nil {
+		sr.raw = bytes.NewBuffer(data)
+	}
+	return &prefetchedSource{sr: sr}
+}
+
+// sourceRead parses the body of the source at uri with parse.
+type sourceRead func(uri string, parse func(io.Reader) error) error
+
+// cachedRead returns a sourceRead that reads sources as by readSource.
+func (p *Provider) cachedRead(reload bool) sourceRead {
+	return func(uri string, parse func(io.Reader) error) error {
+		return p.readSource(uri, reload, false, parse)
+	}
+}
+
+var errStdinUnread = errors.New("standard input has not been read yet")
+
+// previewRead downloads the source at uri afresh and parses it with parse,
+// leaving the caches untouched. Standard input, which can only be read once,
+// is parsed from the memory cache instead.
+func (p *Provider) previewRead(uri string, parse func(io.Reader) error) error {
+	if uri == stdinURI {
+		data := p.sources.get(uri)
+		if data == nil {
+			return errStdinUnread
+		}
+		return parse(bytes.NewReader(data))
+	}
+
+	reader, err := loadReader(p.client, uri, p.sourceHeader(uri), p.config.HTTPRetries)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return parse(reader)
+}
+
+// readSource parses the body of uri with parse, opened as by openSource.
+func (p *Provider) readSource(uri string, reload bool, download bool, parse func(io.Reader) error) error {
+	sr, err := p.openSource(uri, reload, download)
+	if err != nil {
+		return err
+	}
+	return p.parseSource(uri, sr, download, parse)
+}
+
+// parseSource parses the body of uri read by sr with parse, then closes sr. A
+// cached body that fails to parse, e.g. because the cache file is corrupt, is
+// downloaded again.
+func (p *Provider) parseSource(uri string, sr *sourceReader, download bool, parse func(io.Reader) error) error {
+	defer sr.Close()
+
+	if err := parse(sr); err != nil {
+		if sr.cached && !download {
+			log.WithError(err).WithField("url", uri).Warn("unable to parse cached source, downloading it")
+			return p.readSource(uri, true, true, parse)
+		}
+		return err
+	}
+
+	p.commit(uri, sr)
+	return nil
+}
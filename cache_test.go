@@ -0,0 +1,124 @@
+package proxytv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderDiskCache(t *testing.T) {
+	var m3uHits, epgHits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/iptv.m3u":
+			m3uHits.Add(1)
+			w.Write([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`))
+		case "/epg.xml":
+			epgHits.Add(1)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+</tv>`))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	now := time.Now()
+	newProvider := func(ttl time.Duration) *Provider {
+		provider, err := NewProvider(&Config{
+			IPTVUrl:  server.URL + "/iptv.m3u",
+			EPGUrl:   server.URL + "/epg.xml",
+			CacheDir: dir,
+			CacheTTL: ttl,
+		})
+		require.NoError(t, err)
+		provider.now = func() time.Time { return now }
+		return provider
+	}
+
+	provider := newProvider(time.Hour)
+	require.NoError(t, provider.Refresh())
+	assert.Equal(t, int32(1), m3uHits.Load())
+	assert.Equal(t, int32(1), epgHits.Load())
+
+	t.Run("fresh copies are reused", func(t *testing.T) {
+		restarted := newProvider(time.Hour)
+		require.NoError(t, restarted.Refresh())
+		assert.Equal(t, int32(1), m3uHits.Load())
+		assert.Equal(t, int32(1), epgHits.Load())
+		assert.Contains(t, restarted.GetM3u(), "Channel 1")
+		assert.Contains(t, restarted.GetEpgXML(), `<channel id="id1">`)
+	})
+
+	t.Run("expired copies are downloaded again", func(t *testing.T) {
+		now = now.Add(2 * time.Hour)
+		require.NoError(t, provider.Refresh())
+		assert.Equal(t, int32(2), m3uHits.Load())
+		assert.Equal(t, int32(2), epgHits.Load())
+	})
+
+	t.Run("corrupt copies are downloaded again", func(t *testing.T) {
+		path, ok := provider.cachePath(server.URL + "/iptv.m3u")
+		require.True(t, ok)
+		require.NoError(t, os.WriteFile(path, []byte("not a playlist"), 0644))
+		require.NoError(t, os.Chtimes(path, now, now))
+
+		require.NoError(t, provider.Refresh())
+		assert.Equal(t, int32(3), m3uHits.Load())
+		assert.Equal(t, int32(2), epgHits.Load())
+		assert.Contains(t, provider.GetM3u(), "Channel 1")
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "#EXTM3U")
+	})
+
+	t.Run("zero ttl always downloads", func(t *testing.T) {
+		uncached := newProvider(0)
+		require.NoError(t, uncached.Refresh())
+		assert.Equal(t, int32(4), m3uHits.Load())
+		assert.Equal(t, int32(3), epgHits.Load())
+	})
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestProviderPrefetchClosedOnError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/iptv.m3u":
+			w.Write([]byte("not a playlist"))
+		case "/epg.xml":
+			w.Write([]byte(emptyEpg))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	provider, err := NewProvider(&Config{
+		IPTVUrl:  server.URL + "/iptv.m3u",
+		EPGUrl:   server.URL + "/epg.xml",
+		CacheDir: dir,
+		CacheTTL: time.Hour,
+	})
+	require.NoError(t, err)
+	assert.Error(t, provider.Refresh())
+
+	// The guide downloaded alongside the failed playlist is neither cached nor
+	// left behind as a partial file.
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
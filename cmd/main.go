@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/url"
@@ -10,7 +11,6 @@ import (
 	"regexp"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/csfrancis/proxytv"
 
@@ -113,6 +113,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to load provider: %v", err)
 	}
+	go prefetchLogos(provider, config)
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
@@ -124,8 +125,11 @@ func main() {
 
 	errChan := server.Start(provider)
 
-	refreshTicker := time.NewTicker(config.RefreshInterval)
-	defer refreshTicker.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider.StartAutoRefresh(ctx, func() {
+		go prefetchLogos(provider, config)
+	})
 
 	exit := false
 
@@ -136,13 +140,22 @@ func main() {
 		case <-stop:
 			log.Info("shutting down")
 			exit = true
-		case <-refreshTicker.C:
-			log.Info("refreshing provider")
-			if err := provider.Refresh(); err != nil {
-				log.WithError(err).Error("failed to refresh provider")
-			}
 		}
 	}
 
 	server.Stop()
 }
+
+// prefetchLogos warms the logo cache, giving up once the next refresh is due.
+func prefetchLogos(provider *proxytv.Provider, config *proxytv.Config) {
+	if config.LogoPrefetchConcurrency <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.RefreshInterval)
+	defer cancel()
+
+	if err := provider.PrefetchLogos(ctx, config.LogoPrefetchConcurrency); err != nil {
+		log.WithError(err).Warn("logo prefetch did not complete")
+	}
+}
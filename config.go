@@ -1,19 +1,45 @@
 package proxytv
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/creasty/defaults"
+	"golang.org/x/text/unicode/norm"
 	"gopkg.in/yaml.v3"
 )
 
 type Filter struct {
-	Value  string         `yaml:"filter"`
-	Type   string         `yaml:"type"`
-	regexp *regexp.Regexp // Compiled regular expression
+	Value string `yaml:"filter"`
+	Type  string `yaml:"type"`
+	// Normalize matches against a lowercased value with diacritics removed,
+	// using a pattern normalized the same way, so that "Espana" and "España"
+	// both match "ESPAÑA".
+	Normalize bool `yaml:"normalize,omitempty"`
+	// Separator splits hierarchical values such as "Sports / Football / UK"
+	// into segments. The filter then matches the full value or any segment,
+	// or only the segment at Depth (starting at 1) when Depth is set.
+	Separator string `yaml:"separator,omitempty"`
+	Depth     int    `yaml:"depth,omitempty"`
+	// Exact anchors the pattern so that it must match the whole value, so
+	// that "News" does not match "International News".
+	Exact bool `yaml:"exact,omitempty"`
+	// Exclude drops the tracks matching the filter, even if they also match
+	// an include filter.
+	Exclude bool `yaml:"exclude,omitempty"`
+	// Conditions, if set, are filters that must all match a track for it to
+	// match this filter, which then has no type or pattern of its own.
+	Conditions []*Filter      `yaml:"conditions,omitempty"`
+	regexp     *regexp.Regexp // Compiled regular expression
 }
 
 // GetRegexp returns the compiled regular expression
@@ -21,10 +47,148 @@ func (f *Filter) GetRegexp() *regexp.Regexp {
 	return f.regexp
 }
 
+// Validate checks the filter's type and options and compiles its pattern, or
+// those of each of its conditions.
+func (f *Filter) Validate() error {
+	if len(f.Conditions) > 0 {
+		if len(f.Type) > 0 || len(f.Value) > 0 {
+			return fmt.Errorf("a filter with conditions cannot have a type or pattern")
+		}
+		for i, condition := range f.Conditions {
+			if condition.Exclude || len(condition.Conditions) > 0 {
+				return fmt.Errorf("condition %d: conditions cannot be excluded or nested", i)
+			}
+			if err := condition.Validate(); err != nil {
+				return fmt.Errorf("condition %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+
+	if len(f.Type) == 0 || strings.ContainsAny(f.Type, " \t\"=") {
+		return fmt.Errorf("invalid type %q", f.Type)
+	}
+	if f.Depth < 0 {
+		return fmt.Errorf("invalid depth: %d", f.Depth)
+	}
+	if f.Depth > 0 && len(f.Separator) == 0 {
+		return fmt.Errorf("depth requires a separator")
+	}
+
+	pattern := f.Value
+	if f.Normalize {
+		pattern = stripDiacritics(pattern)
+	}
+	if f.Exact {
+		pattern = "^(?:" + pattern + ")$"
+	}
+	if f.Normalize {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression %q: %w", f.Value, err)
+	}
+	f.regexp = re
+	return nil
+}
+
+// String describes the filter as its type and pattern, e.g. "group:News", or
+// as its conditions joined by "&", prefixed with "!" if it is an exclude
+// filter.
+func (f *Filter) String() string {
+	desc := fmt.Sprintf("%s:%s", f.Type, f.Value)
+	if len(f.Conditions) > 0 {
+		conditions := make([]string, len(f.Conditions))
+		for i, condition := range f.Conditions {
+			conditions[i] = condition.String()
+		}
+		desc = strings.Join(conditions, "&")
+	}
+	if f.Exclude {
+		return "!" + desc
+	}
+	return desc
+}
+
+// matches reports whether value satisfies the filter.
+func (f *Filter) matches(value string) bool {
+	if f.Normalize {
+		value = normalizeText(value)
+	}
+	if len(f.Separator) == 0 {
+		return f.regexp.MatchString(value)
+	}
+
+	segments := strings.Split(value, f.Separator)
+	if f.Depth > 0 {
+		if f.Depth > len(segments) {
+			return false
+		}
+		return f.regexp.MatchString(strings.TrimSpace(segments[f.Depth-1]))
+	}
+
+	if f.regexp.MatchString(value) {
+		return true
+	}
+	for _, segment := range segments {
+		if f.regexp.MatchString(strings.TrimSpace(segment)) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeText lowercases s and strips its diacritics.
+func normalizeText(s string) string {
+	return strings.ToLower(stripDiacritics(s))
+}
+
+// stripDiacritics decomposes s (NFD) and drops the combining marks, so that
+// "España" becomes "Espana".
+func stripDiacritics(s string) string {
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if !unicode.Is(unicode.Mn, r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// EPGWindow limits how far ahead the guide extends for the channels of a group.
+type EPGWindow struct {
+	Group     string        `yaml:"group"`
+	Window    time.Duration `yaml:"-"`
+	WindowStr string        `yaml:"window"`
+}
+
+// SourceAuth holds the credentials sent with the requests for one kind of
+// source. Username and Password are sent as Basic auth, and Header, a
+// "Name: value" header such as "Authorization: Bearer ...", replaces them if
+// it has the same name.
+type SourceAuth struct {
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Header   string `yaml:"header,omitempty"`
+}
+
+// Lineup is an additional playlist built from the same source as the main one
+// using its own set of filters.
+type Lineup struct {
+	Name    string    `yaml:"name"`
+	Filters []*Filter `yaml:"filters"`
+}
+
 type Config struct {
 	LogLevel string `yaml:"logLevel,omitempty" default:"info"`
 	IPTVUrl  string `yaml:"iptvUrl"`
-	EPGUrl   string `yaml:"epgUrl"`
+	// IPTVUrls lists further playlists, loaded after iptvUrl and merged with
+	// it as though they were a single playlist.
+	IPTVUrls []string `yaml:"iptvUrls,omitempty"`
+	EPGUrl   string   `yaml:"epgUrl"`
+	// EPGUrls lists further guides, loaded after epgUrl and merged with it.
+	EPGUrls []string `yaml:"epgUrls,omitempty"`
 
 	ListenAddress string `yaml:"listenAddress,omitempty" default:":6078"`
 	ServerAddress string `yaml:"serverAddress"`
@@ -32,13 +196,179 @@ type Config struct {
 	UseFFMPEG    bool
 	UseFFMPEGPtr *bool `yaml:"ffmpeg,omitempty" default:"true"`
 	MaxStreams   int   `yaml:"maxStreams,omitempty" default:"1"`
+	// RelativeURLs emits rewritten channel URLs as host-less paths.
+	RelativeURLs bool `yaml:"relativeUrls,omitempty"`
+
+	StreamStallTimeout    time.Duration
+	StreamStallTimeoutStr string `yaml:"streamStallTimeout,omitempty" default:"30s"`
+	StreamStallRestarts   int    `yaml:"streamStallRestarts,omitempty" default:"0"`
+	StreamFormat          string `yaml:"streamFormat,omitempty" default:"mpegts"`
 
 	RefreshInterval    time.Duration
 	RefreshIntervalStr string `yaml:"refreshInterval,omitempty" default:"12h"`
+	// RefreshBackoffMax caps how far the refresh interval is doubled after
+	// consecutive failed refreshes. A value not above RefreshInterval disables
+	// the backoff.
+	RefreshBackoffMax    time.Duration `yaml:"-"`
+	RefreshBackoffMaxStr string        `yaml:"refreshBackoffMax,omitempty" default:"48h"`
+	// RefreshJitter adds a random delay of up to this long to each wait between
+	// refreshes, so that instances started together do not refresh together.
+	RefreshJitter    time.Duration `yaml:"-"`
+	RefreshJitterStr string        `yaml:"refreshJitter,omitempty" default:"0"`
+	// IPTVInterval and EPGInterval refresh the playlist and the EPG on their
+	// own schedules, reusing the other source's last download in between.
+	// Zero means refreshInterval.
+	IPTVInterval    time.Duration `yaml:"-"`
+	IPTVIntervalStr string        `yaml:"iptvInterval,omitempty" default:"0"`
+	EPGInterval     time.Duration `yaml:"-"`
+	EPGIntervalStr  string        `yaml:"epgInterval,omitempty" default:"0"`
+
+	// CacheDir, if set, keeps a copy of each downloaded source, which is read
+	// instead of the source while it is younger than CacheTTL.
+	CacheDir    string        `yaml:"cacheDir,omitempty"`
+	CacheTTL    time.Duration `yaml:"-"`
+	CacheTTLStr string        `yaml:"cacheTtl,omitempty" default:"1h"`
+
+	MaxDataAge    time.Duration
+	MaxDataAgeStr string `yaml:"maxDataAge,omitempty" default:"0"`
+	OnFailure     string `yaml:"onFailure,omitempty" default:"serve-stale"`
+	// MaxRefreshAge is how old the last successful refresh may be before
+	// /healthz reports the service as unhealthy. Zero means any age.
+	MaxRefreshAge    time.Duration `yaml:"-"`
+	MaxRefreshAgeStr string        `yaml:"maxRefreshAge,omitempty" default:"0"`
 
 	UserAgent string `yaml:"userAgent,omitempty" default:""`
+	// IPTVAuth and EPGAuth are sent with the requests for the playlist and
+	// the EPG sources respectively, and with no other requests.
+	IPTVAuth SourceAuth `yaml:"iptvAuth,omitempty"`
+	EPGAuth  SourceAuth `yaml:"epgAuth,omitempty"`
+	// MaxRetries is the number of times the EPG is fetched again when it
+	// fails to decode.
+	MaxRetries int `yaml:"maxRetries,omitempty" default:"2"`
+	// AsyncEPG publishes the playlists as soon as they are loaded and the EPG
+	// once it has loaded in the background.
+	AsyncEPG bool `yaml:"asyncEpg,omitempty"`
+
+	// Profile records per-phase timing and allocation stats for each refresh.
+	Profile bool `yaml:"profile,omitempty"`
+
+	HTTP2              bool  `yaml:"-"`
+	HTTP2Ptr           *bool `yaml:"http2,omitempty" default:"true"`
+	HTTPMaxIdleConns   int   `yaml:"httpMaxIdleConns,omitempty" default:"100"`
+	HTTPReadBufferSize int   `yaml:"httpReadBufferSize,omitempty" default:"0"`
+
+	HTTPTimeout    time.Duration `yaml:"-"`
+	HTTPTimeoutStr string        `yaml:"httpTimeout,omitempty" default:"5m"`
+	// HTTPRetries is the number of times a playlist or EPG download is retried
+	// after a connection error or a 5xx response.
+	HTTPRetries int `yaml:"httpRetries,omitempty" default:"2"`
+
+	EPGHeaderAttributes []string `yaml:"epgHeaderAttributes,omitempty"`
+	EPGSplitChannels    int      `yaml:"epgSplitChannels,omitempty" default:"0"`
+	// EmitPerChannelTvgURL sets each track's tvg-url to the guide part that
+	// holds its channel.
+	EmitPerChannelTvgURL bool   `yaml:"emitPerChannelTvgUrl,omitempty"`
+	EPGDuplicateChannels string `yaml:"epgDuplicateChannels,omitempty" default:"first"`
+	OutputIDCase         string `yaml:"outputIdCase,omitempty" default:"preserve"`
+	// EPGLanguages lists the preferred guide languages in order. Each
+	// programme keeps the titles and descriptions of the first listed
+	// language it has.
+	EPGLanguages []string `yaml:"epgLanguages,omitempty"`
+	// DefaultDesc is the description given to programmes without one, with
+	// "{title}" replaced by the programme's title.
+	DefaultDesc string `yaml:"defaultDesc,omitempty"`
+	// InferProgrammeStop sets the stop time of programmes that lack one to the
+	// start of the channel's next programme, dropping those it cannot infer.
+	InferProgrammeStop bool `yaml:"inferProgrammeStop,omitempty"`
+	// EPGWindows drops the programmes of a group's channels that start beyond
+	// the group's window from now.
+	EPGWindows []*EPGWindow `yaml:"epgWindows,omitempty"`
+	// EPGMaxDays, if set, drops the programmes that have ended or that start
+	// more than this many days from now.
+	EPGMaxDays int `yaml:"epgMaxDays,omitempty"`
+	// TimeShift moves the programmes of the channels with the given tvg-ids by
+	// a number of hours, which may be fractional or negative. The tvg-ids are
+	// matched after outputIdCase applies.
+	TimeShift map[string]float64 `yaml:"timeShift,omitempty"`
+
+	PreserveComments    bool `yaml:"preserveComments,omitempty"`
+	CanonicalAttributes bool `yaml:"canonicalAttributes,omitempty"`
+	// KeepAttributes, if set, limits the attributes of emitted EXTINF lines,
+	// which are rebuilt in canonical order, to those listed.
+	KeepAttributes []string `yaml:"keepAttributes,omitempty"`
+	// StripTags lists the attributes removed from emitted EXTINF lines.
+	StripTags    []string `yaml:"stripTags,omitempty" default:"[\"xui-id\"]"`
+	stripRegexps []*regexp.Regexp
+	LogoFromEPG  bool `yaml:"logoFromEpg,omitempty"`
+	// Logos maps tvg-ids to the logo given to their tracks when they have none.
+	Logos map[string]string `yaml:"logos,omitempty"`
+	// LogoBaseURL, if set, gives tracks with a tvg-id but no logo, and none in
+	// Logos, the logo LogoBaseURL + tvg-id + ".png".
+	LogoBaseURL string `yaml:"logoBaseUrl,omitempty"`
+	// ForceLogo applies Logos and LogoBaseURL to tracks that have a logo too.
+	ForceLogo  bool `yaml:"forceLogo,omitempty"`
+	DedupByURI bool `yaml:"dedupByUri,omitempty"`
+	// SynthesizeIDs gives tracks without a tvg-id one derived from their name
+	// and group.
+	SynthesizeIDs bool `yaml:"synthesizeIds,omitempty"`
+	// MatchByName keeps the guide channels whose display name matches the
+	// tvg-name, or title, of a track without a tvg-id.
+	MatchByName bool `yaml:"matchByName,omitempty"`
+	// TrimWhitespace trims the whitespace around track names and their
+	// tvg-id, tvg-name and group-title, and CollapseSpaces replaces runs of
+	// whitespace within them with a single space, before filtering and dedup.
+	TrimWhitespace bool `yaml:"trimWhitespace,omitempty"`
+	CollapseSpaces bool `yaml:"collapseSpaces,omitempty"`
+	// StripLeadingNumber removes numbering such as "101. " from track names,
+	// keeping the number as the tvg-chno.
+	StripLeadingNumber bool `yaml:"stripLeadingNumber,omitempty"`
+	// DedupKey is a template such as "{tvg-id}|{group-title}" whose expansion
+	// identifies duplicate tracks. Tracks are deduplicated by name if empty.
+	DedupKey string `yaml:"dedupKey,omitempty"`
+	// DefaultQualityRank is the quality tier given to tracks whose name has no
+	// quality marker when choosing between tracks with the same tvg-id.
+	DefaultQualityRank string `yaml:"defaultQualityRank,omitempty"`
+	// PreferPatterns are case-insensitive regular expressions, most preferred
+	// first, that decide which of the tracks with the same tvg-id is kept
+	// when no resolution tells them apart. Defaults to matching "HD".
+	PreferPatterns []string `yaml:"preferPatterns,omitempty"`
+	preferRegexps  []*regexp.Regexp
+
+	LogoCacheSize           int `yaml:"logoCacheSize,omitempty" default:"1000"`
+	LogoPrefetchConcurrency int `yaml:"logoPrefetchConcurrency,omitempty" default:"0"`
+
+	// HealthCheck drops channels whose stream URL fails to respond. Results
+	// are cached for HealthCheckTTL.
+	HealthCheck            bool          `yaml:"healthCheck,omitempty"`
+	HealthCheckConcurrency int           `yaml:"healthCheckConcurrency,omitempty" default:"8"`
+	HealthCheckTTL         time.Duration `yaml:"-"`
+	HealthCheckTTLStr      string        `yaml:"healthCheckTtl,omitempty" default:"1h"`
+
+	// SortBy orders channels by "priority", "rank", "name", "chno" or
+	// "group-then-name".
+	SortBy   string `yaml:"sortBy,omitempty" default:"priority"`
+	RankFile string `yaml:"rankFile,omitempty"`
+	// StableTieBreak orders tracks that sort equally by "id" (the default) or
+	// "name", then by group-title and stream URL, instead of by source order.
+	StableTieBreak string `yaml:"stableTieBreak,omitempty"`
+	// GroupOrder orders channels by group-title before sortBy applies, with
+	// groups that are not listed last.
+	GroupOrder []string `yaml:"groupOrder,omitempty"`
+	// RenumberChannels sets the tvg-chno of the emitted channels to sequential
+	// numbers from StartChannel, in playlist order.
+	RenumberChannels bool `yaml:"renumberChannels,omitempty"`
+	StartChannel     int  `yaml:"startChannel,omitempty" default:"1"`
+	// PreserveOrder emits channels in the order they were accepted from the
+	// source instead of sorting them.
+	PreserveOrder bool `yaml:"preserveOrder,omitempty"`
 
 	Filters []*Filter `yaml:"filters"`
+	Lineups []*Lineup `yaml:"lineups,omitempty"`
+
+	// SplitRadio moves radio channels, marked radio="true" or in one of
+	// RadioGroups, out of the main playlist into a separate radio playlist.
+	SplitRadio  bool     `yaml:"splitRadio,omitempty"`
+	RadioGroups []string `yaml:"radioGroups,omitempty"`
 }
 
 // LoadConfig reads a YAML config file from the given path and returns a Config pointer.
@@ -60,32 +390,176 @@ func LoadConfig(path string) (*Config, error) {
 	}
 
 	config.UseFFMPEG = *config.UseFFMPEGPtr
+	config.HTTP2 = *config.HTTP2Ptr
+
+	if config.RelativeURLs && !config.UseFFMPEG {
+		return nil, fmt.Errorf("relativeUrls requires ffmpeg, since only rewritten channel URLs can be relative")
+	}
+
+	if config.AsyncEPG && (config.LogoFromEPG || config.EmitPerChannelTvgURL) {
+		return nil, errAsyncEPGAttributes
+	}
+
+	if len(config.LogoBaseURL) > 0 && !isURL(config.LogoBaseURL) {
+		return nil, fmt.Errorf("invalid logoBaseUrl: %q is not a URL", config.LogoBaseURL)
+	}
 
 	config.RefreshInterval, err = time.ParseDuration(config.RefreshIntervalStr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid refreshInterval: %w", err)
 	}
 
-	if config.IPTVUrl == "" {
+	config.RefreshBackoffMax, err = time.ParseDuration(config.RefreshBackoffMaxStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refreshBackoffMax: %w", err)
+	}
+
+	config.RefreshJitter, err = time.ParseDuration(config.RefreshJitterStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refreshJitter: %w", err)
+	}
+
+	config.CacheTTL, err = time.ParseDuration(config.CacheTTLStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cacheTtl: %w", err)
+	}
+
+	config.IPTVInterval, err = time.ParseDuration(config.IPTVIntervalStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid iptvInterval: %w", err)
+	}
+
+	config.EPGInterval, err = time.ParseDuration(config.EPGIntervalStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid epgInterval: %w", err)
+	}
+
+	config.HTTPTimeout, err = time.ParseDuration(config.HTTPTimeoutStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid httpTimeout: %w", err)
+	}
+
+	config.MaxDataAge, err = time.ParseDuration(config.MaxDataAgeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxDataAge: %w", err)
+	}
+
+	config.MaxRefreshAge, err = time.ParseDuration(config.MaxRefreshAgeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxRefreshAge: %w", err)
+	}
+
+	config.StreamStallTimeout, err = time.ParseDuration(config.StreamStallTimeoutStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid streamStallTimeout: %w", err)
+	}
+
+	config.HealthCheckTTL, err = time.ParseDuration(config.HealthCheckTTLStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid healthCheckTtl: %w", err)
+	}
+
+	for i, window := range config.EPGWindows {
+		window.Window, err = time.ParseDuration(window.WindowStr)
+		if err != nil || window.Window <= 0 {
+			return nil, fmt.Errorf("invalid window in epgWindow %d: %q", i, window.WindowStr)
+		}
+	}
+
+	if len(config.iptvURLs()) == 0 {
 		return nil, fmt.Errorf("iptvUrl is required")
 	}
-	if config.EPGUrl == "" {
+	if len(config.epgURLs()) == 0 {
 		return nil, fmt.Errorf("epgUrl is required")
 	}
 	if config.ServerAddress == "" {
 		return nil, fmt.Errorf("serverAddress is required")
 	}
 
+	if _, ok := streamFormats[config.StreamFormat]; !ok {
+		return nil, fmt.Errorf("invalid streamFormat: %q", config.StreamFormat)
+	}
+
+	switch config.SortBy {
+	case "priority", "name", "chno", "group-then-name":
+	case "rank":
+		if config.RankFile == "" {
+			return nil, fmt.Errorf("rankFile is required when sortBy is rank")
+		}
+	default:
+		return nil, fmt.Errorf("invalid sortBy: %q", config.SortBy)
+	}
+
+	if config.PreserveOrder && (config.SortBy != "priority" || len(config.GroupOrder) > 0) {
+		return nil, fmt.Errorf("preserveOrder cannot be combined with sortBy %s or groupOrder", config.SortBy)
+	}
+
+	switch config.StableTieBreak {
+	case "", "id", "name":
+	default:
+		return nil, fmt.Errorf("invalid stableTieBreak: %q", config.StableTieBreak)
+	}
+
+	if _, ok := qualityRanks[config.DefaultQualityRank]; !ok && len(config.DefaultQualityRank) > 0 {
+		return nil, fmt.Errorf("invalid defaultQualityRank: %q", config.DefaultQualityRank)
+	}
+
+	switch config.EPGDuplicateChannels {
+	case "first", "merge":
+	default:
+		return nil, fmt.Errorf("invalid epgDuplicateChannels: %q", config.EPGDuplicateChannels)
+	}
+
+	switch config.OnFailure {
+	case "serve-stale", "error", "empty":
+	default:
+		return nil, fmt.Errorf("invalid onFailure: %q", config.OnFailure)
+	}
+
+	switch config.OutputIDCase {
+	case "preserve", "lower", "upper":
+	default:
+		return nil, fmt.Errorf("invalid outputIdCase: %q", config.OutputIDCase)
+	}
+
 	re := regexp.MustCompile(`^https?://`)
 	config.ServerAddress = re.ReplaceAllString(config.ServerAddress, "")
 
-	if err := validateFileOrURL(config.IPTVUrl); err != nil {
-		return nil, fmt.Errorf("invalid iptvUrl: %w", err)
+	stdinSources := 0
+	for _, uri := range append(config.iptvURLs(), config.epgURLs()...) {
+		if uri == stdinURI {
+			stdinSources++
+		}
 	}
-	if err := validateFileOrURL(config.EPGUrl); err != nil {
-		return nil, fmt.Errorf("invalid epgUrl: %w", err)
+	if stdinSources > 1 {
+		return nil, fmt.Errorf("only one source can be read from stdin")
 	}
 
+	for _, uri := range config.iptvURLs() {
+		if err := validateFileOrURL(uri); err != nil {
+			return nil, fmt.Errorf("invalid iptvUrl: %w", err)
+		}
+		if isSelfReferential(uri, config.ServerAddress) {
+			return nil, fmt.Errorf("invalid iptvUrl: %w", errSelfReferential)
+		}
+	}
+	for _, uri := range config.epgURLs() {
+		if err := validateFileOrURL(uri); err != nil {
+			return nil, fmt.Errorf("invalid epgUrl: %w", err)
+		}
+		if isSelfReferential(uri, config.ServerAddress) {
+			return nil, fmt.Errorf("invalid epgUrl: %w", errSelfReferential)
+		}
+	}
+
+	if _, err := config.sourceHeader(config.IPTVAuth); err != nil {
+		return nil, fmt.Errorf("invalid iptvAuth: %w", err)
+	}
+	if _, err := config.sourceHeader(config.EPGAuth); err != nil {
+		return nil, fmt.Errorf("invalid epgAuth: %w", err)
+	}
+
+	config.normalizeTimeShift()
 	if err := config.compileFilterRegexps(); err != nil {
 		return nil, err
 	}
@@ -93,18 +567,138 @@ func LoadConfig(path string) (*Config, error) {
 	return config, nil
 }
 
+// normalizeTimeShift applies outputIdCase to the tvg-ids of timeShift, so that
+// they match the guide's channel ids once those have been recased.
+func (c *Config) normalizeTimeShift() {
+	if len(c.TimeShift) == 0 {
+		return
+	}
+	shifts := make(map[string]float64, len(c.TimeShift))
+	for id, hours := range c.TimeShift {
+		shifts[applyIDCase(c.OutputIDCase, id)] = hours
+	}
+	c.TimeShift = shifts
+}
+
+// sourceHeader returns the header sent with the requests for sources: the
+// user agent, then Basic auth from the username and password of auth, then
+// its header, which replaces them if it has the same name.
+func (c *Config) sourceHeader(auth SourceAuth) (http.Header, error) {
+	header := make(http.Header)
+	if len(c.UserAgent) > 0 {
+		header.Set("User-Agent", c.UserAgent)
+	}
+	if len(auth.Username) > 0 || len(auth.Password) > 0 {
+		credentials := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+	if len(auth.Header) > 0 {
+		name, value, ok := strings.Cut(auth.Header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || len(name) == 0 || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header: expected \"Name: value\"")
+		}
+		header.Set(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// iptvURLs returns iptvUrl, if set, followed by iptvUrls.
+func (c *Config) iptvURLs() []string {
+	var urls []string
+	if len(c.IPTVUrl) > 0 {
+		urls = append(urls, c.IPTVUrl)
+	}
+	return append(urls, c.IPTVUrls...)
+}
+
+// epgURLs returns epgUrl, if set, followed by epgUrls.
+func (c *Config) epgURLs() []string {
+	var urls []string
+	if len(c.EPGUrl) > 0 {
+		urls = append(urls, c.EPGUrl)
+	}
+	return append(urls, c.EPGUrls...)
+}
+
 func (c *Config) compileFilterRegexps() error {
-	for i, filter := range c.Filters {
-		re, err := regexp.Compile(filter.Value)
+	if err := compileFilters(c.Filters); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(c.Lineups))
+	for _, lineup := range c.Lineups {
+		if lineup.Name == "" || strings.ContainsAny(lineup.Name, "/?#") {
+			return fmt.Errorf("invalid lineup name: %q", lineup.Name)
+		}
+		if names[lineup.Name] {
+			return fmt.Errorf("duplicate lineup name: %q", lineup.Name)
+		}
+		names[lineup.Name] = true
+
+		if err := compileFilters(lineup.Filters); err != nil {
+			return fmt.Errorf("lineup %q: %w", lineup.Name, err)
+		}
+	}
+
+	c.stripRegexps = nil
+	for _, tag := range c.StripTags {
+		c.stripRegexps = append(c.stripRegexps, regexp.MustCompile(`\s+`+regexp.QuoteMeta(tag)+`=(?:"[^"]*"|[^\s",]*)`))
+	}
+
+	c.preferRegexps = nil
+	for i, pattern := range c.PreferPatterns {
+		re, err := regexp.Compile("(?i)" + pattern)
 		if err != nil {
-			return fmt.Errorf("invalid regular expression in filter %d: %w", i, err)
+			return fmt.Errorf("invalid regular expression in preferPatterns %d: %w", i, err)
+		}
+		c.preferRegexps = append(c.preferRegexps, re)
+	}
+	return nil
+}
+
+func compileFilters(filters []*Filter) error {
+	for i, filter := range filters {
+		if err := filter.Validate(); err != nil {
+			return fmt.Errorf("filter %d: %w", i, err)
 		}
-		c.Filters[i].regexp = re
 	}
 	return nil
 }
 
+var errSelfReferential = errors.New("url points at proxytv's own server address")
+
+var errAsyncEPGAttributes = errors.New("asyncEpg cannot be combined with logoFromEpg or emitPerChannelTvgUrl, since the playlist is published before the EPG is loaded")
+
+// isSelfReferential reports whether uri is served from address, i.e. whether
+// loading it would make proxytv fetch its own output.
+func isSelfReferential(uri string, address string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || address == "" {
+		return false
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	host, addrPort, err := net.SplitHostPort(address)
+	if err != nil {
+		host, addrPort = address, "80"
+	}
+
+	return strings.EqualFold(u.Hostname(), host) && port == addrPort
+}
+
 func validateFileOrURL(input string) error {
+	if input == stdinURI {
+		return nil
+	}
+
 	// Check if it's a file
 	if _, err := os.Stat(input); err == nil {
 		return nil
@@ -100,6 +100,27 @@ maxStreams: 10
 		assert.Equal(t, 10, config.MaxStreams)
 		assert.Len(t, config.Filters, 0)
 		assert.Equal(t, 2*time.Hour, config.RefreshInterval)
+		assert.Equal(t, 30*time.Second, config.StreamStallTimeout)
+		assert.Equal(t, 0, config.StreamStallRestarts)
+		assert.Equal(t, "mpegts", config.StreamFormat)
+		assert.Equal(t, time.Duration(0), config.MaxDataAge)
+		assert.Equal(t, "serve-stale", config.OnFailure)
+		assert.Equal(t, 1000, config.LogoCacheSize)
+		assert.Equal(t, "priority", config.SortBy)
+		assert.True(t, config.HTTP2)
+		assert.Equal(t, 100, config.HTTPMaxIdleConns)
+		assert.Equal(t, 5*time.Minute, config.HTTPTimeout)
+		assert.Equal(t, 2, config.HTTPRetries)
+		assert.Equal(t, "first", config.EPGDuplicateChannels)
+		assert.Equal(t, 2, config.MaxRetries)
+		assert.Equal(t, 8, config.HealthCheckConcurrency)
+		assert.Equal(t, time.Hour, config.HealthCheckTTL)
+		assert.Equal(t, 48*time.Hour, config.RefreshBackoffMax)
+		assert.Equal(t, time.Duration(0), config.RefreshJitter)
+		assert.Equal(t, []string{"xui-id"}, config.StripTags)
+		assert.Equal(t, time.Hour, config.CacheTTL)
+		assert.Equal(t, time.Duration(0), config.MaxRefreshAge)
+		assert.Equal(t, 1, config.StartChannel)
 	})
 
 	// Test with invalid regular expression
@@ -132,7 +153,210 @@ filters:
 		config, err := LoadConfig(tmpfile.Name())
 		assert.Error(t, err)
 		assert.Nil(t, config)
-		assert.Contains(t, err.Error(), "invalid regular expression in filter 1")
+		assert.Contains(t, err.Error(), `filter 1: invalid regular expression "news["`)
+	})
+
+	// Test with relative URLs but no URL rewriting
+	t.Run("Relative URLs without ffmpeg", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+ffmpeg: false
+relativeUrls: true
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if _, err := tmpfile.Write(content); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+		assert.Contains(t, err.Error(), "relativeUrls requires ffmpeg")
+	})
+
+	t.Run("Async EPG with EPG-derived attributes", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+asyncEpg: true
+logoFromEpg: true
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if _, err := tmpfile.Write(content); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+		assert.Contains(t, err.Error(), "asyncEpg cannot be combined")
+	})
+
+	t.Run("Preserve order with group order", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+preserveOrder: true
+groupOrder: [News]
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if _, err := tmpfile.Write(content); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+		assert.Contains(t, err.Error(), "preserveOrder cannot be combined")
+	})
+
+	t.Run("Several stdin sources", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: "-"
+epgUrl: "-"
+serverAddress: iptvserver:8080
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if _, err := tmpfile.Write(content); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+		assert.Contains(t, err.Error(), "only one source can be read from stdin")
+	})
+
+	t.Run("Invalid logo base URL", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+logoBaseUrl: logos/
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if _, err := tmpfile.Write(content); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+		assert.Contains(t, err.Error(), "invalid logoBaseUrl")
+	})
+
+	t.Run("Source credentials", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+iptvAuth:
+  username: user
+  password: secret
+epgAuth:
+  header: "Authorization: Bearer token"
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if _, err := tmpfile.Write(content); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, SourceAuth{Username: "user", Password: "secret"}, config.IPTVAuth)
+		assert.Equal(t, SourceAuth{Header: "Authorization: Bearer token"}, config.EPGAuth)
+	})
+
+	t.Run("Filter with conditions", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+filters:
+  - conditions:
+      - filter: Sports
+        type: group
+      - filter: 4K
+        type: name
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if _, err := tmpfile.Write(content); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.NoError(t, err)
+		if assert.Len(t, config.Filters, 1) && assert.Len(t, config.Filters[0].Conditions, 2) {
+			assert.Equal(t, "group:Sports&name:4K", config.Filters[0].String())
+			assert.NotNil(t, config.Filters[0].Conditions[1].GetRegexp())
+		}
 	})
 
 	// Test with invalid IPTV and EPG URLs
@@ -176,6 +400,22 @@ serverAddress: iptvserver:8080
 		assert.Error(t, err)
 		assert.Nil(t, config)
 		assert.Contains(t, err.Error(), "invalid epgUrl")
+
+		// Test with an IPTV URL pointing at proxytv itself
+		content = []byte(`
+iptvUrl: http://iptvserver:8080/iptv.m3u
+epgUrl: http://example.com/epg
+serverAddress: http://iptvserver:8080
+`)
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err = LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+		assert.ErrorIs(t, err, errSelfReferential)
 	})
 
 	// Test with valid file paths for IPTV and EPG URLs
@@ -223,3 +463,25 @@ serverAddress: iptvserver:8080
 		assert.Equal(t, epgFile.Name(), config.EPGUrl)
 	})
 }
+
+func TestIsSelfReferential(t *testing.T) {
+	tests := []struct {
+		uri      string
+		address  string
+		expected bool
+	}{
+		{"http://iptvserver:8080/iptv.m3u", "iptvserver:8080", true},
+		{"http://IPTVServer:8080/iptv.m3u", "iptvserver:8080", true},
+		{"http://iptvserver/iptv.m3u", "iptvserver", true},
+		{"https://iptvserver/iptv.m3u", "iptvserver:443", true},
+		{"http://iptvserver:8081/iptv.m3u", "iptvserver:8080", false},
+		{"http://example.com/iptv.m3u", "iptvserver:8080", false},
+		{"/tmp/iptv.m3u", "iptvserver:8080", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isSelfReferential(tt.uri, tt.address))
+		})
+	}
+}
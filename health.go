@@ -0,0 +1,169 @@
+package proxytv
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+const healthCheckTimeout = 10 * time.Second
+
+type healthResult struct {
+	healthy bool
+	checked time.Time
+}
+
+// healthCache remembers the outcome of probing stream URLs so that they are
+// not probed again until their result is older than ttl.
+type healthCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	results map[string]healthResult
+}
+
+func newHealthCache(ttl time.Duration) *healthCache {
+	return &healthCache{ttl: ttl, results: make(map[string]healthResult)}
+}
+
+func (hc *healthCache) get(url string, now time.Time) (healthy bool, ok bool) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	result, ok := hc.results[url]
+	if !ok || now.Sub(result.checked) >= hc.ttl {
+		return false, false
+	}
+	return result.healthy, true
+}
+
+func (hc *healthCache) set(url string, healthy bool, now time.Time) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	hc.results[url] = healthResult{healthy: healthy, checked: now}
+}
+
+// probeURL reports whether a stream URL responds successfully.
+func (p *Provider) probeURL(url string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	if p.userAgent != "" {
+		req.Header.Set("User-Agent", p.userAgent)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.WithError(err).WithField("url", url).Debug("health check failed")
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < http.StatusBadRequest
+}
+
+// checkHealth probes the primary URL of every track in the playlists, with at
+// most healthCheckConcurrency probes in flight. A track whose URL fails is
+// kept on the first of its alternate URLs that passes, which becomes its
+// primary URL, and dropped if there is none. URLs probed within the last
+// healthCheckTTL are not probed again.
+func (p *Provider) checkHealth(playlists *playlistSet) {
+	now := p.now()
+	healthy := make(map[string]bool)
+	probed := 0
+	probe := func(urls []string) {
+		var unchecked []string
+		for _, url := range urls {
+			if _, seen := healthy[url]; seen {
+				continue
+			}
+			ok, cached := p.health.get(url, now)
+			healthy[url] = ok
+			if !cached {
+				unchecked = append(unchecked, url)
+			}
+		}
+
+		var lock sync.Mutex
+		var g errgroup.Group
+		g.SetLimit(max(p.config.HealthCheckConcurrency, 1))
+		for _, url := range unchecked {
+			g.Go(func() error {
+				ok := p.probeURL(url)
+				p.health.set(url, ok, now)
+				lock.Lock()
+				healthy[url] = ok
+				lock.Unlock()
+				return nil
+			})
+		}
+		g.Wait()
+		probed += len(unchecked)
+	}
+
+	var primaries []string
+	for _, pl := range playlists.all() {
+		for i := range pl.tracks {
+			if !pl.tracks[i].IsEmpty() {
+				primaries = append(primaries, pl.tracks[i].URI.String())
+			}
+		}
+	}
+	probe(primaries)
+
+	// Alternates are only probed for the tracks whose primary URL failed.
+	var alternates []string
+	for _, pl := range playlists.all() {
+		for i := range pl.tracks {
+			track := &pl.tracks[i]
+			if track.IsEmpty() || healthy[track.URI.String()] {
+				continue
+			}
+			for _, uri := range track.AltURIs {
+				alternates = append(alternates, uri.String())
+			}
+		}
+	}
+	probe(alternates)
+
+	for _, pl := range playlists.all() {
+		kept := pl.tracks[:0]
+		for _, track := range pl.tracks {
+			if track.IsEmpty() || healthy[track.URI.String()] || promoteHealthyAlternate(&track, healthy) {
+				kept = append(kept, track)
+				continue
+			}
+			if pl == playlists.main {
+				playlists.warnings.add("unhealthy-channel", track.LineNumber, "channel %q failed its health check", track.Name)
+			}
+		}
+		pl.tracks = kept
+	}
+
+	log.WithFields(log.Fields{
+		"urlCount":    len(healthy),
+		"probedCount": probed,
+	}).Info("checked channel health")
+}
+
+// promoteHealthyAlternate makes the first healthy alternate URL of track its
+// primary URL, dropping the failed one. It returns false if no alternate is
+// healthy.
+func promoteHealthyAlternate(track *Track, healthy map[string]bool) bool {
+	for i, uri := range track.AltURIs {
+		if healthy[uri.String()] {
+			track.URI = uri
+			track.AltURIs = slices.Delete(slices.Clone(track.AltURIs), i, i+1)
+			return true
+		}
+	}
+	return false
+}
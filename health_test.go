@@ -0,0 +1,119 @@
+package proxytv
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderHealthCheck(t *testing.T) {
+	var lock sync.Mutex
+	probes := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		probes[r.URL.Path]++
+		lock.Unlock()
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m3uFile, err := createTempFile(fmt.Sprintf(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+%[1]s/up
+#EXTINF:-1 tvg-id="id2",Channel 2
+%[1]s/down`, server.URL), "test_m3u_*.m3u")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(m3uFile.Name()) })
+	epgFile, err := createTempFile(emptyEpg, "test_epg_*.xml")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(epgFile.Name()) })
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl:                m3uFile.Name(),
+		EPGUrl:                 epgFile.Name(),
+		HealthCheck:            true,
+		HealthCheckConcurrency: 2,
+		HealthCheckTTL:         time.Hour,
+	})
+	require.NoError(t, err)
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+
+	require.NoError(t, provider.Refresh())
+	assert.Equal(t, "Channel 1", provider.GetTrack(0).Name)
+	assert.True(t, provider.GetTrack(1).IsEmpty())
+	assert.Equal(t, map[string]int{"/up": 1, "/down": 1}, probes)
+
+	// Within the TTL the cached results are reused.
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, provider.Refresh())
+	assert.True(t, provider.GetTrack(1).IsEmpty())
+	assert.Equal(t, map[string]int{"/up": 1, "/down": 1}, probes)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, provider.Refresh())
+	assert.Equal(t, map[string]int{"/up": 2, "/down": 2}, probes)
+}
+
+func TestProviderHealthCheckAlternates(t *testing.T) {
+	var lock sync.Mutex
+	probes := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		probes[r.URL.Path]++
+		lock.Unlock()
+		if r.URL.Path != "/up" && r.URL.Path != "/live" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m3uFile, err := createTempFile(fmt.Sprintf(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+%[1]s/up
+#EXTINF:-1 tvg-id="id1",Channel 1
+%[1]s/unused
+#EXTINF:-1 tvg-id="id2",Channel 2
+%[1]s/dead
+#EXTINF:-1 tvg-id="id2",Channel 2
+%[1]s/gone
+#EXTINF:-1 tvg-id="id2",Channel 2
+%[1]s/live
+#EXTINF:-1 tvg-id="id3",Channel 3
+%[1]s/down
+#EXTINF:-1 tvg-id="id3",Channel 3
+%[1]s/missing`, server.URL), "test_m3u_*.m3u")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(m3uFile.Name()) })
+	epgFile, err := createTempFile(emptyEpg, "test_epg_*.xml")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(epgFile.Name()) })
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl:        m3uFile.Name(),
+		EPGUrl:         epgFile.Name(),
+		HealthCheck:    true,
+		HealthCheckTTL: time.Hour,
+	})
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	assert.Equal(t, server.URL+"/up", provider.GetTrack(0).URI.String())
+	track := provider.GetTrack(1)
+	assert.Equal(t, "Channel 2", track.Name)
+	assert.Equal(t, server.URL+"/live", track.URI.String())
+	assert.Equal(t, []string{server.URL + "/live", server.URL + "/gone"}, track.urls())
+	assert.True(t, provider.GetTrack(2).IsEmpty())
+
+	// The alternates of a healthy track are not probed.
+	assert.Equal(t, map[string]int{"/up": 1, "/dead": 1, "/gone": 1, "/live": 1, "/down": 1, "/missing": 1}, probes)
+}
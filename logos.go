@@ -0,0 +1,200 @@
+package proxytv
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultLogoCacheSize = 1000
+
+// logo is a fetched channel logo image.
+type logo struct {
+	data        []byte
+	contentType string
+}
+
+type logoCacheEntry struct {
+	url  string
+	logo *logo
+}
+
+// logoCache is a fixed-size LRU cache of logos keyed by their upstream URL.
+type logoCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLogoCache(size int) *logoCache {
+	if size <= 0 {
+		size = defaultLogoCacheSize
+	}
+	return &logoCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (lc *logoCache) get(url string) (*logo, bool) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	elem, ok := lc.entries[url]
+	if !ok {
+		return nil, false
+	}
+	lc.order.MoveToFront(elem)
+	return elem.Value.(*logoCacheEntry).logo, true
+}
+
+func (lc *logoCache) add(url string, l *logo) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	if elem, ok := lc.entries[url]; ok {
+		elem.Value.(*logoCacheEntry).logo = l
+		lc.order.MoveToFront(elem)
+		return
+	}
+
+	lc.entries[url] = lc.order.PushFront(&logoCacheEntry{url: url, logo: l})
+	for lc.order.Len() > lc.size {
+		oldest := lc.order.Back()
+		lc.order.Remove(oldest)
+		delete(lc.entries, oldest.Value.(*logoCacheEntry).url)
+	}
+}
+
+func (lc *logoCache) purge() {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	lc.order.Init()
+	lc.entries = make(map[string]*list.Element)
+}
+
+func (lc *logoCache) len() int {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	return lc.order.Len()
+}
+
+// fetchLogo downloads the logo at url.
+func (p *Provider) fetchLogo(ctx context.Context, url string) (*logo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.userAgent != "" {
+		req.Header.Set("User-Agent", p.userAgent)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid logo response code: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logo{data: data, contentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// GetLogo returns the logo at url, fetching and caching it on a miss.
+func (p *Provider) GetLogo(ctx context.Context, url string) (data []byte, contentType string, err error) {
+	if l, ok := p.logos.get(url); ok {
+		return l.data, l.contentType, nil
+	}
+
+	l, err := p.fetchLogo(ctx, url)
+	if err != nil {
+		return nil, "", err
+	}
+	p.logos.add(url, l)
+
+	return l.data, l.contentType, nil
+}
+
+// logoURLs returns the distinct tvg-logo URLs of every published playlist.
+func (p *Provider) logoURLs() []string {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	var loaders []*playlistLoader
+	if p.playlist != nil {
+		loaders = append(loaders, p.playlist)
+	}
+	for _, pl := range p.lineups {
+		loaders = append(loaders, pl)
+	}
+	if p.radio != nil {
+		loaders = append(loaders, p.radio)
+	}
+
+	seen := make(map[string]bool)
+	var urls []string
+	for _, pl := range loaders {
+		for i := range pl.tracks {
+			url := pl.tracks[i].Tags["tvg-logo"]
+			if len(url) == 0 || seen[url] || !isURL(url) {
+				continue
+			}
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// PrefetchLogos fetches every uncached channel logo into the logo cache, with
+// at most concurrency downloads in flight. Logos that fail to download are
+// logged and skipped; the context's error is returned if it ends first.
+func (p *Provider) PrefetchLogos(ctx context.Context, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var g errgroup.Group
+	g.SetLimit(concurrency)
+
+	fetched := 0
+	for _, url := range p.logoURLs() {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, ok := p.logos.get(url); ok {
+			continue
+		}
+
+		fetched++
+		g.Go(func() error {
+			if _, _, err := p.GetLogo(ctx, url); err != nil && ctx.Err() == nil {
+				log.WithError(err).WithField("url", url).Warn("unable to prefetch logo")
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	log.WithFields(log.Fields{
+		"logoCount":   fetched,
+		"cachedCount": p.logos.len(),
+	}).Info("prefetched logos")
+
+	return ctx.Err()
+}
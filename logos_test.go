@@ -0,0 +1,109 @@
+package proxytv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderPrefetchLogos(t *testing.T) {
+	var lock sync.Mutex
+	hits := make(map[string]int)
+	var inFlight, maxInFlight int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+
+		lock.Lock()
+		hits[r.URL.Path]++
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	var m3u strings.Builder
+	m3u.WriteString("#EXTM3U\n")
+	for i := 0; i < 8; i++ {
+		fmt.Fprintf(&m3u, "#EXTINF:-1 tvg-id=\"id%d\" tvg-logo=\"%s/logo%d.png\",Channel %d\nhttp://example.com/channel%d\n", i, ts.URL, i%5, i, i)
+	}
+	m3u.WriteString("#EXTINF:-1 tvg-id=\"nologo\",No Logo\nhttp://example.com/nologo\n")
+
+	provider := newTestProvider(t, &Config{}, m3u.String(), emptyEpg)
+
+	require.NoError(t, provider.PrefetchLogos(context.Background(), 2))
+
+	assert.Len(t, hits, 5)
+	for path, count := range hits {
+		assert.Equal(t, 1, count, path)
+	}
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(2))
+
+	data, contentType, err := provider.GetLogo(context.Background(), ts.URL+"/logo3.png")
+	require.NoError(t, err)
+	assert.Equal(t, "/logo3.png", string(data))
+	assert.Equal(t, "image/png", contentType)
+
+	require.NoError(t, provider.PrefetchLogos(context.Background(), 2))
+	for path, count := range hits {
+		assert.Equal(t, 1, count, path)
+	}
+}
+
+func TestLogoCacheEviction(t *testing.T) {
+	cache := newLogoCache(2)
+	cache.add("a", &logo{data: []byte("a")})
+	cache.add("b", &logo{data: []byte("b")})
+	_, ok := cache.get("a")
+	assert.True(t, ok)
+
+	cache.add("c", &logo{data: []byte("c")})
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	_, ok = cache.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, cache.len())
+}
+
+func TestProviderPurgeCaches(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("logo"))
+	}))
+	defer ts.Close()
+
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-logo="`+ts.URL+`/1.png",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	for i := 0; i < 2; i++ {
+		_, _, err := provider.GetLogo(context.Background(), ts.URL+"/1.png")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	provider.PurgeCaches()
+
+	_, _, err := provider.GetLogo(context.Background(), ts.URL+"/1.png")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
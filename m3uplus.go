@@ -7,13 +7,23 @@ import (
 	"io"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type m3uHandler interface {
 	OnPlaylistStart()
+	// OnHeaderComment is called for comment lines and unknown directives that
+	// appear before the first track.
+	OnHeaderComment(line string)
 	OnTrack(track *Track)
+	// OnFooterComment is called for comment lines and unknown directives that
+	// appear after the last track.
+	OnFooterComment(line string)
 	OnPlaylistEnd()
 }
 
@@ -24,15 +34,113 @@ type Track struct {
 	Tags       map[string]string
 	Raw        string
 	LineNumber int
+	// Comments holds the comment lines that directly preceded the track's EXTINF line.
+	Comments []string
+	// Opts holds the player option lines, such as #EXTVLCOPT and #KODIPROP,
+	// between the track's EXTINF line and its URL.
+	Opts []string
+	// InnerLines holds every comment line and directive between the track's
+	// EXTINF line and its URL in their original order, including its Opts.
+	InnerLines []string
+	// AltURIs holds the URIs of duplicates of this track dropped during dedup.
+	AltURIs []*url.URL
+	// hasLength is set if the EXTINF line gave a duration other than -1, so
+	// that an explicit #EXTINF:0 is not rewritten to -1.
+	hasLength bool
+}
+
+// IsEmpty reports whether the track carries no stream, as is the case for the
+// value returned when a channel lookup fails.
+func (t *Track) IsEmpty() bool {
+	return t.URI == nil
+}
+
+// clone returns a copy of the track that shares no mutable state with t.
+func (t *Track) clone() Track {
+	c := *t
+	c.Tags = make(map[string]string, len(t.Tags))
+	for k, v := range t.Tags {
+		c.Tags[k] = v
+	}
+	c.Comments = append([]string(nil), t.Comments...)
+	c.Opts = append([]string(nil), t.Opts...)
+	c.InnerLines = append([]string(nil), t.InnerLines...)
+	c.AltURIs = append([]*url.URL(nil), t.AltURIs...)
+	return c
+}
+
+// urls returns the track's primary URI followed by its alternates.
+func (t *Track) urls() []string {
+	if t.IsEmpty() {
+		return nil
+	}
+
+	urls := make([]string, 0, len(t.AltURIs)+1)
+	urls = append(urls, t.URI.String())
+	for _, uri := range t.AltURIs {
+		urls = append(urls, uri.String())
+	}
+	return urls
+}
+
+func (t *Track) hasURI(uri *url.URL) bool {
+	if t.URI != nil && t.URI.String() == uri.String() {
+		return true
+	}
+	for _, alt := range t.AltURIs {
+		if alt.String() == uri.String() {
+			return true
+		}
+	}
+	return false
 }
 
 var errMalformedM3U = errors.New("malformed M3U provided")
 var errMissingExtinf = errors.New("URL found without preceding EXTINF")
 
-func loadM3u(r io.Reader, handler m3uHandler) error {
+// m3uSummary describes the outcome of parsing a playlist.
+type m3uSummary struct {
+	// Tracks is the number of tracks passed to the handler.
+	Tracks int
+	// SkippedLines is the number of malformed lines that were ignored: EXTINF
+	// lines that cannot be decoded or are not followed by a URL, URLs without
+	// an EXTINF and lines that are neither a directive nor a URL.
+	SkippedLines int
+}
+
+// loadM3u parses the playlist read from r, passing each track to handler.
+// Malformed lines are logged and skipped rather than failing the whole
+// playlist, except for a stream URL before the first EXTINF, which suggests
+// the source is not an extended M3U at all.
+func loadM3u(r io.Reader, handler m3uHandler) (m3uSummary, error) {
 	scanner := bufio.NewScanner(r)
 	lineNum := 0
+	var summary m3uSummary
 	var currentTrack *Track
+	var comments []string
+	seenHeader := false
+	seenTrack := false
+	// skipURI is set after an EXTINF that could not be decoded, so that its URL
+	// is skipped along with it.
+	skipURI := false
+
+	skip := func(reason string, line string) {
+		summary.SkippedLines++
+		log.WithFields(log.Fields{
+			"lineNumber": lineNum,
+			"line":       truncate(line, 64),
+		}).Warn(reason)
+	}
+	dropDangling := func() {
+		if currentTrack != nil {
+			summary.SkippedLines++
+			log.WithFields(log.Fields{
+				"lineNumber": currentTrack.LineNumber,
+				"name":       currentTrack.Name,
+			}).Warn("skipping EXTINF without a stream url")
+			currentTrack = nil
+		}
+	}
 
 	handler.OnPlaylistStart()
 
@@ -40,47 +148,127 @@ func loadM3u(r io.Reader, handler m3uHandler) error {
 		lineNum++
 		line := strings.TrimSpace(scanner.Text())
 
-		if lineNum == 1 && !strings.HasPrefix(line, "#EXTM3U") {
-			return errMalformedM3U
+		if !seenHeader {
+			line = strings.TrimPrefix(line, "\uFEFF")
+			if len(line) == 0 {
+				continue
+			}
+			if !strings.HasPrefix(line, "#EXTM3U") {
+				return summary, fmt.Errorf("%w: expected #EXTM3U header, found %q", errMalformedM3U, truncate(line, 64))
+			}
+			seenHeader = true
+			continue
 		}
 
+		if len(line) == 0 {
+			continue
+		}
+
+		sanitized := sanitizeURL(line)
+
 		switch {
 		case strings.HasPrefix(line, "#EXTINF:"):
-			if currentTrack != nil {
-				handler.OnTrack(currentTrack)
+			dropDangling()
+			seenTrack = true
+			length, name, tags, err := decodeInfoLine(line)
+			if err != nil {
+				skip("skipping malformed EXTINF", line)
+				comments = nil
+				skipURI = true
+				continue
 			}
+			skipURI = false
 			currentTrack = &Track{
+				Name:       name,
+				Length:     length,
+				Tags:       tags,
 				Raw:        line,
 				LineNumber: lineNum,
+				Comments:   comments,
+				hasLength:  hasExtinfLength(line),
 			}
-			var err error
-			currentTrack.Length, currentTrack.Name, currentTrack.Tags, err = decodeInfoLine(line)
-			if err != nil {
-				return err
-			}
+			comments = nil
 
-		case isURL(line):
+		case isURL(sanitized):
 			if currentTrack == nil {
-				return errMissingExtinf
+				if !seenTrack {
+					return summary, errMissingExtinf
+				}
+				if skipURI {
+					skipURI = false
+					summary.SkippedLines++
+					continue
+				}
+				skip("skipping stream url without EXTINF", line)
+				continue
+			}
+			if sanitized != line {
+				log.WithFields(log.Fields{
+					"lineNumber": lineNum,
+					"url":        sanitized,
+				}).Warn("escaped unsafe characters in stream url")
 			}
-			uri, _ := url.Parse(line)
+			uri, _ := url.Parse(sanitized)
 			currentTrack.URI = uri
 			handler.OnTrack(currentTrack)
+			summary.Tracks++
 			currentTrack = nil
+
+		case strings.HasPrefix(line, "#"):
+			if currentTrack != nil {
+				if isPlayerOpt(line) {
+					currentTrack.Opts = append(currentTrack.Opts, line)
+				}
+				currentTrack.InnerLines = append(currentTrack.InnerLines, line)
+				continue
+			}
+			if seenTrack {
+				comments = append(comments, line)
+			} else {
+				handler.OnHeaderComment(line)
+			}
+
+		default:
+			skip("skipping unrecognized playlist line", line)
 		}
 	}
 
-	if currentTrack != nil {
-		handler.OnTrack(currentTrack)
-	}
+	dropDangling()
 
 	if err := scanner.Err(); err != nil {
-		return err
+		return summary, err
+	}
+	if !seenHeader {
+		return summary, fmt.Errorf("%w: empty playlist", errMalformedM3U)
 	}
 
+	for _, line := range comments {
+		handler.OnFooterComment(line)
+	}
 	handler.OnPlaylistEnd()
 
-	return nil
+	return summary, nil
+}
+
+// playerOptPrefixes lists the directives that pass options for a track to the
+// player, e.g. its user agent or DRM settings.
+var playerOptPrefixes = []string{"#EXTVLCOPT:", "#KODIPROP:"}
+
+func isPlayerOpt(line string) bool {
+	for _, prefix := range playerOptPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate shortens s to at most n bytes for inclusion in an error message.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
 }
 
 func isURL(str string) bool {
@@ -88,10 +276,57 @@ func isURL(str string) bool {
 	return err == nil && u.Scheme != "" && u.Host != ""
 }
 
-var infoRegex = regexp.MustCompile(`([^\s="]+)=(?:"(.*?)"|(\d+))(?:,([.*^,]))?|#EXTINF:(-?\d*\s*)|,(.*)`)
+// sanitizeURL percent-encodes the characters of a stream URL that are not
+// valid in a URL, such as spaces or a '%' that does not start an escape
+// sequence. Valid URLs are returned unchanged, and so is a Kodi-style
+// "|User-Agent=..." header suffix.
+func sanitizeURL(str string) string {
+	str, headers, hasHeaders := strings.Cut(str, "|")
+
+	var sb strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case c == '%' && i+2 < len(str) && isHex(str[i+1]) && isHex(str[i+2]):
+			sb.WriteByte(c)
+		case c <= ' ' || c >= 0x7f || strings.IndexByte(`"%<>\^`+"`"+`{|}`, c) >= 0:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if hasHeaders {
+		sb.WriteString("|" + headers)
+	}
+	return sb.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// infoRegex matches the duration, the key=value attributes and the title of an
+// EXTINF line. Attribute values may be quoted or bare; quoted values may
+// contain commas, which only end the attributes outside of quotes. Every
+// attribute is kept so that unknown ones (e.g. tvg-rec) survive a
+// reconstructed line.
+var infoRegex = regexp.MustCompile(`([^\s=",]+)=(?:"(.*?)"|([^\s",]+))(?:,([.*^,]))?|#EXTINF:(-?\d*\s*)|,(.*)`)
+
+// hasExtinfLength reports whether an EXTINF line gives a duration other than
+// -1.
+func hasExtinfLength(line string) bool {
+	duration := strings.TrimPrefix(line, "#EXTINF:")
+	if end := strings.IndexAny(duration, " \t,"); end != -1 {
+		duration = duration[:end]
+	}
+	return len(duration) > 0 && duration != "-1"
+}
 
 func decodeInfoLine(line string) (float64, string, map[string]string, error) {
 	matches := infoRegex.FindAllStringSubmatch(line, -1)
+	if len(matches) < 2 {
+		return 0, "", nil, errors.New("missing channel name")
+	}
 	var err error
 	durationFloat := 0.0
 	durationStr := strings.TrimSpace(matches[0][len(matches[0])-2])
@@ -116,3 +351,115 @@ func decodeInfoLine(line string) (float64, string, map[string]string, error) {
 
 	return durationFloat, title, keyMap, nil
 }
+
+// canonicalAttributeOrder lists the attributes that lead a reconstructed EXTINF
+// line. Any other attributes follow in alphabetical order.
+var canonicalAttributeOrder = []string{"tvg-id", "tvg-name", "tvg-logo", "group-title"}
+
+// formatExtinf rebuilds the EXTINF line for a track from its parsed fields,
+// emitting attributes in canonical order.
+func formatExtinf(track *Track) string {
+	var sb strings.Builder
+	sb.WriteString("#EXTINF:")
+	if track.Length != 0 || track.hasLength {
+		sb.WriteString(strconv.FormatFloat(track.Length, 'f', -1, 64))
+	} else {
+		sb.WriteString("-1")
+	}
+
+	for _, key := range canonicalAttributeKeys(track.Tags) {
+		sb.WriteString(fmt.Sprintf(` %s="%s"`, key, track.Tags[key]))
+	}
+
+	sb.WriteString(",")
+	sb.WriteString(track.Name)
+
+	return sb.String()
+}
+
+func canonicalAttributeKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	known := make(map[string]bool, len(canonicalAttributeOrder))
+	for _, key := range canonicalAttributeOrder {
+		known[key] = true
+		if _, ok := tags[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	others := make([]string, 0, len(tags))
+	for key := range tags {
+		if !known[key] {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+
+	return append(keys, others...)
+}
+
+// setTag sets an attribute on the track, keeping the parsed tags and the raw
+// EXTINF line in sync.
+func (t *Track) setTag(key string, value string) {
+	if t.Tags == nil {
+		t.Tags = make(map[string]string)
+	}
+	t.Tags[key] = value
+	t.Raw = setExtinfAttr(t.Raw, key, value)
+}
+
+// setName renames the track, keeping the title of the raw EXTINF line in sync.
+func (t *Track) setName(name string) {
+	t.Name = name
+	if len(t.Raw) > 0 {
+		t.Raw = t.Raw[:extinfTitleIndex(t.Raw)] + "," + name
+	}
+}
+
+// extinfTitleIndex returns the index of the comma separating the attributes of
+// an EXTINF line from its title, ignoring commas inside quoted values. It
+// returns len(line) if there is no title.
+func extinfTitleIndex(line string) int {
+	inQuotes := false
+	for i, r := range line {
+		switch r {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				return i
+			}
+		}
+	}
+	return len(line)
+}
+
+// extinfAttrRegexps caches the regexps matching an attribute of an EXTINF
+// line, keyed by attribute name, since they are used for every track.
+var extinfAttrRegexps sync.Map
+
+// extinfAttrRegexp returns the regexp matching the attribute key and its
+// quoted or bare value.
+func extinfAttrRegexp(key string) *regexp.Regexp {
+	if re, ok := extinfAttrRegexps.Load(key); ok {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(`(?i)(?:^|\s)(` + regexp.QuoteMeta(key) + `=(?:"[^"]*"|[^\s"]*))`)
+	extinfAttrRegexps.Store(key, re)
+	return re
+}
+
+// setExtinfAttr replaces the value of key in an EXTINF line, appending the
+// attribute after the existing ones if it is not present.
+func setExtinfAttr(line string, key string, value string) string {
+	idx := extinfTitleIndex(line)
+	head, tail := line[:idx], line[idx:]
+	attr := fmt.Sprintf(`%s="%s"`, key, value)
+
+	re := extinfAttrRegexp(key)
+	if loc := re.FindStringSubmatchIndex(head); loc != nil {
+		return head[:loc[2]] + attr + head[loc[3]:] + tail
+	}
+
+	return head + " " + attr + tail
+}
@@ -18,6 +18,10 @@ func (m *mockHandler) OnPlaylistStart() {
 	m.playlistStartCalled = true
 }
 
+func (m *mockHandler) OnHeaderComment(line string) {}
+
+func (m *mockHandler) OnFooterComment(line string) {}
+
 func (m *mockHandler) OnTrack(t *Track) {
 	m.tracks = append(m.tracks, *t)
 }
@@ -60,12 +64,61 @@ http://example.com/channel2`,
 			},
 			wantErr: false,
 		},
+		{
+			name: "Commas in quoted attributes",
+			input: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News, US" tvg-name="Channel, One",Channel, One
+http://example.com/channel1`,
+			expected: mockHandler{
+				playlistStartCalled: true,
+				tracks: []Track{
+					{
+						Name:   "Channel, One",
+						Length: 0,
+						URI:    mustParseURL("http://example.com/channel1"),
+						Tags:   map[string]string{"tvg-id": "id1", "group-title": "News, US", "tvg-name": "Channel, One"},
+					},
+				},
+				playlistEndCalled: true,
+			},
+			wantErr: false,
+		},
 		{
 			name:     "Invalid M3U (missing #EXTM3U)",
 			input:    "Invalid content",
 			expected: mockHandler{},
 			wantErr:  true,
 		},
+		{
+			name:     "HTML error page",
+			input:    "<!DOCTYPE html>\n<html><body>Service Unavailable</body></html>",
+			expected: mockHandler{},
+			wantErr:  true,
+		},
+		{
+			name:     "Empty body",
+			input:    "",
+			expected: mockHandler{},
+			wantErr:  true,
+		},
+		{
+			name: "Blank lines and BOM before header",
+			input: "\n\uFEFF#EXTM3U\n" + `#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`,
+			expected: mockHandler{
+				playlistStartCalled: true,
+				tracks: []Track{
+					{
+						Name:   "Channel 1",
+						Length: 0,
+						URI:    mustParseURL("http://example.com/channel1"),
+						Tags:   map[string]string{"tvg-id": "id1"},
+					},
+				},
+				playlistEndCalled: true,
+			},
+			wantErr: false,
+		},
 		{
 			name: "Missing EXTINF",
 			input: `#EXTM3U
@@ -80,7 +133,7 @@ http://example.com/channel1`,
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			handler := &mockHandler{}
-			err := loadM3u(strings.NewReader(tt.input), handler)
+			_, err := loadM3u(strings.NewReader(tt.input), handler)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -101,7 +154,180 @@ http://example.com/channel1`,
 	}
 }
 
+func TestDecodeM3uSkipsMalformedLines(t *testing.T) {
+	input := `#EXTM3U
+
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+# a comment between tracks
+#EXTINF:-1 tvg-id="dangling",Dangling
+#EXTINF:- tvg-id="bad",Bad Duration
+http://example.com/bad
+#EXTINF:-1
+http://example.com/untitled
+not a url
+#EXTINF:-1 tvg-id="id2",Channel 2
+#EXTGRP:News
+
+http://example.com/channel2
+http://example.com/orphan
+#EXTINF:-1 tvg-id="trailing",Trailing`
+
+	handler := &mockHandler{}
+	summary, err := loadM3u(strings.NewReader(input), handler)
+	assert.NoError(t, err)
+	assert.Equal(t, m3uSummary{Tracks: 2, SkippedLines: 8}, summary)
+	assert.True(t, handler.playlistEndCalled)
+
+	if assert.Len(t, handler.tracks, 2) {
+		assert.Equal(t, "id1", handler.tracks[0].Tags["tvg-id"])
+		assert.Equal(t, "id2", handler.tracks[1].Tags["tvg-id"])
+		assert.Equal(t, mustParseURL("http://example.com/channel2"), handler.tracks[1].URI)
+		assert.Equal(t, 12, handler.tracks[1].LineNumber)
+	}
+}
+
+func TestDecodeM3uPlayerOptions(t *testing.T) {
+	input := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+#EXTVLCOPT:http-user-agent=Mozilla/5.0
+#EXTGRP:News
+#KODIPROP:inputstream.adaptive.license_type=com.widevine.alpha
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`
+
+	handler := &mockHandler{}
+	_, err := loadM3u(strings.NewReader(input), handler)
+	assert.NoError(t, err)
+
+	if assert.Len(t, handler.tracks, 2) {
+		assert.Equal(t, []string{
+			"#EXTVLCOPT:http-user-agent=Mozilla/5.0",
+			"#KODIPROP:inputstream.adaptive.license_type=com.widevine.alpha",
+		}, handler.tracks[0].Opts)
+		assert.Equal(t, []string{
+			"#EXTVLCOPT:http-user-agent=Mozilla/5.0",
+			"#EXTGRP:News",
+			"#KODIPROP:inputstream.adaptive.license_type=com.widevine.alpha",
+		}, handler.tracks[0].InnerLines)
+		assert.Empty(t, handler.tracks[1].Opts)
+	}
+}
+
 func mustParseURL(s string) *url.URL {
 	u, _ := url.Parse(s)
 	return u
 }
+
+func TestSetExtinfAttr(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		key      string
+		value    string
+		expected string
+	}{
+		{
+			name:     "Replace existing attribute",
+			line:     `#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1`,
+			key:      "tvg-id",
+			value:    "id2",
+			expected: `#EXTINF:-1 tvg-id="id2" tvg-name="name1",Channel 1`,
+		},
+		{
+			name:     "Append missing attribute",
+			line:     `#EXTINF:-1 tvg-id="id1" group-title="News, US",Channel 1`,
+			key:      "tvg-chno",
+			value:    "5",
+			expected: `#EXTINF:-1 tvg-id="id1" group-title="News, US" tvg-chno="5",Channel 1`,
+		},
+		{
+			name:     "Replace unquoted attribute",
+			line:     `#EXTINF:-1 tvg-chno=12 tvg-id="id1",Channel 1`,
+			key:      "tvg-chno",
+			value:    "5",
+			expected: `#EXTINF:-1 tvg-chno="5" tvg-id="id1",Channel 1`,
+		},
+		{
+			name:     "Does not touch title",
+			line:     `#EXTINF:-1 tvg-id="id1",tvg-name="fake"`,
+			key:      "tvg-name",
+			value:    "real",
+			expected: `#EXTINF:-1 tvg-id="id1" tvg-name="real",tvg-name="fake"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, setExtinfAttr(tt.line, tt.key, tt.value))
+		})
+	}
+
+	// The regexp for a key is compiled once.
+	assert.Same(t, extinfAttrRegexp("tvg-id"), extinfAttrRegexp("tvg-id"))
+}
+
+func TestFormatExtinfKeepsUnknownAttributes(t *testing.T) {
+	line := `#EXTINF:-1 tvg-rec="3" tvg-id="id1" catchup=default timeshift=2,Channel 1`
+	length, name, tags, err := decodeInfoLine(line)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"tvg-rec":   "3",
+		"tvg-id":    "id1",
+		"catchup":   "default",
+		"timeshift": "2",
+	}, tags)
+
+	track := &Track{Name: name, Length: length, Tags: tags}
+	assert.Equal(t, `#EXTINF:-1 tvg-id="id1" catchup="default" timeshift="2" tvg-rec="3",Channel 1`, formatExtinf(track))
+}
+
+func TestFormatExtinfKeepsLength(t *testing.T) {
+	handler := &mockHandler{}
+	_, err := loadM3u(strings.NewReader(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:0 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:10 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF: tvg-id="id1",Channel 1
+http://example.com/channel1`), handler)
+	assert.NoError(t, err)
+
+	var lines []string
+	for i := range handler.tracks {
+		lines = append(lines, formatExtinf(&handler.tracks[i]))
+	}
+	assert.Equal(t, []string{
+		`#EXTINF:-1 tvg-id="id1",Channel 1`,
+		`#EXTINF:0 tvg-id="id1",Channel 1`,
+		`#EXTINF:10 tvg-id="id1",Channel 1`,
+		`#EXTINF:-1 tvg-id="id1",Channel 1`,
+	}, lines)
+
+	// A track built in code without a length has an unknown duration.
+	assert.Equal(t, `#EXTINF:-1,Channel 1`, formatExtinf(&Track{Name: "Channel 1"}))
+}
+
+func TestSanitizeURL(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"http://example.com/channel1", "http://example.com/channel1"},
+		{"http://example.com/my channel.ts", "http://example.com/my%20channel.ts"},
+		{"http://example.com/live?name=a b{c}", "http://example.com/live?name=a%20b%7Bc%7D"},
+		{"http://example.com/live.ts|User-Agent=Mozilla/5.0 (X11)&Referer=http://example.com/", "http://example.com/live.ts|User-Agent=Mozilla/5.0 (X11)&Referer=http://example.com/"},
+		{"http://example.com/my live.ts|User-Agent=VLC", "http://example.com/my%20live.ts|User-Agent=VLC"},
+		{"http://example.com/100%.ts", "http://example.com/100%25.ts"},
+		{"http://example.com/a%20b", "http://example.com/a%20b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.expected, sanitizeURL(tt.input))
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package proxytv
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// manifest describes the data a provider serves, for clients that want it
+// in a single document.
+type manifest struct {
+	Version      string            `json:"version"`
+	LastRefresh  *time.Time        `json:"lastRefresh,omitempty"`
+	ChannelCount int               `json:"channelCount"`
+	Groups       []manifestGroup   `json:"groups"`
+	Lineups      []manifestLineup  `json:"lineups"`
+	EPG          manifestEPG       `json:"epg"`
+	Endpoints    manifestEndpoints `json:"endpoints"`
+}
+
+type manifestGroup struct {
+	Name         string `json:"name"`
+	ChannelCount int    `json:"channelCount"`
+}
+
+type manifestLineup struct {
+	Name         string `json:"name"`
+	ChannelCount int    `json:"channelCount"`
+	M3u          string `json:"m3u"`
+}
+
+type manifestEPG struct {
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+}
+
+type manifestEndpoints struct {
+	M3u     string `json:"m3u"`
+	EPG     string `json:"epg"`
+	EPGJSON string `json:"epgJson"`
+	Logo    string `json:"logo"`
+	Radio   string `json:"radio,omitempty"`
+}
+
+// endpointURL returns the URL of path on the server, or path itself when no
+// serverAddress is configured.
+func (p *Provider) endpointURL(path string) string {
+	if len(p.config.ServerAddress) == 0 {
+		return path
+	}
+	return fmt.Sprintf("http://%s%s", p.config.ServerAddress, path)
+}
+
+// Manifest returns a JSON document describing the published data: the
+// channel count and groups of the main playlist, the lineups, the guide's
+// coverage, the endpoint URLs, the last refresh time and the content version.
+func (p *Provider) Manifest() []byte {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	m := manifest{
+		Version: p.version,
+		Groups:  []manifestGroup{},
+		Lineups: []manifestLineup{},
+		Endpoints: manifestEndpoints{
+			M3u:     p.endpointURL("/iptv.m3u"),
+			EPG:     p.endpointURL("/epg.xml"),
+			EPGJSON: p.endpointURL("/epg.json"),
+			Logo:    p.endpointURL("/logo/{channelId}"),
+		},
+	}
+	if !p.lastRefresh.IsZero() {
+		m.LastRefresh = &p.lastRefresh
+	}
+	if p.playlist != nil {
+		m.ChannelCount = len(p.playlist.tracks)
+	}
+	if !p.coverage.from.IsZero() {
+		m.EPG = manifestEPG{From: &p.coverage.from, To: &p.coverage.to}
+	}
+	if p.config.SplitRadio {
+		m.Endpoints.Radio = p.endpointURL("/radio.m3u")
+	}
+
+	for name, count := range p.groupCounts() {
+		m.Groups = append(m.Groups, manifestGroup{Name: name, ChannelCount: count})
+	}
+	sort.Slice(m.Groups, func(i, j int) bool { return m.Groups[i].Name < m.Groups[j].Name })
+
+	for name, pl := range p.lineups {
+		m.Lineups = append(m.Lineups, manifestLineup{
+			Name:         name,
+			ChannelCount: len(pl.tracks),
+			M3u:          p.endpointURL(fmt.Sprintf("/lineup/%s/iptv.m3u", name)),
+		})
+	}
+	sort.Slice(m.Lineups, func(i, j int) bool { return m.Lineups[i].Name < m.Lineups[j].Name })
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.WithError(err).Error("unable to marshal manifest")
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,48 @@
+package proxytv
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderManifest(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="Sports",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" group-title="Sports",Channel 3
+http://example.com/channel3`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`
+
+	provider := newTestProvider(t, &Config{
+		ServerAddress: "proxytv:8080",
+		Lineups:       []*Lineup{{Name: "sports", Filters: []*Filter{{Type: "group", Value: "Sports"}}}},
+	}, m3u, epg)
+
+	var m manifest
+	require.NoError(t, json.Unmarshal(provider.Manifest(), &m))
+
+	assert.Equal(t, 3, m.ChannelCount)
+	assert.Equal(t, []manifestGroup{{Name: "News", ChannelCount: 1}, {Name: "Sports", ChannelCount: 2}}, m.Groups)
+	assert.Equal(t, []manifestLineup{{Name: "sports", ChannelCount: 2, M3u: "http://proxytv:8080/lineup/sports/iptv.m3u"}}, m.Lineups)
+	assert.Equal(t, manifestEndpoints{
+		M3u:     "http://proxytv:8080/iptv.m3u",
+		EPG:     "http://proxytv:8080/epg.xml",
+		EPGJSON: "http://proxytv:8080/epg.json",
+		Logo:    "http://proxytv:8080/logo/{channelId}",
+	}, m.Endpoints)
+	require.NotNil(t, m.EPG.From)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), m.EPG.From.UTC())
+	assert.Equal(t, provider.ContentVersion(), m.Version)
+	require.NotNil(t, m.LastRefresh)
+	assert.True(t, m.LastRefresh.Equal(provider.GetLastRefresh()))
+}
@@ -0,0 +1,129 @@
+package proxytv
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// providerMetrics holds the Prometheus metrics describing the published data
+// and the refreshes that produced it. Each provider has its own registry so
+// that providers do not share state.
+type providerMetrics struct {
+	registry        *prometheus.Registry
+	groupChannels   *prometheus.GaugeVec
+	refreshes       prometheus.Counter
+	refreshFailures prometheus.Counter
+	refreshDuration prometheus.Gauge
+	lastRefresh     prometheus.Gauge
+	channelCount    prometheus.Gauge
+	programmeCount  prometheus.Gauge
+}
+
+func newProviderMetrics() *providerMetrics {
+	m := &providerMetrics{
+		registry: prometheus.NewRegistry(),
+		groupChannels: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "proxytv",
+			Name:      "group_channels",
+			Help:      "Number of channels in the main playlist per group-title.",
+		}, []string{"group"}),
+		refreshes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proxytv",
+			Name:      "refreshes_total",
+			Help:      "Number of refreshes attempted.",
+		}),
+		refreshFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proxytv",
+			Name:      "refresh_failures_total",
+			Help:      "Number of refreshes that failed.",
+		}),
+		refreshDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proxytv",
+			Name:      "refresh_duration_seconds",
+			Help:      "Duration of the last refresh.",
+		}),
+		lastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proxytv",
+			Name:      "last_refresh_timestamp_seconds",
+			Help:      "Unix time of the last successful refresh.",
+		}),
+		channelCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proxytv",
+			Name:      "channels",
+			Help:      "Number of channels in the main playlist.",
+		}),
+		programmeCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proxytv",
+			Name:      "programmes",
+			Help:      "Number of programmes in the published guide.",
+		}),
+	}
+	m.registry.MustRegister(m.collectors()...)
+	return m
+}
+
+func (m *providerMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.groupChannels,
+		m.refreshes,
+		m.refreshFailures,
+		m.refreshDuration,
+		m.lastRefresh,
+		m.channelCount,
+		m.programmeCount,
+	}
+}
+
+// update sets the gauges from the published playlist. Groups that no longer
+// have channels are removed.
+func (m *providerMetrics) update(groups map[string]int, channels int, refreshed time.Time) {
+	if m == nil {
+		return
+	}
+	m.groupChannels.Reset()
+	for group, count := range groups {
+		m.groupChannels.WithLabelValues(group).Set(float64(count))
+	}
+	m.channelCount.Set(float64(channels))
+	m.lastRefresh.Set(float64(refreshed.Unix()))
+}
+
+// updateEPG sets the gauges from the published guide.
+func (m *providerMetrics) updateEPG(programmes int) {
+	if m == nil {
+		return
+	}
+	m.programmeCount.Set(float64(programmes))
+}
+
+// observeRefresh records a refresh that took duration and failed if err is set.
+func (m *providerMetrics) observeRefresh(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.refreshes.Inc()
+	if err != nil {
+		m.refreshFailures.Inc()
+	}
+	m.refreshDuration.Set(duration.Seconds())
+}
+
+// MetricsHandler returns an HTTP handler serving the provider's metrics in the
+// Prometheus exposition format.
+func (p *Provider) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(p.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterMetrics additionally registers the provider's metrics on reg, e.g.
+// prometheus.DefaultRegisterer, for applications that serve their own metrics.
+func (p *Provider) RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range p.metrics.collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
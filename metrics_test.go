@@ -0,0 +1,80 @@
+package proxytv
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderGroupChannelMetrics(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="News",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" group-title="Sports",Channel 3
+http://example.com/channel3
+#EXTINF:-1 tvg-id="id4" group-title="Movies",Channel 4
+http://example.com/channel4`
+
+	provider := newTestProvider(t, &Config{
+		Filters: []*Filter{{Type: "group", Value: "News|Sports"}},
+	}, m3u, emptyEpg)
+
+	assert.Equal(t, map[string]int{"News": 2, "Sports": 1}, provider.GroupCounts())
+	gauges := provider.metrics.groupChannels
+	assert.Equal(t, 2, testutil.CollectAndCount(gauges))
+	assert.Equal(t, 2.0, testutil.ToFloat64(gauges.WithLabelValues("News")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(gauges.WithLabelValues("Sports")))
+
+	rec := httptest.NewRecorder()
+	provider.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `proxytv_group_channels{group="News"} 2`)
+}
+
+func TestProviderRefreshMetrics(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>Morning</title></programme>
+  <programme start="20240101010000 +0000" stop="20240101020000 +0000" channel="id1"><title>Noon</title></programme>
+</tv>`)
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, provider.RegisterMetrics(registry))
+
+	require.NoError(t, os.WriteFile(provider.iptvURLs[0], []byte("not a playlist"), 0644))
+	assert.Error(t, provider.Refresh())
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP proxytv_channels Number of channels in the main playlist.
+# TYPE proxytv_channels gauge
+proxytv_channels 2
+# HELP proxytv_programmes Number of programmes in the published guide.
+# TYPE proxytv_programmes gauge
+proxytv_programmes 2
+# HELP proxytv_refresh_failures_total Number of refreshes that failed.
+# TYPE proxytv_refresh_failures_total counter
+proxytv_refresh_failures_total 1
+# HELP proxytv_refreshes_total Number of refreshes attempted.
+# TYPE proxytv_refreshes_total counter
+proxytv_refreshes_total 2
+`), "proxytv_channels", "proxytv_programmes", "proxytv_refresh_failures_total", "proxytv_refreshes_total"))
+
+	m := provider.metrics
+	assert.Equal(t, float64(provider.GetLastRefresh().Unix()), testutil.ToFloat64(m.lastRefresh))
+	assert.Greater(t, testutil.ToFloat64(m.refreshDuration), 0.0)
+}
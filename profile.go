@@ -0,0 +1,102 @@
+package proxytv
+
+import (
+	"io"
+	"runtime"
+	"time"
+)
+
+// PhaseProfile holds the timing and allocation stats of one refresh phase.
+type PhaseProfile struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	// AllocBytes and Allocs are the heap bytes and objects allocated during
+	// the phase.
+	AllocBytes uint64 `json:"allocBytes"`
+	Allocs     uint64 `json:"allocs"`
+}
+
+// RefreshProfile is the record of a profiled refresh.
+type RefreshProfile struct {
+	Start          time.Time      `json:"start"`
+	Duration       time.Duration  `json:"duration"`
+	Phases         []PhaseProfile `json:"phases"`
+	TrackCount     int            `json:"trackCount"`
+	ProgrammeCount int            `json:"programmeCount"`
+	M3uBytes       int64          `json:"m3uBytes"`
+	EPGBytes       int64          `json:"epgBytes"`
+}
+
+// refreshProfiler builds a RefreshProfile. A nil profiler records nothing, so
+// that Refresh can call it unconditionally.
+type refreshProfiler struct {
+	profile RefreshProfile
+}
+
+func newRefreshProfiler() *refreshProfiler {
+	return &refreshProfiler{profile: RefreshProfile{Start: time.Now()}}
+}
+
+// phase starts timing the named phase. The returned function ends it.
+func (rp *refreshProfiler) phase(name string) func() {
+	if rp == nil {
+		return func() {}
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	return func() {
+		duration := time.Since(start)
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		rp.profile.Phases = append(rp.profile.Phases, PhaseProfile{
+			Name:       name,
+			Duration:   duration,
+			AllocBytes: after.TotalAlloc - before.TotalAlloc,
+			Allocs:     after.Mallocs - before.Mallocs,
+		})
+	}
+}
+
+// countM3u and countEPG return readers that count the bytes read from r into
+// the profile.
+func (rp *refreshProfiler) countM3u(r io.Reader) io.Reader {
+	if rp == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &rp.profile.M3uBytes}
+}
+
+func (rp *refreshProfiler) countEPG(r io.Reader) io.Reader {
+	if rp == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &rp.profile.EPGBytes}
+}
+
+func (rp *refreshProfiler) finish(playlists *playlistSet, epgProgrammes int) *RefreshProfile {
+	if rp == nil {
+		return nil
+	}
+
+	for _, pl := range playlists.all() {
+		rp.profile.TrackCount += len(pl.tracks)
+	}
+	rp.profile.ProgrammeCount = epgProgrammes
+	rp.profile.Duration = time.Since(rp.profile.Start)
+
+	return &rp.profile
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	*cr.n += int64(n)
+	return n, err
+}
@@ -1,36 +1,128 @@
 package proxytv
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/csfrancis/proxytv/xmltv"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/text/encoding/ianaindex"
 )
 
+// Warning describes a data-quality issue found while loading provider data.
+type Warning struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Line is the line of the source M3U or EPG the warning refers to, if any.
+	Line int `json:"line,omitempty"`
+}
+
+type warnings []Warning
+
+func (w *warnings) add(kind string, line int, format string, args ...any) {
+	*w = append(*w, Warning{Kind: kind, Message: fmt.Sprintf(format, args...), Line: line})
+}
+
+// trackCollector gathers the parsed tracks of a playlist so that they can be
+// replayed through several playlistLoaders without reparsing.
+type trackCollector struct {
+	tracks         []Track
+	headerComments []string
+	footerComments []string
+	skippedLines   int
+}
+
+func (tc *trackCollector) OnPlaylistStart() {}
+
+func (tc *trackCollector) OnHeaderComment(line string) {
+	tc.headerComments = append(tc.headerComments, line)
+}
+
+func (tc *trackCollector) OnTrack(track *Track) {
+	tc.tracks = append(tc.tracks, *track)
+}
+
+func (tc *trackCollector) OnFooterComment(line string) {
+	tc.footerComments = append(tc.footerComments, line)
+}
+
+func (tc *trackCollector) OnPlaylistEnd() {}
+
+func (tc *trackCollector) replay(handler m3uHandler) {
+	handler.OnPlaylistStart()
+	for _, line := range tc.headerComments {
+		handler.OnHeaderComment(line)
+	}
+	for i := range tc.tracks {
+		track := tc.tracks[i].clone()
+		handler.OnTrack(&track)
+	}
+	for _, line := range tc.footerComments {
+		handler.OnFooterComment(line)
+	}
+	handler.OnPlaylistEnd()
+}
+
 type playlistLoader struct {
 	baseAddress string
+	channelPath string
 	filters     []*Filter
+	config      *Config
+	// include, if set, rejects the tracks it returns false for before any
+	// filtering.
+	include func(track *Track) bool
 
-	tracks     []Track
-	priorities map[string]int
-	m3u        strings.Builder
+	tracks         []Track
+	priorities     map[string]int
+	uris           map[string]string
+	headerComments []string
+	footerComments []string
+	warnings       warnings
+	ranks          map[string]float64
+	// filterMatches counts the tracks each filter matched, or is nil if the
+	// loader does not report its filters. matched holds the filters that
+	// matched the current track.
+	filterMatches []int
+	matched       []bool
+	// accepted counts the tracks that passed filtering, before dedup, and
+	// droppedWithoutID the tracks without a tvg-id that did not.
+	accepted         int
+	droppedWithoutID int
 }
 
-func newPlaylistLoader(baseAddress string, filters []*Filter) *playlistLoader {
+func newPlaylistLoader(baseAddress string, filters []*Filter, config *Config) *playlistLoader {
 	return &playlistLoader{
-		baseAddress: baseAddress,
-		filters:     filters,
-		tracks:      make([]Track, 0, len(filters)),
-		priorities:  make(map[string]int),
+		baseAddress:   baseAddress,
+		channelPath:   "channel",
+		filters:       filters,
+		config:        config,
+		tracks:        make([]Track, 0, len(filters)),
+		priorities:    make(map[string]int),
+		uris:          make(map[string]string),
+		filterMatches: make([]int, len(filters)),
 	}
 }
 
@@ -48,311 +140,2851 @@ func (pl *playlistLoader) findIndexWithID(track *Track) int {
 	return -1
 }
 
-func (pl *playlistLoader) OnPlaylistStart() {
-	pl.m3u.Reset()
-	pl.m3u.WriteString("#EXTM3U\n")
+func (pl *playlistLoader) OnPlaylistStart() {}
+
+func (pl *playlistLoader) OnHeaderComment(line string) {
+	pl.headerComments = append(pl.headerComments, line)
+}
+
+func (pl *playlistLoader) OnFooterComment(line string) {
+	pl.footerComments = append(pl.footerComments, line)
 }
 
 func (pl *playlistLoader) OnTrack(track *Track) {
-	if len(pl.filters) == 0 {
-		pl.processTrack(track, 0)
+	// Every filter is matched first, so that filterMatches counts the tracks
+	// of the whole source.
+	pl.matched = pl.matched[:0]
+	for i, filter := range pl.filters {
+		matched := matchesTrack(filter, track)
+		if matched && pl.filterMatches != nil {
+			pl.filterMatches[i]++
+		}
+		pl.matched = append(pl.matched, matched)
+	}
+
+	if pl.include != nil && !pl.include(track) {
 		return
 	}
 
+	// Exclude filters win: a track matching any of them is dropped even if it
+	// also matches an include filter.
+	included := false
 	for i, filter := range pl.filters {
-		var field string
-		switch filter.Type {
-		case "id":
-			field = "tvg-id"
-		case "group":
-			field = "group-title"
-		case "name":
-			field = "tvg-name"
-		default:
-			log.WithField("type", filter.Type).Panic("invalid filter type")
-		}
-
-		val := track.Tags[field]
-		if len(val) == 0 {
+		if !filter.Exclude {
+			included = true
 			continue
 		}
+		if pl.matched[i] {
+			pl.drop(track)
+			return
+		}
+	}
+
+	if !included {
+		pl.accepted++
+		pl.processTrack(track, 0)
+		return
+	}
 
-		if filter.regexp.Match([]byte(val)) {
+	counted := false
+	for i, filter := range pl.filters {
+		if !filter.Exclude && pl.matched[i] {
+			if !counted {
+				pl.accepted++
+				counted = true
+			}
 			pl.processTrack(track, i)
 		}
 	}
+	if !counted {
+		pl.drop(track)
+	}
+}
+
+// drop records a track left out by the filters.
+func (pl *playlistLoader) drop(track *Track) {
+	if len(track.Tags["tvg-id"]) == 0 {
+		pl.droppedWithoutID++
+	}
+}
+
+// matchesTrack reports whether track satisfies filter, or all of its
+// conditions if it has any.
+func matchesTrack(filter *Filter, track *Track) bool {
+	if len(filter.Conditions) > 0 {
+		for _, condition := range filter.Conditions {
+			if !matchesTrack(condition, track) {
+				return false
+			}
+		}
+		return true
+	}
+	val := filterValue(filter, track)
+	return len(val) > 0 && filter.matches(val)
+}
+
+// filterValue returns the value of track that filter is matched against. The
+// types "id", "group" and "name" are aliases for the tvg-id, group-title and
+// tvg-name tags.
+func filterValue(filter *Filter, track *Track) string {
+	switch filter.Type {
+	case "id":
+		return track.Tags["tvg-id"]
+	case "group":
+		return track.Tags["group-title"]
+	case "name":
+		return track.Tags["tvg-name"]
+	case "resolution":
+		if height := resolutionHeight(track.Name); height > 0 {
+			return strconv.Itoa(height)
+		}
+		return ""
+	case "any":
+		return allTagValues(track)
+	default:
+		// Any other type names a tag directly, e.g. "tvg-chno". Tracks without
+		// the tag do not match.
+		return track.Tags[filter.Type]
+	}
 }
 
 func (pl *playlistLoader) processTrack(track *Track, priority int) {
-	name := track.Name
+	key := pl.dedupKey(track)
 
 	if len(track.Tags["tvg-id"]) == 0 {
 		log.WithField("track", track).Debug("missing tvg-id")
 	}
 
-	if existingPriority, exists := pl.priorities[name]; !exists || priority < existingPriority {
-		idx := pl.findIndexWithID(track)
+	if pl.config.DedupByURI && track.URI != nil {
+		if owner, exists := pl.uris[track.URI.String()]; exists && owner != key {
+			log.WithField("track", track).Debug("duplicate uri")
+			return
+		}
+	}
+
+	if existingPriority, exists := pl.priorities[key]; !exists || priority < existingPriority {
+		// A configured dedupKey replaces the default matching on tvg-id.
+		idx := -1
+		if len(pl.config.DedupKey) == 0 {
+			idx = pl.findIndexWithID(track)
+		}
 		if idx != -1 {
-			if strings.Contains(track.Name, "HD") {
-				delete(pl.priorities, pl.tracks[idx].Name)
+			if pl.preferTrack(track, &pl.tracks[idx]) {
+				replaced := pl.tracks[idx]
+				delete(pl.priorities, pl.dedupKey(&replaced))
 				pl.tracks[idx] = *track
+				pl.addAlternate(idx, &replaced)
+				pl.recordURI(track)
 			} else {
+				pl.addAlternate(idx, track)
 				return
 			}
 		} else {
 			if !exists {
 				pl.tracks = append(pl.tracks, *track)
+				pl.recordURI(track)
+			} else {
+				pl.addAlternate(pl.findIndexWithKey(key), track)
 			}
 		}
-		pl.priorities[name] = priority
+		pl.priorities[key] = priority
 	} else {
-		log.WithField("track", track).Warn("duplicate name")
+		if pl.addAlternate(pl.findIndexWithKey(key), track) {
+			log.WithField("track", track).Warn("duplicate name")
+			pl.warnings.add("duplicate-name", track.LineNumber, "duplicate channel name %q", track.Name)
+		}
 	}
 }
 
-func (pl *playlistLoader) OnPlaylistEnd() {
-	sort.SliceStable(pl.tracks, func(i, j int) bool {
-		priorityI, existsI := pl.priorities[pl.tracks[i].Name]
-		priorityJ, existsJ := pl.priorities[pl.tracks[j].Name]
-
-		if !existsI && !existsJ {
-			return false // Keep original order for unmatched elements
-		}
-		if !existsI {
-			return false // Unmatched elements go to the end
-		}
-		if !existsJ {
-			return true // Matched elements come before unmatched ones
+// allTagValues joins the track's title and the values of all its tags, in
+// canonical attribute order, into a single space-separated string.
+func allTagValues(track *Track) string {
+	values := []string{strings.TrimSpace(track.Name)}
+	for _, key := range canonicalAttributeKeys(track.Tags) {
+		if v := strings.TrimSpace(track.Tags[key]); len(v) > 0 {
+			values = append(values, v)
 		}
-		return priorityI < priorityJ
-	})
-
-	rewriteURL := len(pl.baseAddress) > 0
+	}
+	return strings.TrimSpace(strings.Join(values, " "))
+}
 
-	reXuiid := regexp.MustCompile(`xui-id="\{[^"]*\}"\s*`)
+var resolutionRegex = regexp.MustCompile(`(?i)\b(\d{3,4})[pi]\b`)
 
-	for i := range len(pl.tracks) {
-		track := pl.tracks[i]
-		uri := track.URI.String()
-		if rewriteURL {
-			uri = fmt.Sprintf("http://%s/channel/%d", pl.baseAddress, i)
+// resolutionHeight returns the pixel height of the highest resolution token
+// (e.g. "1080p") in name, or 0 if there is none.
+func resolutionHeight(name string) int {
+	height := 0
+	for _, match := range resolutionRegex.FindAllStringSubmatch(name, -1) {
+		if h, err := strconv.Atoi(match[1]); err == nil && h > height {
+			height = h
 		}
-		// Remove xui-id from the tags
-		fixedRaw := reXuiid.ReplaceAllString(track.Raw, "")
-		pl.m3u.WriteString(fmt.Sprintf("%s\n%s\n", fixedRaw, uri))
 	}
+	return height
 }
 
-func loadReader(uri string, userAgent string) (io.ReadCloser, error) {
-	var err error
-	var reader io.ReadCloser
-	logger := log.WithField("uri", uri)
-	if isURL(uri) {
-		req, err := http.NewRequest(http.MethodGet, uri, nil)
-		if err != nil {
-			logger.WithError(err).Panic("unable to create request")
-		}
-		if userAgent != "" {
-			req.Header.Set("User-Agent", userAgent)
-		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			logger.WithError(err).Panic("unable to load uri")
-		}
+// qualityMarkers maps the quality keywords recognised in track names to the
+// pixel height they rank as.
+var qualityMarkers = []struct {
+	re     *regexp.Regexp
+	height int
+}{
+	{regexp.MustCompile(`(?i)\b(UHD|4K)\b`), 2160},
+	{regexp.MustCompile(`(?i)\bFHD\b`), 1080},
+	{regexp.MustCompile(`(?i)\bHD\b`), 720},
+	{regexp.MustCompile(`(?i)\bSD\b`), 480},
+}
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("invalid url response code: %d", resp.StatusCode)
-		}
+// qualityRanks maps the values of defaultQualityRank to the rank given to
+// tracks without a quality marker.
+var qualityRanks = map[string]int{
+	"lowest":  0,
+	"sd":      480,
+	"hd":      720,
+	"fhd":     1080,
+	"uhd":     2160,
+	"highest": math.MaxInt,
+}
 
-		reader = resp.Body
-	} else {
-		reader, err = os.Open(uri)
-		if err != nil {
-			return nil, err
+// qualityRank ranks a track name by its resolution token, then by its quality
+// keyword, falling back to the rank of defaultRank.
+func qualityRank(name string, defaultRank string) int {
+	if height := resolutionHeight(name); height > 0 {
+		return height
+	}
+	for _, marker := range qualityMarkers {
+		if marker.re.MatchString(name) {
+			return marker.height
 		}
 	}
-
-	return reader, nil
+	return qualityRanks[defaultRank]
 }
 
-type Provider struct {
-	iptvURL     string
-	epgURL      string
-	baseAddress string
-	userAgent   string
-	filters     []*Filter
-
-	playlist    *playlistLoader
-	epg         *xmltv.TV
-	epgData     []byte
-	lastRefresh time.Time
-}
+// defaultPreferRegexps are used when no preferPatterns are configured.
+var defaultPreferRegexps = []*regexp.Regexp{regexp.MustCompile("(?i)HD")}
 
-func NewProvider(config *Config) (*Provider, error) {
-	provider := &Provider{
-		iptvURL: config.IPTVUrl,
-		epgURL:  config.EPGUrl,
-		filters: config.Filters,
+// preferTrack reports whether track should replace existing, a track with the
+// same tvg-id. With a defaultQualityRank, the track of higher quality rank
+// wins and ties keep existing. Otherwise a higher resolution wins when both
+// names carry one, and then the track matching the most preferred of
+// preferPatterns wins, with ties going to the newer track.
+func (pl *playlistLoader) preferTrack(track *Track, existing *Track) bool {
+	if len(pl.config.DefaultQualityRank) > 0 {
+		return qualityRank(track.Name, pl.config.DefaultQualityRank) > qualityRank(existing.Name, pl.config.DefaultQualityRank)
 	}
 
-	if len(config.UserAgent) > 0 {
-		provider.userAgent = config.UserAgent
+	height, existingHeight := resolutionHeight(track.Name), resolutionHeight(existing.Name)
+	if height > 0 && existingHeight > 0 && height != existingHeight {
+		return height > existingHeight
 	}
 
-	if config.UseFFMPEG {
-		provider.baseAddress = config.ServerAddress
+	patterns := pl.config.preferRegexps
+	if len(patterns) == 0 {
+		patterns = defaultPreferRegexps
 	}
+	rank := preferRank(track.Name, patterns)
+	return rank > 0 && rank >= preferRank(existing.Name, patterns)
+}
 
-	return provider, nil
+// preferRank ranks name by the first of patterns it matches, from
+// len(patterns) for the first pattern down to 1 for the last, or 0 if it
+// matches none.
+func preferRank(name string, patterns []*regexp.Regexp) int {
+	for i, re := range patterns {
+		if re.MatchString(name) {
+			return len(patterns) - i
+		}
+	}
+	return 0
 }
 
-func (p *Provider) loadXMLTv(reader io.Reader) (*xmltv.TV, error) {
-	start := time.Now()
+func (pl *playlistLoader) recordURI(track *Track) {
+	if track.URI != nil {
+		pl.uris[track.URI.String()] = pl.dedupKey(track)
+	}
+}
 
-	channels := make(map[string]bool)
-	for _, track := range p.playlist.tracks {
-		id := track.Tags["tvg-id"]
-		if len(id) == 0 {
-			continue
+func (pl *playlistLoader) findIndexWithKey(key string) int {
+	for i := range pl.tracks {
+		if pl.dedupKey(&pl.tracks[i]) == key {
+			return i
 		}
-		channels[id] = true
 	}
+	return -1
+}
 
-	decoder := xml.NewDecoder(reader)
-	tvSetup := new(xmltv.TV)
+var dedupKeyPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
 
-	totalChannelCount := 0
-	totalProgrammeCount := 0
+// dedupKey returns the key under which tracks are considered duplicates: the
+// configured dedupKey template with each {tag} replaced by the track's value
+// for that tag ({name} for the track title), or the track name by default.
+func (pl *playlistLoader) dedupKey(track *Track) string {
+	if len(pl.config.DedupKey) == 0 {
+		return track.Name
+	}
+	return dedupKeyPlaceholder.ReplaceAllStringFunc(pl.config.DedupKey, func(placeholder string) string {
+		tag := placeholder[1 : len(placeholder)-1]
+		if tag == "name" {
+			return track.Name
+		}
+		return track.Tags[tag]
+	})
+}
 
-	for {
-		// Decode the next XML token
-		tok, err := decoder.Token()
-		if err != nil {
-			break // Exit on EOF or error
+// addAlternate records the URIs of a track discarded during dedup as fallbacks
+// for the track at idx. It returns false if the track adds no new URIs, as
+// happens when the same track matches several filters.
+func (pl *playlistLoader) addAlternate(idx int, track *Track) bool {
+	if idx == -1 {
+		return false
+	}
+
+	kept := &pl.tracks[idx]
+	added := false
+	for _, uri := range append([]*url.URL{track.URI}, track.AltURIs...) {
+		if uri == nil || kept.hasURI(uri) {
+			continue
 		}
+		kept.AltURIs = append(kept.AltURIs, uri)
+		added = true
+	}
+	return added
+}
 
-		// Process the start element
-		switch se := tok.(type) {
-		case xml.StartElement:
-			switch se.Name.Local {
-			case "tv":
-				for _, attr := range se.Attr {
-					switch attr.Name.Local {
-					case "date":
-						tvSetup.Date = attr.Value
-					case "source-info-url":
-						tvSetup.SourceInfoURL = attr.Value
-					case "source-info-name":
-						tvSetup.SourceInfoName = attr.Value
-					case "source-data-url":
-						tvSetup.SourceDataURL = attr.Value
-					case "generator-info-name":
-						tvSetup.GeneratorInfoName = attr.Value
-					case "generator-info-url":
-						tvSetup.GeneratorInfoURL = attr.Value
-					}
-				}
-			case "programme":
-				var programme xmltv.Programme
-				err := decoder.DecodeElement(&programme, &se)
-				if err != nil {
-					return nil, err
-				}
-				if channels[programme.Channel] {
-					tvSetup.Programmes = append(tvSetup.Programmes, programme)
-				}
-				totalProgrammeCount++
-			case "channel":
-				var channel xmltv.Channel
-				err := decoder.DecodeElement(&channel, &se)
-				if err != nil {
-					return nil, err
-				}
-				if channels[channel.ID] {
-					tvSetup.Channels = append(tvSetup.Channels, channel)
-				}
-				totalChannelCount++
-			}
+func (pl *playlistLoader) OnPlaylistEnd() {
+	for i, count := range pl.filterMatches {
+		if count == 0 {
+			filter := pl.filters[i]
+			log.WithField("filter", filter.String()).Warn("filter matched no tracks")
+			pl.warnings.add("unmatched-filter", 0, "filter %s matched no tracks", filter)
 		}
 	}
 
-	log.WithFields(log.Fields{
-		"totalChannelCount":   totalChannelCount,
-		"channelCount":        len(tvSetup.Channels),
-		"totalProgrammeCount": totalProgrammeCount,
-		"programmeCount":      len(tvSetup.Programmes),
-		"duration":            time.Since(start),
-	}).Info("loaded xmltv")
+	if !pl.config.PreserveOrder {
+		pl.sortTracks()
+	}
 
-	return tvSetup, nil
+	for i := range pl.tracks {
+		track := &pl.tracks[i]
+		if id, ok := track.Tags["tvg-id"]; ok {
+			if cased := applyIDCase(pl.config.OutputIDCase, id); cased != id {
+				track.setTag("tvg-id", cased)
+			}
+		}
+		if logo := pl.logoFor(track); len(logo) > 0 {
+			track.setTag("tvg-logo", logo)
+		}
+	}
 }
 
-func (p *Provider) Refresh() error {
-	var err error
-	log.WithField("url", p.iptvURL).Info("loading IPTV m3u")
+// filterStats maps each filter to the number of tracks it matched.
+func (pl *playlistLoader) filterStats() map[string]int {
+	stats := make(map[string]int)
+	for i, count := range pl.filterMatches {
+		stats[pl.filters[i].String()] += count
+	}
+	return stats
+}
 
-	start := time.Now()
-	iptvReader, err := loadReader(p.iptvURL, p.userAgent)
-	if err != nil {
-		return err
+// logoFor returns the logo configured for the track by logos or logoBaseUrl,
+// or "" if there is none or the track keeps its own logo.
+func (pl *playlistLoader) logoFor(track *Track) string {
+	if len(track.Tags["tvg-logo"]) > 0 && !pl.config.ForceLogo {
+		return ""
+	}
+	id := track.Tags["tvg-id"]
+	if len(id) == 0 {
+		return ""
+	}
+	if logo, ok := pl.config.Logos[id]; ok {
+		return logo
+	}
+	if len(pl.config.LogoBaseURL) > 0 {
+		return pl.config.LogoBaseURL + url.PathEscape(id) + ".png"
 	}
-	defer iptvReader.Close()
-	log.WithField("duration", time.Since(start)).Debug("loaded IPTV m3u")
+	return ""
+}
 
-	pl := newPlaylistLoader(p.baseAddress, p.filters)
-	err = loadM3u(iptvReader, pl)
-	if err != nil {
-		return err
+// sortTracks orders the accepted tracks by groupOrder, then by sortBy.
+func (pl *playlistLoader) sortTracks() {
+	groupRanks := make(map[string]int, len(pl.config.GroupOrder))
+	for i, group := range pl.config.GroupOrder {
+		if _, exists := groupRanks[group]; !exists {
+			groupRanks[group] = i
+		}
+	}
+	groupRank := func(track *Track) int {
+		if rank, ok := groupRanks[track.Tags["group-title"]]; ok {
+			return rank
+		}
+		return len(pl.config.GroupOrder) // Unlisted groups go last
 	}
-	p.playlist = pl
 
-	log.WithField("channelCount", len(p.playlist.tracks)).Info("parsed IPTV m3u")
+	sort.SliceStable(pl.tracks, func(i, j int) bool {
+		a, b := &pl.tracks[i], &pl.tracks[j]
+		if rankA, rankB := groupRank(a), groupRank(b); rankA != rankB {
+			return rankA < rankB
+		}
+		switch pl.config.SortBy {
+		case "rank":
+			if pl.rankLess(a, b) != pl.rankLess(b, a) {
+				return pl.rankLess(a, b)
+			}
+			return pl.tieBreakLess(a, b)
+		case "name", "chno", "group-then-name":
+			if less, ok := sortKeyLess(pl.config.SortBy, a, b); ok {
+				return less
+			}
+			return pl.tieBreakLess(a, b)
+		}
 
-	log.WithField("url", p.epgURL).Info("loading EPG")
+		priorityI, existsI := pl.priorities[pl.dedupKey(a)]
+		priorityJ, existsJ := pl.priorities[pl.dedupKey(b)]
 
-	start = time.Now()
-	epgReader, err := loadReader(p.epgURL, p.userAgent)
-	if err != nil {
-		return err
-	}
-	defer epgReader.Close()
-	log.WithField("duration", time.Since(start)).Debug("loaded EPG")
+		if !existsI && !existsJ {
+			return pl.tieBreakLess(a, b) // Unmatched elements only tie-break
+		}
+		if !existsI {
+			return false // Unmatched elements go to the end
+		}
+		if !existsJ {
+			return true // Matched elements come before unmatched ones
+		}
+		if priorityI == priorityJ {
+			return pl.tieBreakLess(a, b)
+		}
+		return priorityI < priorityJ
+	})
+}
 
-	p.epg, err = p.loadXMLTv(epgReader)
-	if err != nil {
-		return err
+// tieBreakLess orders tracks that sort equally by tvg-id and then name, or by
+// name and then tvg-id with a "name" stableTieBreak, so that the output does
+// not depend on source order. Tracks with the same tvg-id and name are ordered
+// by group-title and then by stream URL.
+func (pl *playlistLoader) tieBreakLess(a *Track, b *Track) bool {
+	idA, idB := a.Tags["tvg-id"], b.Tags["tvg-id"]
+	if pl.config.StableTieBreak == "name" {
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if idA != idB {
+			return idA < idB
+		}
+	} else {
+		if idA != idB {
+			return idA < idB
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+	}
+	if groupA, groupB := a.Tags["group-title"], b.Tags["group-title"]; groupA != groupB {
+		return groupA < groupB
 	}
+	return trackURI(a) < trackURI(b)
+}
 
-	xmlData, err := xml.Marshal(p.epg)
-	if err != nil {
-		return err
+// trackURI returns the track's stream URL, or "" if it has none.
+func trackURI(track *Track) string {
+	if track.URI == nil {
+		return ""
 	}
+	return track.URI.String()
+}
 
-	xmlHeader := []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><!DOCTYPE tv SYSTEM \"xmltv.dtd\">")
-	p.epgData = append(xmlHeader, xmlData...)
+// rankLess orders tracks by descending rank score, with unranked tracks last.
+func (pl *playlistLoader) rankLess(a *Track, b *Track) bool {
+	scoreA, rankedA := pl.ranks[a.Tags["tvg-id"]]
+	scoreB, rankedB := pl.ranks[b.Tags["tvg-id"]]
+	if !rankedA || !rankedB {
+		return rankedA && !rankedB
+	}
+	return scoreA > scoreB
+}
 
-	p.lastRefresh = time.Now()
+// sortKeyLess compares tracks by the key of the given sortBy mode, ignoring
+// case in names and groups. Tracks missing the key, or with a tvg-chno that is
+// not an integer, come after those that have it. ok is false if the tracks
+// sort equally.
+func sortKeyLess(sortBy string, a *Track, b *Track) (less bool, ok bool) {
+	switch sortBy {
+	case "chno":
+		chnoA, errA := strconv.Atoi(strings.TrimSpace(a.Tags["tvg-chno"]))
+		chnoB, errB := strconv.Atoi(strings.TrimSpace(b.Tags["tvg-chno"]))
+		if (errA == nil) != (errB == nil) {
+			return errA == nil, true
+		}
+		if errA == nil && chnoA != chnoB {
+			return chnoA < chnoB, true
+		}
+		return false, false
+	case "group-then-name":
+		if less, ok := textKeyLess(a.Tags["group-title"], b.Tags["group-title"]); ok {
+			return less, true
+		}
+	}
+	return textKeyLess(a.Name, b.Name)
+}
 
-	return nil
+// textKeyLess compares two sort keys case-insensitively, with empty keys last.
+func textKeyLess(a string, b string) (less bool, ok bool) {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if a == b {
+		return false, false
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return len(b) == 0, true
+	}
+	return a < b, true
 }
 
-func (p *Provider) GetM3u() string {
-	return p.playlist.m3u.String()
+// writeM3u renders the accepted tracks to w, pointing channels at their
+// rewritten URLs when a base address is set. The playlist is rendered on each
+// call rather than kept in memory.
+func (pl *playlistLoader) writeM3u(w io.Writer) error {
+	return pl.renderM3u(w, len(pl.baseAddress) > 0)
 }
 
-func (p *Provider) GetEpgXML() string {
-	return string(p.epgData)
+func (pl *playlistLoader) m3uString() string {
+	var m3u strings.Builder
+	pl.writeM3u(&m3u)
+	return m3u.String()
 }
 
-var trackNotFound = Track{}
+// renderM3u writes the playlist to w, pointing channels at their rewritten
+// URLs if rewriteURL is set and at their upstream URLs otherwise.
+func (pl *playlistLoader) renderM3u(w io.Writer, rewriteURL bool) error {
+	m3u := bufio.NewWriter(w)
+	m3u.WriteString("#EXTM3U")
+	if len(pl.config.ServerAddress) > 0 {
+		epgURL := fmt.Sprintf("http://%s/epg.xml", pl.config.ServerAddress)
+		for _, attr := range pl.config.EPGHeaderAttributes {
+			fmt.Fprintf(m3u, ` %s="%s"`, attr, epgURL)
+		}
+	}
+	m3u.WriteString("\n")
 
-func (p *Provider) GetTrack(idx int) *Track {
-	if idx >= len(p.playlist.tracks) {
-		return &trackNotFound
+	if pl.config.PreserveComments {
+		for _, line := range pl.headerComments {
+			m3u.WriteString(line + "\n")
+		}
 	}
-	return &p.playlist.tracks[idx]
-}
 
-func (p *Provider) GetLastRefresh() time.Time {
-	return p.lastRefresh
+	for i := range len(pl.tracks) {
+		track := &pl.tracks[i]
+		uri := pl.trackURL(i, rewriteURL)
+		extinf := track.Raw
+		if len(pl.config.KeepAttributes) > 0 {
+			kept := *track
+			kept.Tags = make(map[string]string, len(pl.config.KeepAttributes))
+			for _, key := range pl.config.KeepAttributes {
+				if value, ok := track.Tags[key]; ok {
+					kept.Tags[key] = value
+				}
+			}
+			extinf = formatExtinf(&kept)
+		} else if pl.config.CanonicalAttributes {
+			extinf = formatExtinf(track)
+		}
+		if rewriteURL && len(track.Tags["catchup-source"]) > 0 && (len(pl.config.KeepAttributes) == 0 || slices.Contains(pl.config.KeepAttributes, "catchup-source")) {
+			extinf = setExtinfAttr(extinf, "catchup-source", pl.catchupSource(i))
+		}
+		for _, re := range pl.config.stripRegexps {
+			extinf = re.ReplaceAllString(extinf, "")
+		}
+		if pl.config.PreserveComments {
+			for _, line := range track.Comments {
+				m3u.WriteString(line + "\n")
+			}
+		}
+		m3u.WriteString(extinf + "\n")
+		innerLines := track.Opts
+		if pl.config.PreserveComments {
+			innerLines = track.InnerLines
+		}
+		for _, line := range innerLines {
+			m3u.WriteString(line + "\n")
+		}
+		m3u.WriteString(uri + "\n")
+	}
+
+	if pl.config.PreserveComments {
+		for _, line := range pl.footerComments {
+			m3u.WriteString(line + "\n")
+		}
+	}
+
+	return m3u.Flush()
+}
+
+// trackURL returns the URL at which the track at idx is served: the rewritten
+// URL if rewriteURL is set and the upstream URL otherwise.
+func (pl *playlistLoader) trackURL(idx int, rewriteURL bool) string {
+	if !rewriteURL {
+		return pl.tracks[idx].URI.String()
+	}
+	if pl.config.RelativeURLs {
+		return fmt.Sprintf("/%s/%d", pl.channelPath, idx)
+	}
+	return fmt.Sprintf("http://%s/%s/%d", pl.baseAddress, pl.channelPath, idx)
+}
+
+// catchupPlaceholder matches the placeholders of a catchup-source template,
+// such as {utc}, ${start} or {duration:60}.
+var catchupPlaceholder = regexp.MustCompile(`\$?\{[^{}]+\}`)
+
+// catchupPlaceholders returns the distinct placeholders of a catchup-source
+// template in order of appearance.
+func catchupPlaceholders(source string) []string {
+	var placeholders []string
+	for _, placeholder := range catchupPlaceholder.FindAllString(source, -1) {
+		if !slices.Contains(placeholders, placeholder) {
+			placeholders = append(placeholders, placeholder)
+		}
+	}
+	return placeholders
+}
+
+// catchupSource returns the catchup-source template at which the catchup of
+// the track at idx is served. Clients fill in the placeholders of the
+// upstream template, which are passed on as the parameters p0, p1 and so on.
+// For catchup="append" the template is appended to the channel URL, as the
+// client does with the upstream one.
+func (pl *playlistLoader) catchupSource(idx int) string {
+	track := &pl.tracks[idx]
+	path := "/catchup"
+	for i, placeholder := range catchupPlaceholders(track.Tags["catchup-source"]) {
+		sep := "&"
+		if i == 0 {
+			sep = "?"
+		}
+		path += fmt.Sprintf("%sp%d=%s", sep, i, placeholder)
+	}
+	if track.Tags["catchup"] == "append" {
+		return path
+	}
+	return pl.trackURL(idx, true) + path
+}
+
+// catchupPathEscaper escapes, on top of url.PathEscape, the characters that
+// would otherwise change the authority of a URL.
+var catchupPathEscaper = strings.NewReplacer(":", "%3A", "@", "%40")
+
+// catchupURL returns the upstream catchup URL of the track, with the
+// placeholders of its catchup-source replaced by values in order, or "" if
+// it has no catchup-source. The values are escaped for the part of the URL
+// they land in, so that they cannot change its host or path structure.
+func (t *Track) catchupURL(values []string) string {
+	source := t.Tags["catchup-source"]
+	if len(source) == 0 {
+		return ""
+	}
+	prefix := ""
+	if t.Tags["catchup"] == "append" && t.URI != nil {
+		prefix = t.URI.String()
+	}
+
+	index := make(map[string]int)
+	for i, placeholder := range catchupPlaceholders(source) {
+		index[placeholder] = i
+	}
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	inQuery := strings.ContainsAny(prefix, "?#")
+	last := 0
+	for _, loc := range catchupPlaceholder.FindAllStringIndex(source, -1) {
+		literal := source[last:loc[0]]
+		sb.WriteString(literal)
+		inQuery = inQuery || strings.ContainsAny(literal, "?#")
+		last = loc[1]
+
+		value := ""
+		if i := index[source[loc[0]:loc[1]]]; i < len(values) {
+			value = values[i]
+		}
+		if inQuery {
+			sb.WriteString(url.QueryEscape(value))
+		} else {
+			sb.WriteString(catchupPathEscaper.Replace(url.PathEscape(value)))
+		}
+	}
+	sb.WriteString(source[last:])
+	return sb.String()
+}
+
+// shiftProgramme moves the start and stop times of programme by shift.
+func shiftProgramme(programme *xmltv.Programme, shift time.Duration) {
+	for _, t := range []*xmltv.Time{programme.Start, programme.Stop} {
+		if t != nil && !t.IsZero() {
+			t.Time = t.Add(shift)
+		}
+	}
+}
+
+// applyIDCase converts a channel id according to the configured output case so
+// that playlist and guide ids match exactly.
+func applyIDCase(mode string, id string) string {
+	switch mode {
+	case "lower":
+		return strings.ToLower(id)
+	case "upper":
+		return strings.ToUpper(id)
+	default:
+		return id
+	}
+}
+
+// newHTTPClient returns the client used to download provider data, with the
+// transport tuned according to the config.
+func newHTTPClient(config *Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = config.HTTP2
+	if config.HTTPMaxIdleConns > 0 {
+		transport.MaxIdleConns = config.HTTPMaxIdleConns
+	}
+	if config.HTTPReadBufferSize > 0 {
+		transport.ReadBufferSize = config.HTTPReadBufferSize
+	}
+	return &http.Client{Transport: transport, Timeout: config.HTTPTimeout}
+}
+
+// httpRetryBackoff is the delay before the first retry of a download. It
+// doubles with each further attempt.
+var httpRetryBackoff = time.Second
+
+// retryableError marks download failures that are worth retrying, namely
+// connection errors and 5xx responses.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// stdinURI names standard input as a source.
+const stdinURI = "-"
+
+// stdin is the reader behind stdinURI, replaced in tests.
+var stdin io.Reader = os.Stdin
+
+// loadReader opens a source: standard input, a file or a URL, which is
+// requested with header and retried up to retries times on server errors.
+func loadReader(client *http.Client, uri string, header http.Header, retries int) (io.ReadCloser, error) {
+	if uri == stdinURI {
+		return io.NopCloser(stdin), nil
+	}
+	if !isURL(uri) {
+		file, err := os.Open(uri)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(uri, ".gz") {
+			return gunzip(file)
+		}
+		return file, nil
+	}
+
+	backoff := httpRetryBackoff
+	for attempt := 0; ; attempt++ {
+		reader, err := fetchURL(client, uri, header)
+		var retryable *retryableError
+		if err == nil || !errors.As(err, &retryable) || attempt >= retries {
+			return reader, err
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"uri":     uri,
+			"attempt": attempt + 1,
+			"backoff": backoff,
+		}).Warn("download failed, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func fetchURL(client *http.Client, uri string, header http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request for %s: %w", uri, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	// Credentials in the URL are more specific than the configured ones.
+	if user := req.URL.User; user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &retryableError{fmt.Errorf("requesting %s: %w", uri, err)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return nil, &retryableError{fmt.Errorf("invalid url response code: %d", resp.StatusCode)}
+		}
+		return nil, fmt.Errorf("invalid url response code: %d", resp.StatusCode)
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" || strings.HasSuffix(req.URL.Path, ".gz") {
+		return gunzip(resp.Body)
+	}
+	return resp.Body, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// gunzip decompresses a body expected to be gzipped. The body is returned as is
+// if it does not start with the gzip magic number, as happens when the HTTP
+// transport has already decompressed it.
+func gunzip(body io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+	if magic, err := br.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, body}, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("invalid gzip data: %w", err)
+	}
+	return &gzipReadCloser{Reader: gz, body: body}, nil
+}
+
+// loadRanks reads the rank file, a CSV of tvg-id and score rows. A first row
+// whose score is not a number is treated as a header.
+func (p *Provider) loadRanks() (map[string]float64, error) {
+	reader, err := loadReader(p.client, p.config.RankFile, p.header, p.config.HTTPRetries)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load rank file: %w", err)
+	}
+	defer reader.Close()
+
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = 2
+	csvReader.TrimLeadingSpace = true
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rank file: %w", err)
+	}
+
+	ranks := make(map[string]float64, len(records))
+	for i, record := range records {
+		score, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("invalid score on line %d of rank file: %w", i+1, err)
+		}
+		ranks[strings.TrimSpace(record[0])] = score
+	}
+
+	log.WithField("rankCount", len(ranks)).Debug("loaded rank file")
+
+	return ranks, nil
+}
+
+type Provider struct {
+	config    *Config
+	iptvURLs  []string
+	epgURLs   []string
+	userAgent string
+	// header is sent with the requests for files other than the sources, and
+	// sourceHeaders, keyed by URL, with those for the sources.
+	header        http.Header
+	sourceHeaders map[string]http.Header
+	filters       []*Filter
+	client        *http.Client
+
+	// lock guards baseAddress, which may be changed between refreshes.
+	lock        sync.Mutex
+	baseAddress string
+
+	// refreshLock serializes refreshes, so that the data one publishes is
+	// never replaced by that of a refresh started before it.
+	refreshLock sync.Mutex
+
+	// dataLock guards the published data below, which refreshes replace
+	// while it is being served.
+	dataLock     sync.RWMutex
+	playlist     *playlistLoader
+	lineups      map[string]*playlistLoader
+	radio        *playlistLoader
+	source       *trackCollector
+	epg          *xmltv.TV
+	epgData      []byte
+	coverage     epgCoverage
+	warnings     warnings
+	epgSourceIDs []string
+	version      string
+	lastRefresh  time.Time
+	lastError    error
+	profile      *RefreshProfile
+	// generation counts published playlists, so that a guide loaded
+	// asynchronously is only published alongside the playlist it was
+	// loaded for.
+	generation int
+
+	logos   *logoCache
+	health  *healthCache
+	metrics *providerMetrics
+
+	// epgPartsLock guards the renderings of the guide built on first use.
+	epgPartsLock sync.Mutex
+	epgParts     [][]byte
+	epgGzip      []byte
+
+	// sources holds the last downloaded source bodies when the playlists and
+	// the EPG refresh on different schedules.
+	sources sourceCache
+
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+// ErrDataExpired is returned by DataError when the last successful refresh is
+// older than the configured maxDataAge and the onFailure policy is "error".
+var ErrDataExpired = errors.New("provider data is older than maxDataAge")
+
+// emptyM3u and emptyEpgXML are served in place of expired data under the
+// "empty" onFailure policy.
+const (
+	emptyM3u    = "#EXTM3U\n"
+	emptyEpgXML = "<?xml version=\"1.0\" encoding=\"UTF-8\"?><!DOCTYPE tv SYSTEM \"xmltv.dtd\"><tv></tv>"
+)
+
+func NewProvider(config *Config) (*Provider, error) {
+	if config.AsyncEPG && (config.LogoFromEPG || config.EmitPerChannelTvgURL) {
+		return nil, errAsyncEPGAttributes
+	}
+	config.normalizeTimeShift()
+	if err := config.compileFilterRegexps(); err != nil {
+		return nil, err
+	}
+	header, err := config.sourceHeader(SourceAuth{})
+	if err != nil {
+		return nil, err
+	}
+	iptvHeader, err := config.sourceHeader(config.IPTVAuth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid iptvAuth: %w", err)
+	}
+	epgHeader, err := config.sourceHeader(config.EPGAuth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid epgAuth: %w", err)
+	}
+
+	provider := &Provider{
+		config:   config,
+		iptvURLs: config.iptvURLs(),
+		epgURLs:  config.epgURLs(),
+		header:   header,
+		filters:  config.Filters,
+		client:   newHTTPClient(config),
+		logos:    newLogoCache(config.LogoCacheSize),
+		health:   newHealthCache(config.HealthCheckTTL),
+		metrics:  newProviderMetrics(),
+		now:      time.Now,
+		after:    time.After,
+	}
+
+	// A URL listed as both a playlist and a guide gets the playlist's
+	// credentials.
+	provider.sourceHeaders = make(map[string]http.Header, len(provider.iptvURLs)+len(provider.epgURLs))
+	for _, uri := range provider.epgURLs {
+		provider.sourceHeaders[uri] = epgHeader
+	}
+	for _, uri := range provider.iptvURLs {
+		provider.sourceHeaders[uri] = iptvHeader
+	}
+
+	if len(config.UserAgent) > 0 {
+		provider.userAgent = config.UserAgent
+	}
+
+	if config.UseFFMPEG {
+		provider.baseAddress = config.ServerAddress
+	}
+
+	return provider, nil
+}
+
+// SetBaseAddress changes the server address used in rewritten channel URLs.
+// The new address takes effect on the next refresh.
+func (p *Provider) SetBaseAddress(address string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.config.UseFFMPEG {
+		p.baseAddress = address
+	}
+}
+
+func (p *Provider) getBaseAddress() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.baseAddress
+}
+
+// epgCoverage is the time range spanned by the retained guide programmes.
+type epgCoverage struct {
+	from time.Time
+	to   time.Time
+}
+
+func (c *epgCoverage) add(programme *xmltv.Programme) {
+	start := xmltvTime(programme.Start)
+	if start == nil {
+		return
+	}
+	stop := xmltvTime(programme.Stop)
+	if stop == nil {
+		stop = start
+	}
+	if c.from.IsZero() || start.Before(c.from) {
+		c.from = *start
+	}
+	if c.to.IsZero() || stop.After(c.to) {
+		c.to = *stop
+	}
+}
+
+// loadXMLTv parses the guide, keeping the channels and programmes of the given
+// tracks. The ids of every channel the guide declares are stored in sourceIDs.
+func (p *Provider) loadXMLTv(reader io.Reader, tracks []Track, warns *warnings, sourceIDs *[]string) (*xmltv.TV, error) {
+	start := time.Now()
+
+	channels := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, track := range tracks {
+		id := track.Tags["tvg-id"]
+		if len(id) == 0 {
+			if p.config.MatchByName {
+				names[matchName(trackName(&track))] = true
+			}
+			continue
+		}
+		channels[id] = true
+	}
+	horizons := p.epgHorizons(tracks)
+
+	decoder := xml.NewDecoder(reader)
+	decoder.CharsetReader = charsetReader
+	tvSetup := new(xmltv.TV)
+	channelIndex := make(map[string]int)
+	seenIDs := make(map[string]bool)
+	var ids []string
+
+	totalChannelCount := 0
+	totalProgrammeCount := 0
+	droppedProgrammeCount := 0
+	droppedWindowCount := 0
+	droppedMaxDaysCount := 0
+	duplicateProgrammeCount := 0
+	nameMatchCount := 0
+	now := p.now()
+	maxStart := now.AddDate(0, 0, p.config.EPGMaxDays)
+	seenProgrammes := make(map[string]bool)
+
+	for {
+		// Decode the next XML token
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Process the start element
+		switch se := tok.(type) {
+		case xml.StartElement:
+			switch se.Name.Local {
+			case "tv":
+				for _, attr := range se.Attr {
+					switch attr.Name.Local {
+					case "date":
+						tvSetup.Date = attr.Value
+					case "source-info-url":
+						tvSetup.SourceInfoURL = attr.Value
+					case "source-info-name":
+						tvSetup.SourceInfoName = attr.Value
+					case "source-data-url":
+						tvSetup.SourceDataURL = attr.Value
+					case "generator-info-name":
+						tvSetup.GeneratorInfoName = attr.Value
+					case "generator-info-url":
+						tvSetup.GeneratorInfoURL = attr.Value
+					}
+				}
+			case "programme":
+				var programme xmltv.Programme
+				line, _ := decoder.InputPos()
+				err := decoder.DecodeElement(&programme, &se)
+				var parseErr *time.ParseError
+				if errors.As(err, &parseErr) {
+					// Attributes are decoded first, so the programme's body is
+					// still unread and can be skipped.
+					log.WithError(err).WithField("line", line).Warn("unparseable programme timestamp")
+					warns.add("unparseable-timestamp", line, "unparseable programme timestamp %q", parseErr.Value)
+					totalProgrammeCount++
+					if err := decoder.Skip(); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				programme.Channel = applyIDCase(p.config.OutputIDCase, programme.Channel)
+				if len(p.config.EPGLanguages) > 0 {
+					programme.Titles = selectLanguage(programme.Titles, p.config.EPGLanguages)
+					programme.Descriptions = selectLanguage(programme.Descriptions, p.config.EPGLanguages)
+				}
+				if len(p.config.DefaultDesc) > 0 {
+					fillDefaultDesc(&programme, p.config.DefaultDesc)
+				}
+				if hours, ok := p.config.TimeShift[programme.Channel]; ok {
+					shiftProgramme(&programme, time.Duration(hours*float64(time.Hour)))
+				}
+				if p.config.EPGMaxDays > 0 && outsideWindow(&programme, now, maxStart) {
+					droppedMaxDaysCount++
+				} else if horizon, ok := horizons[programme.Channel]; ok && programme.Start != nil && !programme.Start.Before(horizon) {
+					droppedWindowCount++
+				} else if channels[programme.Channel] {
+					if key := programmeKey(&programme); seenProgrammes[key] {
+						duplicateProgrammeCount++
+					} else {
+						seenProgrammes[key] = true
+						tvSetup.Programmes = append(tvSetup.Programmes, programme)
+					}
+				} else {
+					droppedProgrammeCount++
+				}
+				totalProgrammeCount++
+			case "channel":
+				var channel xmltv.Channel
+				line, _ := decoder.InputPos()
+				err := decoder.DecodeElement(&channel, &se)
+				if err != nil {
+					return nil, err
+				}
+				channel.ID = applyIDCase(p.config.OutputIDCase, channel.ID)
+				if !seenIDs[channel.ID] {
+					seenIDs[channel.ID] = true
+					ids = append(ids, channel.ID)
+				}
+				if !channels[channel.ID] && len(names) > 0 && matchesName(&channel, names) {
+					// Channels precede programmes in XMLTV, so the channel's
+					// programmes are kept from here on.
+					channels[channel.ID] = true
+					nameMatchCount++
+				}
+				if channels[channel.ID] {
+					if idx, exists := channelIndex[channel.ID]; exists {
+						warns.add("duplicate-epg-channel", line, "duplicate guide channel %q", channel.ID)
+						if p.config.EPGDuplicateChannels == "merge" {
+							mergeEPGChannel(&tvSetup.Channels[idx], &channel)
+						}
+					} else {
+						channelIndex[channel.ID] = len(tvSetup.Channels)
+						tvSetup.Channels = append(tvSetup.Channels, channel)
+					}
+				}
+				totalChannelCount++
+			}
+		}
+	}
+
+	*sourceIDs = ids
+
+	if p.config.InferProgrammeStop {
+		var dropped int
+		tvSetup.Programmes, dropped = inferProgrammeStops(tvSetup.Programmes)
+		if dropped > 0 {
+			warns.add("missing-stop", 0, "%d programmes without a stop time dropped", dropped)
+		}
+	}
+	log.WithFields(log.Fields{
+		"totalChannelCount":   totalChannelCount,
+		"channelCount":        len(tvSetup.Channels),
+		"totalProgrammeCount": totalProgrammeCount,
+		"programmeCount":      len(tvSetup.Programmes),
+		"duration":            time.Since(start),
+	}).Info("loaded xmltv")
+
+	if droppedWindowCount > 0 {
+		log.WithField("programmeCount", droppedWindowCount).Debug("dropped programmes beyond their group's epg window")
+	}
+
+	if droppedMaxDaysCount > 0 {
+		log.WithField("programmeCount", droppedMaxDaysCount).Debug("dropped programmes outside epgMaxDays")
+	}
+
+	if duplicateProgrammeCount > 0 {
+		log.WithField("programmeCount", duplicateProgrammeCount).Info("dropped duplicate programmes")
+	}
+
+	if nameMatchCount > 0 {
+		log.WithField("channelCount", nameMatchCount).Debug("matched guide channels by display name")
+	}
+
+	if droppedProgrammeCount > 0 {
+		warns.add("dropped-programmes", 0, "%d programmes dropped for channels not in the playlist", droppedProgrammeCount)
+	}
+
+	return tvSetup, nil
+}
+
+// outsideWindow reports whether programme ended before now or starts after
+// maxStart.
+func outsideWindow(programme *xmltv.Programme, now time.Time, maxStart time.Time) bool {
+	if programme.Stop != nil && !programme.Stop.IsZero() && programme.Stop.Before(now) {
+		return true
+	}
+	return programme.Start != nil && !programme.Start.IsZero() && programme.Start.After(maxStart)
+}
+
+// trackName returns the track's tvg-name, or its title if it has none.
+func trackName(track *Track) string {
+	if name := track.Tags["tvg-name"]; len(name) > 0 {
+		return name
+	}
+	return track.Name
+}
+
+// matchName normalizes a channel name for matching by name, lowercasing it and
+// dropping everything but letters and digits.
+func matchName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// matchesName reports whether any of the channel's display names is in names,
+// a set of names normalized by matchName.
+func matchesName(channel *xmltv.Channel, names map[string]bool) bool {
+	for _, name := range channel.DisplayNames {
+		if key := matchName(name.Value); len(key) > 0 && names[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// programmeKey identifies a programme by its channel, start and stop times and
+// title, so that exact repeats within a guide can be dropped.
+func programmeKey(programme *xmltv.Programme) string {
+	var start, stop, title string
+	if programme.Start != nil {
+		start = programme.Start.Format(time.RFC3339)
+	}
+	if programme.Stop != nil {
+		stop = programme.Stop.Format(time.RFC3339)
+	}
+	if len(programme.Titles) > 0 {
+		title = programme.Titles[0].Value
+	}
+	return strings.Join([]string{programme.Channel, start, stop, title}, "\x00")
+}
+
+// epgHorizons maps the guide ids of tracks in a group with an EPG window to
+// the time after which their programmes are dropped. A channel in several
+// groups gets the longest of their windows, and none if any of its groups has
+// no window.
+func (p *Provider) epgHorizons(tracks []Track) map[string]time.Time {
+	if len(p.config.EPGWindows) == 0 {
+		return nil
+	}
+
+	windows := make(map[string]time.Duration, len(p.config.EPGWindows))
+	for _, w := range p.config.EPGWindows {
+		windows[w.Group] = w.Window
+	}
+
+	now := p.now()
+	horizons := make(map[string]time.Time)
+	unlimited := make(map[string]bool)
+	for _, track := range tracks {
+		id := track.Tags["tvg-id"]
+		if len(id) == 0 {
+			continue
+		}
+		window, ok := windows[track.Tags["group-title"]]
+		if !ok {
+			unlimited[id] = true
+			continue
+		}
+		if horizon := now.Add(window); horizon.After(horizons[id]) {
+			horizons[id] = horizon
+		}
+	}
+	for id := range unlimited {
+		delete(horizons, id)
+	}
+	return horizons
+}
+
+// charsetReader converts a guide declaring a non-UTF-8 encoding, such as
+// ISO-8859-1, to UTF-8.
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	enc, err := ianaindex.IANA.Encoding(label)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported encoding: %s", label)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// inferProgrammeStops sets the stop time of each programme that lacks one to
+// the start of the next programme on the same channel. Programmes with no later
+// programme to take a stop time from are dropped, and their count is returned.
+// The order of the remaining programmes is preserved.
+func inferProgrammeStops(programmes []xmltv.Programme) ([]xmltv.Programme, int) {
+	byChannel := make(map[string][]int)
+	for i := range programmes {
+		if xmltvTime(programmes[i].Start) != nil {
+			byChannel[programmes[i].Channel] = append(byChannel[programmes[i].Channel], i)
+		}
+	}
+
+	for _, indices := range byChannel {
+		sort.SliceStable(indices, func(a, b int) bool {
+			return programmes[indices[a]].Start.Before(programmes[indices[b]].Start.Time)
+		})
+		for n, i := range indices {
+			if xmltvTime(programmes[i].Stop) != nil {
+				continue
+			}
+			for _, next := range indices[n+1:] {
+				if programmes[next].Start.After(programmes[i].Start.Time) {
+					programmes[i].Stop = &xmltv.Time{Time: programmes[next].Start.Time}
+					break
+				}
+			}
+		}
+	}
+
+	kept := programmes[:0]
+	for _, programme := range programmes {
+		if xmltvTime(programme.Stop) != nil {
+			kept = append(kept, programme)
+		}
+	}
+	return kept, len(programmes) - len(kept)
+}
+
+// fillDefaultDesc gives a programme without a non-blank description the
+// default one, with "{title}" replaced by the programme's title.
+func fillDefaultDesc(programme *xmltv.Programme, defaultDesc string) {
+	for _, desc := range programme.Descriptions {
+		if len(strings.TrimSpace(desc.Value)) > 0 {
+			return
+		}
+	}
+
+	var title xmltv.CommonElement
+	if len(programme.Titles) > 0 {
+		title = programme.Titles[0]
+	}
+	programme.Descriptions = []xmltv.CommonElement{{
+		Lang:  title.Lang,
+		Value: strings.ReplaceAll(defaultDesc, "{title}", title.Value),
+	}}
+}
+
+// selectLanguage returns the elements in the first of languages that any
+// element has, so a programme missing the preferred language falls back to the
+// next one. Elements are returned unchanged if none match.
+func selectLanguage(elements []xmltv.CommonElement, languages []string) []xmltv.CommonElement {
+	for _, lang := range languages {
+		var selected []xmltv.CommonElement
+		for _, e := range elements {
+			if strings.EqualFold(e.Lang, lang) {
+				selected = append(selected, e)
+			}
+		}
+		if len(selected) > 0 {
+			return selected
+		}
+	}
+	return elements
+}
+
+// mergeEPGChannel adds the display names, icons and URLs of a duplicate
+// channel declaration that the kept declaration lacks.
+func mergeEPGChannel(kept *xmltv.Channel, dup *xmltv.Channel) {
+	for _, name := range dup.DisplayNames {
+		if !slices.Contains(kept.DisplayNames, name) {
+			kept.DisplayNames = append(kept.DisplayNames, name)
+		}
+	}
+	for _, icon := range dup.Icons {
+		if !slices.Contains(kept.Icons, icon) {
+			kept.Icons = append(kept.Icons, icon)
+		}
+	}
+	for _, url := range dup.URLs {
+		if !slices.Contains(kept.URLs, url) {
+			kept.URLs = append(kept.URLs, url)
+		}
+	}
+}
+
+// Refresh downloads the playlist and the EPG and publishes the result. The new
+// data is built aside and swapped in at once, so it is safe to call Refresh
+// while the getters are serving the previous data, and concurrent calls run
+// one after the other. If the refresh fails, the previous data keeps being
+// served and the error is reported by GetLastError.
+func (p *Provider) Refresh() error {
+	return p.refresh(true, true)
+}
+
+// refresh runs load, waiting for any refresh in progress to finish first, and
+// records the refresh in the metrics and its error, if any, as the last one.
+func (p *Provider) refresh(reloadM3u bool, reloadEPG bool) error {
+	return p.runRefresh(func() error {
+		return p.load(reloadM3u, reloadEPG)
+	})
+}
+
+// runRefresh runs load under refreshLock and records it as a refresh.
+func (p *Provider) runRefresh(load func() error) error {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	start := time.Now()
+	err := load()
+	p.metrics.observeRefresh(time.Since(start), err)
+
+	p.dataLock.Lock()
+	p.lastError = err
+	p.dataLock.Unlock()
+	return err
+}
+
+// load loads and publishes the playlist and the EPG. A source that is not to
+// be reloaded is read from its cached body if there is one.
+func (p *Provider) load(reloadM3u bool, reloadEPG bool) error {
+	var err error
+	if err := p.checkSources(); err != nil {
+		return err
+	}
+
+	var prof *refreshProfiler
+	if p.config.Profile {
+		prof = newRefreshProfiler()
+	}
+
+	// The guides are downloaded while the playlist loads, but are only parsed
+	// once the playlist is, since parsing them needs its channels. An
+	// asynchronous EPG is downloaded after the playlist is published instead.
+	endPhase := prof.phase("m3u")
+	collector := &trackCollector{}
+	var g errgroup.Group
+	g.Go(func() error {
+		for _, uri := range p.iptvURLs {
+			if err := p.collectM3u(uri, collector, p.cachedRead(reloadM3u), prof); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var prefetched map[string]*prefetchedSource
+	if !p.config.AsyncEPG {
+		prefetched = make(map[string]*prefetchedSource, len(p.epgURLs))
+		var lock sync.Mutex
+		for _, uri := range p.epgURLs {
+			g.Go(func() error {
+				source := p.prefetch(uri, reloadEPG)
+				lock.Lock()
+				prefetched[uri] = source
+				lock.Unlock()
+				return nil
+			})
+		}
+		defer func() {
+			for _, source := range prefetched {
+				if source.sr != nil {
+					source.sr.Close()
+				}
+			}
+		}()
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	playlists, err := p.buildPlaylists(collector)
+	if err != nil {
+		return err
+	}
+	endPhase()
+
+	if p.config.HealthCheck {
+		endPhase = prof.phase("health")
+		p.checkHealth(playlists)
+		endPhase()
+	}
+
+	if p.config.AsyncEPG {
+		endPhase = prof.phase("finish")
+		p.finishPlaylists(playlists, nil)
+		endPhase()
+
+		endPhase = prof.phase("publish")
+		p.dataLock.Lock()
+		p.setPlaylists(playlists)
+		generation := p.generation
+		p.dataLock.Unlock()
+		endPhase()
+
+		go p.refreshEPG(playlists, prof, generation, reloadEPG)
+		return nil
+	}
+
+	endPhase = prof.phase("epg")
+	epg, epgData, coverage, err := p.fetchEPG(playlists, prof, reloadEPG, prefetched)
+	if err != nil {
+		return err
+	}
+	endPhase()
+
+	endPhase = prof.phase("finish")
+	p.finishPlaylists(playlists, epg)
+	endPhase()
+
+	endPhase = prof.phase("publish")
+	p.publish(playlists, epg, epgData, coverage)
+	endPhase()
+
+	p.finishProfile(prof, playlists, len(epg.Programmes))
+
+	return nil
+}
+
+// checkSources rejects sources that point back at proxytv itself.
+func (p *Provider) checkSources() error {
+	baseAddress := p.getBaseAddress()
+	for _, uri := range append(slices.Clone(p.iptvURLs), p.epgURLs...) {
+		if isSelfReferential(uri, baseAddress) {
+			return fmt.Errorf("unable to load %s: %w", uri, errSelfReferential)
+		}
+	}
+	return nil
+}
+
+// refreshEPG loads the guide for playlists, which have already been published
+// under the given generation, and publishes it unless a later refresh has
+// published other playlists in the meantime. On failure the current guide is
+// kept.
+func (p *Provider) refreshEPG(playlists *playlistSet, prof *refreshProfiler, generation int, reload bool) {
+	endPhase := prof.phase("epg")
+	epg, epgData, coverage, err := p.fetchEPG(playlists, prof, reload, nil)
+	if err != nil {
+		log.WithError(err).Error("failed to load EPG")
+		p.dataLock.Lock()
+		if p.generation == generation {
+			p.lastError = err
+		}
+		p.dataLock.Unlock()
+		return
+	}
+	endPhase()
+
+	p.dataLock.Lock()
+	if p.generation != generation {
+		p.dataLock.Unlock()
+		log.Info("discarding EPG superseded by a later refresh")
+		return
+	}
+	p.setEPG(playlists, epg, epgData, coverage)
+	p.dataLock.Unlock()
+
+	log.WithField("programmeCount", len(epg.Programmes)).Info("published EPG")
+	p.finishProfile(prof, playlists, len(epg.Programmes))
+}
+
+func (p *Provider) finishProfile(prof *refreshProfiler, playlists *playlistSet, epgProgrammes int) {
+	if profile := prof.finish(playlists, epgProgrammes); profile != nil {
+		p.dataLock.Lock()
+		p.profile = profile
+		p.dataLock.Unlock()
+		log.WithField("profile", profile).Info("profiled refresh")
+	}
+}
+
+var errNoPlaylist = errors.New("no playlist has been loaded")
+
+// PreviewDiff runs the playlist pipeline with a candidate config over the
+// tracks of the last refresh, without fetching or publishing anything, and
+// reports the channel names it would add to and remove from the current
+// playlist.
+func (p *Provider) PreviewDiff(cfg *Config) (added, removed []string, err error) {
+	if err := cfg.compileFilterRegexps(); err != nil {
+		return nil, nil, err
+	}
+
+	// Published data is never modified, so it is read after releasing
+	// dataLock.
+	p.dataLock.RLock()
+	source, playlist := p.source, p.playlist
+	p.dataLock.RUnlock()
+
+	if source == nil || playlist == nil {
+		return nil, nil, errNoPlaylist
+	}
+
+	// The rank file is not loaded, since ranks only change the order of the
+	// channels.
+	candidate := p.buildPlaylistSet(cfg, source, nil).main
+
+	current := make(map[string]bool, len(playlist.tracks))
+	for i := range playlist.tracks {
+		current[playlist.tracks[i].Name] = true
+	}
+	next := make(map[string]bool, len(candidate.tracks))
+	for i := range candidate.tracks {
+		name := candidate.tracks[i].Name
+		if !current[name] && !next[name] {
+			added = append(added, name)
+		}
+		next[name] = true
+	}
+	for i := range playlist.tracks {
+		if name := playlist.tracks[i].Name; !next[name] {
+			removed = append(removed, name)
+			next[name] = true
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed, nil
+}
+
+// RefreshReport describes the main playlist a refresh would serve.
+type RefreshReport struct {
+	// Filters maps each filter to the number of source tracks it matched.
+	Filters map[string]int `json:"filters"`
+	// Channels is the number of channels in the playlist.
+	Channels int `json:"channels"`
+	// MissingTvgID is the number of tracks without a tvg-id that the filters
+	// leave out of the playlist.
+	MissingTvgID int `json:"missingTvgId"`
+	// Duplicates is the number of accepted tracks merged into another channel
+	// during dedup.
+	Duplicates int `json:"duplicates"`
+	// EPGChannels is the number of channels that have guide data, and
+	// EPGMatchRate their share of Channels.
+	EPGChannels  int     `json:"epgChannels"`
+	EPGMatchRate float64 `json:"epgMatchRate"`
+}
+
+// PreviewRefresh downloads the sources and runs the refresh pipeline like
+// Refresh, but reports what the refresh would serve instead of publishing it.
+// Neither the served data nor the caches are changed. It waits for any
+// refresh in progress to finish first.
+func (p *Provider) PreviewRefresh() (*RefreshReport, error) {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	if err := p.checkSources(); err != nil {
+		return nil, err
+	}
+
+	collector := &trackCollector{}
+	for _, uri := range p.iptvURLs {
+		if err := p.collectM3u(uri, collector, p.previewRead, nil); err != nil {
+			return nil, err
+		}
+	}
+	playlists, err := p.buildPlaylists(collector)
+	if err != nil {
+		return nil, err
+	}
+	var tvs []*xmltv.TV
+	for _, uri := range p.epgURLs {
+		err := p.previewRead(uri, func(r io.Reader) error {
+			tv, err := p.parseEPG(r, playlists)
+			tvs = append(tvs, tv)
+			return err
+		})
+		if err != nil {
+			if len(p.epgURLs) > 1 {
+				err = fmt.Errorf("loading %s: %w", uri, err)
+			}
+			return nil, err
+		}
+	}
+	epg := mergeEPGs(tvs)
+
+	pl := playlists.main
+	report := &RefreshReport{
+		Filters:      pl.filterStats(),
+		Channels:     len(pl.tracks),
+		MissingTvgID: pl.droppedWithoutID,
+		Duplicates:   pl.accepted - len(pl.tracks),
+	}
+	guided := make(map[string]bool, len(epg.Channels))
+	for i := range epg.Channels {
+		guided[epg.Channels[i].ID] = true
+	}
+	for i := range pl.tracks {
+		if id := pl.tracks[i].Tags["tvg-id"]; len(id) > 0 && guided[id] {
+			report.EPGChannels++
+		}
+	}
+	if report.Channels > 0 {
+		report.EPGMatchRate = float64(report.EPGChannels) / float64(report.Channels)
+	}
+	return report, nil
+}
+
+// LoadFromBytes runs the full refresh pipeline over in-memory playlist and EPG
+// data without performing any I/O. It is serialized with, and recorded like,
+// any other refresh.
+func (p *Provider) LoadFromBytes(m3u []byte, epg []byte) error {
+	return p.runRefresh(func() error {
+		playlists, err := p.loadPlaylists(bytes.NewReader(m3u))
+		if err != nil {
+			return err
+		}
+
+		tv, epgData, coverage, err := p.loadEPG(bytes.NewReader(epg), playlists)
+		if err != nil {
+			return err
+		}
+
+		p.finishPlaylists(playlists, tv)
+		p.publish(playlists, tv, epgData, coverage)
+
+		return nil
+	})
+}
+
+// playlistSet holds the main playlist and any configured lineups, all built
+// from a single parse of the source.
+type playlistSet struct {
+	main     *playlistLoader
+	lineups  map[string]*playlistLoader
+	radio    *playlistLoader
+	source   *trackCollector
+	warnings warnings
+	// epgSourceIDs lists every channel id declared by the guide, including
+	// those not in any playlist.
+	epgSourceIDs []string
+}
+
+func (ps *playlistSet) all() []*playlistLoader {
+	all := []*playlistLoader{ps.main}
+	for _, pl := range ps.lineups {
+		all = append(all, pl)
+	}
+	if ps.radio != nil {
+		all = append(all, ps.radio)
+	}
+	return all
+}
+
+// isRadio reports whether a track is a radio channel, either by its radio
+// attribute or by belonging to one of the configured radio groups.
+func isRadio(track *Track, groups []string) bool {
+	if strings.EqualFold(track.Tags["radio"], "true") {
+		return true
+	}
+	return slices.Contains(groups, track.Tags["group-title"])
+}
+
+// collectM3u parses the playlist at uri, read by read, into collector, after
+// the tracks of any playlists collected before it.
+func (p *Provider) collectM3u(uri string, collector *trackCollector, read sourceRead, prof *refreshProfiler) error {
+	log.WithField("url", uri).Info("loading IPTV m3u")
+
+	start := time.Now()
+	var source *trackCollector
+	var summary m3uSummary
+	err := read(uri, func(r io.Reader) error {
+		source = &trackCollector{}
+		var err error
+		summary, err = loadM3u(prof.countM3u(r), source)
+		return err
+	})
+	if err != nil {
+		if len(p.iptvURLs) > 1 {
+			return fmt.Errorf("loading %s: %w", uri, err)
+		}
+		return err
+	}
+	log.WithFields(log.Fields{
+		"duration":     time.Since(start),
+		"tracks":       summary.Tracks,
+		"skippedLines": summary.SkippedLines,
+	}).Debug("loaded IPTV m3u")
+
+	collector.headerComments = append(collector.headerComments, source.headerComments...)
+	collector.footerComments = append(collector.footerComments, source.footerComments...)
+	collector.tracks = append(collector.tracks, source.tracks...)
+	collector.skippedLines += summary.SkippedLines
+	return nil
+}
+
+// loadPlaylists builds the playlists from M3U readers, whose tracks are
+// merged in order.
+func (p *Provider) loadPlaylists(readers ...io.Reader) (*playlistSet, error) {
+	collector := &trackCollector{}
+	for _, reader := range readers {
+		summary, err := loadM3u(reader, collector)
+		if err != nil {
+			return nil, err
+		}
+		collector.skippedLines += summary.SkippedLines
+	}
+	return p.buildPlaylists(collector)
+}
+
+// buildPlaylists builds the playlists of the provider's config from the tracks
+// of collector, loading the rank file first if sorting needs it.
+func (p *Provider) buildPlaylists(collector *trackCollector) (*playlistSet, error) {
+	var ranks map[string]float64
+	if p.config.SortBy == "rank" && len(p.config.RankFile) > 0 {
+		var err error
+		if ranks, err = p.loadRanks(); err != nil {
+			return nil, err
+		}
+	}
+	return p.buildPlaylistSet(p.config, collector, ranks), nil
+}
+
+// buildPlaylistSet builds the playlists of cfg from the tracks of collector,
+// which are left as they were parsed so that they can be built again with
+// another config.
+func (p *Provider) buildPlaylistSet(cfg *Config, collector *trackCollector, ranks map[string]float64) *playlistSet {
+	prepared := prepareTracks(cfg, collector)
+
+	baseAddress := p.getBaseAddress()
+	playlists := &playlistSet{
+		main:    newPlaylistLoader(baseAddress, cfg.Filters, cfg),
+		lineups: make(map[string]*playlistLoader, len(cfg.Lineups)),
+		source:  collector,
+	}
+	playlists.main.ranks = ranks
+	if cfg.SplitRadio {
+		playlists.main.include = func(track *Track) bool {
+			return !isRadio(track, cfg.RadioGroups)
+		}
+	}
+	prepared.replay(playlists.main)
+
+	log.WithField("channelCount", len(playlists.main.tracks)).Info("parsed IPTV m3u")
+
+	missingIDs := 0
+	for i := range prepared.tracks {
+		if len(prepared.tracks[i].Tags["tvg-id"]) == 0 {
+			missingIDs++
+		}
+	}
+	if missingIDs > 0 {
+		playlists.warnings.add("missing-tvg-id", 0, "%d tracks have no tvg-id", missingIDs)
+	}
+	if prepared.skippedLines > 0 {
+		playlists.warnings.add("skipped-lines", 0, "%d malformed playlist lines skipped", prepared.skippedLines)
+	}
+	playlists.warnings = append(playlists.warnings, playlists.main.warnings...)
+
+	for _, lineup := range cfg.Lineups {
+		pl := newPlaylistLoader(baseAddress, lineup.Filters, cfg)
+		pl.channelPath = fmt.Sprintf("lineup/%s/channel", lineup.Name)
+		pl.ranks = ranks
+		prepared.replay(pl)
+		playlists.lineups[lineup.Name] = pl
+
+		log.WithFields(log.Fields{
+			"lineup":       lineup.Name,
+			"channelCount": len(pl.tracks),
+		}).Info("built lineup")
+	}
+
+	if cfg.SplitRadio {
+		pl := newPlaylistLoader(baseAddress, cfg.Filters, cfg)
+		pl.channelPath = "radio/channel"
+		pl.ranks = ranks
+		// The main playlist, which has the same filters, reports them.
+		pl.filterMatches = nil
+		pl.include = func(track *Track) bool {
+			return isRadio(track, cfg.RadioGroups)
+		}
+		prepared.replay(pl)
+		playlists.radio = pl
+
+		log.WithField("channelCount", len(pl.tracks)).Info("built radio playlist")
+	}
+
+	return playlists
+}
+
+// prepareTracks returns the tracks of collector with the whitespace, leading
+// number and tvg-id fixes of cfg applied, copying them if any applies.
+func prepareTracks(cfg *Config, collector *trackCollector) *trackCollector {
+	if !cfg.TrimWhitespace && !cfg.CollapseSpaces && !cfg.StripLeadingNumber && !cfg.SynthesizeIDs {
+		return collector
+	}
+
+	prepared := &trackCollector{
+		tracks:         make([]Track, len(collector.tracks)),
+		headerComments: collector.headerComments,
+		footerComments: collector.footerComments,
+		skippedLines:   collector.skippedLines,
+	}
+	for i := range collector.tracks {
+		track := collector.tracks[i].clone()
+		if cfg.TrimWhitespace || cfg.CollapseSpaces {
+			normalizeWhitespace(&track, cfg.TrimWhitespace, cfg.CollapseSpaces)
+		}
+		if cfg.StripLeadingNumber {
+			stripLeadingNumber(&track)
+		}
+		if cfg.SynthesizeIDs && len(track.Tags["tvg-id"]) == 0 {
+			track.setTag("tvg-id", synthesizeID(&track))
+		}
+		prepared.tracks[i] = track
+	}
+	return prepared
+}
+
+// fetchEPG loads, parses and merges the guides. Unless reload is set, the
+// cached guides are used where there are any.
+func (p *Provider) fetchEPG(playlists *playlistSet, prof *refreshProfiler, reload bool, prefetched map[string]*prefetchedSource) (*xmltv.TV, []byte, epgCoverage, error) {
+	var tvs []*xmltv.TV
+	for _, uri := range p.epgURLs {
+		tv, err := p.fetchXMLTv(uri, playlists, prof, reload, prefetched[uri])
+		if err != nil {
+			if len(p.epgURLs) > 1 {
+				err = fmt.Errorf("loading %s: %w", uri, err)
+			}
+			return nil, nil, epgCoverage{}, err
+		}
+		tvs = append(tvs, tv)
+	}
+	return p.finishEPG(tvs)
+}
+
+// fetchXMLTv loads and parses one guide, fetching it again up to maxRetries
+// times if the guide fails to read or decode once open, as happens when a
+// download is cut short. Failures to open the guide are not retried here, since loadReader
+// already retries those worth retrying. The wait between attempts starts at
+// httpRetryBackoff and doubles each time. The first attempt parses the
+// prefetched body if there is one.
+func (p *Provider) fetchXMLTv(uri string, playlists *playlistSet, prof *refreshProfiler, reload bool, prefetched *prefetchedSource) (*xmltv.TV, error) {
+	backoff := httpRetryBackoff
+	for attempt := 0; ; attempt++ {
+		log.WithField("url", uri).Info("loading EPG")
+
+		start := time.Now()
+		var tv *xmltv.TV
+		decodeFailed := false
+		parse := func(r io.Reader) error {
+			warningCount := len(playlists.warnings)
+			var err error
+			if tv, err = p.parseEPG(prof.countEPG(r), playlists); err != nil {
+				playlists.warnings = playlists.warnings[:warningCount]
+				decodeFailed = true
+			}
+			return err
+		}
+		var err error
+		if attempt == 0 && prefetched != nil {
+			if err = prefetched.err; err == nil {
+				err = p.parseSource(uri, prefetched.sr, false, parse)
+			}
+			decodeFailed = decodeFailed || prefetched.readFailed
+		} else {
+			err = p.readSource(uri, reload || attempt > 0, attempt > 0, parse)
+		}
+		log.WithField("duration", time.Since(start)).Debug("loaded EPG")
+		if err == nil || !decodeFailed || attempt >= p.config.MaxRetries {
+			return tv, err
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"attempt": attempt + 1,
+			"backoff": backoff,
+		}).Warn("unable to decode EPG, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// whitespaceTags lists the attributes whose whitespace normalizeWhitespace
+// fixes along with the track's name.
+var whitespaceTags = []string{"tvg-id", "tvg-name", "group-title"}
+
+var spacesRegex = regexp.MustCompile(`\s{2,}`)
+
+// normalizeWhitespace trims the whitespace around, and collapses runs of
+// whitespace within, the track's name and whitespaceTags as requested.
+func normalizeWhitespace(track *Track, trim bool, collapse bool) {
+	normalize := func(s string) string {
+		if collapse {
+			s = spacesRegex.ReplaceAllString(s, " ")
+		}
+		if trim {
+			s = strings.TrimSpace(s)
+		}
+		return s
+	}
+
+	if name := normalize(track.Name); name != track.Name {
+		track.setName(name)
+	}
+	for _, key := range whitespaceTags {
+		value, ok := track.Tags[key]
+		if !ok {
+			continue
+		}
+		if normalized := normalize(value); normalized != value {
+			track.setTag(key, normalized)
+		}
+	}
+}
+
+var leadingNumberRegex = regexp.MustCompile(`^(\d+)(?:\s*[.|:)-]\s*|\s+)(\S.*)$`)
+
+// stripLeadingNumber removes a numbering prefix such as "101. " or "001 | "
+// from the track's name, using the number as its tvg-chno if it has none.
+func stripLeadingNumber(track *Track) {
+	match := leadingNumberRegex.FindStringSubmatch(track.Name)
+	if match == nil {
+		return
+	}
+
+	track.setName(match[2])
+	if len(track.Tags["tvg-chno"]) == 0 {
+		if n, err := strconv.Atoi(match[1]); err == nil {
+			track.setTag("tvg-chno", strconv.Itoa(n))
+		}
+	}
+}
+
+// synthesizeID derives a tvg-id for a track that lacks one from a hash of its
+// name and group, so that it stays the same across refreshes.
+func synthesizeID(track *Track) string {
+	sum := sha256.Sum256([]byte(track.Name + "\x00" + track.Tags["group-title"]))
+	return "proxytv-" + hex.EncodeToString(sum[:6])
+}
+
+func (p *Provider) loadEPG(reader io.Reader, playlists *playlistSet) (*xmltv.TV, []byte, epgCoverage, error) {
+	tv, err := p.parseEPG(reader, playlists)
+	if err != nil {
+		return nil, nil, epgCoverage{}, err
+	}
+	return p.finishEPG([]*xmltv.TV{tv})
+}
+
+// parseEPG parses one guide for the tracks of playlists, adding the ids of
+// the channels it declares to the playlists' epgSourceIDs.
+func (p *Provider) parseEPG(reader io.Reader, playlists *playlistSet) (*xmltv.TV, error) {
+	var tracks []Track
+	for _, pl := range playlists.all() {
+		tracks = append(tracks, pl.tracks...)
+	}
+
+	var ids []string
+	tv, err := p.loadXMLTv(reader, tracks, &playlists.warnings, &ids)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(playlists.epgSourceIDs))
+	for _, id := range playlists.epgSourceIDs {
+		seen[id] = true
+	}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			playlists.epgSourceIDs = append(playlists.epgSourceIDs, id)
+		}
+	}
+	return tv, nil
+}
+
+// finishEPG merges the parsed guides and marshals the result.
+func (p *Provider) finishEPG(tvs []*xmltv.TV) (*xmltv.TV, []byte, epgCoverage, error) {
+	epg := mergeEPGs(tvs)
+
+	var coverage epgCoverage
+	for i := range epg.Programmes {
+		coverage.add(&epg.Programmes[i])
+	}
+
+	xmlData, err := marshalEPG(epg)
+	if err != nil {
+		return nil, nil, coverage, err
+	}
+
+	return epg, xmlData, coverage, nil
+}
+
+// mergeEPGs combines guides in order. A channel declared by several guides
+// keeps its first declaration, with empty display names, icons and URLs
+// filled in from later ones. Programmes are ordered by channel, then by start
+// time.
+func mergeEPGs(tvs []*xmltv.TV) *xmltv.TV {
+	if len(tvs) == 1 {
+		return tvs[0]
+	}
+
+	merged := *tvs[0]
+	merged.Channels = slices.Clone(merged.Channels)
+	channelIndex := make(map[string]int, len(merged.Channels))
+	for i, channel := range merged.Channels {
+		channelIndex[channel.ID] = i
+	}
+
+	for _, tv := range tvs[1:] {
+		for _, channel := range tv.Channels {
+			idx, exists := channelIndex[channel.ID]
+			if !exists {
+				channelIndex[channel.ID] = len(merged.Channels)
+				merged.Channels = append(merged.Channels, channel)
+				continue
+			}
+			kept := &merged.Channels[idx]
+			if len(kept.DisplayNames) == 0 {
+				kept.DisplayNames = channel.DisplayNames
+			}
+			if len(kept.Icons) == 0 {
+				kept.Icons = channel.Icons
+			}
+			if len(kept.URLs) == 0 {
+				kept.URLs = channel.URLs
+			}
+		}
+		merged.Programmes = append(slices.Clip(merged.Programmes), tv.Programmes...)
+	}
+
+	sort.SliceStable(merged.Programmes, func(i, j int) bool {
+		a, b := &merged.Programmes[i], &merged.Programmes[j]
+		idxA, okA := channelIndex[a.Channel]
+		idxB, okB := channelIndex[b.Channel]
+		if !okA {
+			idxA = len(channelIndex)
+		}
+		if !okB {
+			idxB = len(channelIndex)
+		}
+		if idxA != idxB {
+			return idxA < idxB
+		}
+		if a.Channel != b.Channel {
+			return a.Channel < b.Channel
+		}
+		startA, startB := xmltvTime(a.Start), xmltvTime(b.Start)
+		if startA == nil || startB == nil {
+			return startA != nil
+		}
+		return startA.Before(*startB)
+	})
+
+	return &merged
+}
+
+func marshalEPG(epg *xmltv.TV) ([]byte, error) {
+	xmlData, err := xml.Marshal(epg)
+	if err != nil {
+		return nil, err
+	}
+
+	xmlHeader := []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><!DOCTYPE tv SYSTEM \"xmltv.dtd\">")
+
+	return append(xmlHeader, xmlData...), nil
+}
+
+// epgPartIndex maps each channel id to the guide part it is placed in when
+// the guide is split into parts of size channels.
+func epgPartIndex(epg *xmltv.TV, size int) map[string]int {
+	index := make(map[string]int, len(epg.Channels))
+	for i, channel := range epg.Channels {
+		if _, exists := index[channel.ID]; !exists {
+			index[channel.ID] = i / size
+		}
+	}
+	return index
+}
+
+// splitEPG divides the guide into guides of at most size channels each,
+// carrying the programmes of their channels.
+func splitEPG(epg *xmltv.TV, size int) []*xmltv.TV {
+	parts := make([]*xmltv.TV, (len(epg.Channels)+size-1)/size)
+	for i := range parts {
+		part := *epg
+		part.Channels = nil
+		part.Programmes = nil
+		parts[i] = &part
+	}
+
+	for i, channel := range epg.Channels {
+		parts[i/size].Channels = append(parts[i/size].Channels, channel)
+	}
+
+	index := epgPartIndex(epg, size)
+	for _, programme := range epg.Programmes {
+		if n, ok := index[programme.Channel]; ok {
+			parts[n].Programmes = append(parts[n].Programmes, programme)
+		}
+	}
+
+	return parts
+}
+
+// getEpgParts returns the guide split into chunks of epgSplitChannels channels,
+// building and caching them on first use after a refresh. The caller must
+// hold dataLock.
+func (p *Provider) getEpgParts() [][]byte {
+	p.epgPartsLock.Lock()
+	defer p.epgPartsLock.Unlock()
+
+	if p.epgParts != nil || p.epg == nil {
+		return p.epgParts
+	}
+
+	size := p.config.EPGSplitChannels
+	if size <= 0 {
+		p.epgParts = [][]byte{p.epgData}
+		return p.epgParts
+	}
+
+	parts := [][]byte{}
+	for _, part := range splitEPG(p.epg, size) {
+		data, err := marshalEPG(part)
+		if err != nil {
+			log.WithError(err).Error("unable to marshal epg part")
+			return nil
+		}
+		parts = append(parts, data)
+	}
+	p.epgParts = parts
+
+	return p.epgParts
+}
+
+// PurgeCaches drops the cached logos and guide parts so that they are
+// fetched or rebuilt on next access.
+func (p *Provider) PurgeCaches() {
+	p.logos.purge()
+
+	p.epgPartsLock.Lock()
+	p.epgParts = nil
+	p.epgGzip = nil
+	p.epgPartsLock.Unlock()
+
+	log.Info("purged caches")
+}
+
+// GetEpgPart returns part n of the guide split by epgSplitChannels, or nil if
+// there is no such part. Without splitting, part 0 is the whole guide.
+func (p *Provider) GetEpgPart(n int) []byte {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.withholdData() {
+		return nil
+	}
+	parts := p.getEpgParts()
+	if n < 0 || n >= len(parts) {
+		return nil
+	}
+	return parts[n]
+}
+
+// EPGPartCount returns the number of parts the guide is split into.
+func (p *Provider) EPGPartCount() int {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return len(p.getEpgParts())
+}
+
+func (p *Provider) finishPlaylists(playlists *playlistSet, epg *xmltv.TV) {
+	for _, pl := range playlists.all() {
+		p.finishPlaylist(pl, epg)
+	}
+}
+
+// finishPlaylist applies the attributes that depend on the final set of
+// tracks, such as their channel numbers, or on the guide.
+func (p *Provider) finishPlaylist(pl *playlistLoader, epg *xmltv.TV) {
+	if p.config.RenumberChannels {
+		start := max(p.config.StartChannel, 1)
+		for i := range pl.tracks {
+			pl.tracks[i].setTag("tvg-chno", strconv.Itoa(start+i))
+		}
+	}
+	if p.config.LogoFromEPG {
+		applyEPGLogos(pl.tracks, epg)
+	}
+	if p.config.EmitPerChannelTvgURL && len(p.config.ServerAddress) > 0 {
+		applyTvgURLs(pl.tracks, epg, p.config)
+	}
+}
+
+// applyTvgURLs points the tvg-url of each track that has guide data at the
+// guide part holding its channel, or at the whole guide if it is not split.
+// It does nothing without a guide.
+func applyTvgURLs(tracks []Track, epg *xmltv.TV, config *Config) {
+	if epg == nil {
+		return
+	}
+	var index map[string]int
+	if config.EPGSplitChannels > 0 {
+		index = epgPartIndex(epg, config.EPGSplitChannels)
+	} else {
+		index = make(map[string]int, len(epg.Channels))
+		for _, channel := range epg.Channels {
+			index[channel.ID] = 0
+		}
+	}
+
+	for i := range tracks {
+		track := &tracks[i]
+		part, ok := index[track.Tags["tvg-id"]]
+		if !ok {
+			continue
+		}
+		if config.EPGSplitChannels > 0 {
+			track.setTag("tvg-url", fmt.Sprintf("http://%s/epg/%d.xml", config.ServerAddress, part))
+		} else {
+			track.setTag("tvg-url", fmt.Sprintf("http://%s/epg.xml", config.ServerAddress))
+		}
+	}
+}
+
+// applyEPGLogos fills in tvg-logo for tracks that lack one from the icon of
+// their matched guide channel. It does nothing without a guide.
+func applyEPGLogos(tracks []Track, epg *xmltv.TV) {
+	if epg == nil {
+		return
+	}
+	icons := make(map[string]string, len(epg.Channels))
+	for _, channel := range epg.Channels {
+		if len(channel.Icons) > 0 && len(channel.Icons[0].Source) > 0 {
+			icons[channel.ID] = channel.Icons[0].Source
+		}
+	}
+
+	for i := range tracks {
+		track := &tracks[i]
+		if len(track.Tags["tvg-logo"]) > 0 {
+			continue
+		}
+		if icon, ok := icons[track.Tags["tvg-id"]]; ok {
+			track.setTag("tvg-logo", icon)
+		}
+	}
+}
+
+func (p *Provider) publish(playlists *playlistSet, epg *xmltv.TV, epgData []byte, coverage epgCoverage) {
+	p.dataLock.Lock()
+	defer p.dataLock.Unlock()
+
+	p.setPlaylists(playlists)
+	p.setEPG(playlists, epg, epgData, coverage)
+}
+
+// setPlaylists publishes the playlists, keeping the current guide. The caller
+// must hold dataLock for writing.
+func (p *Provider) setPlaylists(playlists *playlistSet) {
+	p.playlist = playlists.main
+	p.lineups = playlists.lineups
+	p.radio = playlists.radio
+	p.source = playlists.source
+	p.warnings = slices.Clone(playlists.warnings)
+	p.version = contentVersion(playlists, p.epgData)
+	p.lastRefresh = p.now()
+	p.generation++
+	p.metrics.update(p.groupCounts(), len(p.playlist.tracks), p.lastRefresh)
+}
+
+// setEPG publishes the guide loaded for playlists. The caller must hold
+// dataLock for writing.
+func (p *Provider) setEPG(playlists *playlistSet, epg *xmltv.TV, epgData []byte, coverage epgCoverage) {
+	p.epg = epg
+	p.epgData = epgData
+	p.epgPartsLock.Lock()
+	p.epgParts = nil
+	p.epgGzip = nil
+	p.epgPartsLock.Unlock()
+	p.coverage = coverage
+	p.warnings = slices.Clone(playlists.warnings)
+	p.epgSourceIDs = playlists.epgSourceIDs
+	p.version = contentVersion(playlists, epgData)
+	p.metrics.updateEPG(len(epg.Programmes))
+}
+
+// dataExpired reports whether the published data is older than maxDataAge,
+// which happens when refreshes keep failing.
+func (p *Provider) dataExpired() bool {
+	if p.lastRefresh.IsZero() || p.config.MaxDataAge <= 0 {
+		return false
+	}
+	return p.now().Sub(p.lastRefresh) > p.config.MaxDataAge
+}
+
+// withholdData reports whether expired data should be replaced by an empty
+// playlist and guide.
+func (p *Provider) withholdData() bool {
+	return p.dataExpired() && p.config.OnFailure == "empty"
+}
+
+// DataError returns ErrDataExpired if the published data has expired and the
+// onFailure policy requires an error to be served in its place.
+func (p *Provider) DataError() error {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.dataExpired() && p.config.OnFailure == "error" {
+		return ErrDataExpired
+	}
+	return nil
+}
+
+// contentVersion hashes everything the provider serves so that refreshes
+// yielding identical output keep the same version.
+func contentVersion(playlists *playlistSet, epgData []byte) string {
+	h := sha256.New()
+	playlists.main.writeM3u(h)
+	names := make([]string, 0, len(playlists.lineups))
+	for name := range playlists.lineups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%s\x00", name)
+		playlists.lineups[name].writeM3u(h)
+	}
+	if playlists.radio != nil {
+		h.Write([]byte("\x00radio\x00"))
+		playlists.radio.writeM3u(h)
+	}
+	h.Write([]byte{0})
+	h.Write(epgData)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// ContentVersion returns an opaque version of the current M3U and EPG data,
+// suitable for use as an ETag. It is empty until the first refresh.
+func (p *Provider) ContentVersion() string {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return p.version
+}
+
+func (p *Provider) GetM3u() string {
+	var m3u strings.Builder
+	p.WriteM3u(&m3u)
+	return m3u.String()
+}
+
+// WriteM3u renders the main playlist to w without building it in memory
+// first. Nothing is written until the first refresh.
+func (p *Provider) WriteM3u(w io.Writer) error {
+	// Published playlists are never modified, so the playlist is rendered
+	// after releasing dataLock and a slow client does not hold up refreshes.
+	p.dataLock.RLock()
+	playlist, withhold := p.playlist, p.withholdData()
+	p.dataLock.RUnlock()
+
+	if playlist == nil {
+		return nil
+	}
+	if withhold {
+		_, err := io.WriteString(w, emptyM3u)
+		return err
+	}
+	return playlist.writeM3u(w)
+}
+
+// GetM3uRaw returns the main playlist with each channel's upstream URL in
+// place of its rewritten one.
+func (p *Provider) GetM3uRaw() string {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.playlist == nil {
+		return ""
+	}
+	if p.withholdData() {
+		return emptyM3u
+	}
+	var m3u strings.Builder
+	p.playlist.renderM3u(&m3u, false)
+	return m3u.String()
+}
+
+// GetM3uForLineup returns the rendered playlist of the named lineup.
+func (p *Provider) GetM3uForLineup(name string) (string, bool) {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	pl, ok := p.lineups[name]
+	if !ok {
+		return "", false
+	}
+	if p.withholdData() {
+		return emptyM3u, true
+	}
+	return pl.m3uString(), true
+}
+
+// GetRadioM3u returns the rendered radio playlist. It is always empty unless
+// splitRadio is set.
+func (p *Provider) GetRadioM3u() string {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.radio == nil {
+		return ""
+	}
+	if p.withholdData() {
+		return emptyM3u
+	}
+	return p.radio.m3uString()
+}
+
+func (p *Provider) GetEpgXML() string {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.withholdData() {
+		return emptyEpgXML
+	}
+	return string(p.epgData)
+}
+
+// GetEpgXMLGzip returns the guide as GetEpgXML does, gzipped. The compressed
+// guide is kept until the next refresh.
+func (p *Provider) GetEpgXMLGzip() []byte {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.withholdData() || p.epgData == nil {
+		return gzipBytes([]byte(emptyEpgXML))
+	}
+
+	p.epgPartsLock.Lock()
+	defer p.epgPartsLock.Unlock()
+	if p.epgGzip == nil {
+		p.epgGzip = gzipBytes(p.epgData)
+	}
+	return p.epgGzip
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+	return buf.Bytes()
+}
+
+type epgJSONChannel struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Programmes []epgJSONProgramme `json:"programmes"`
+}
+
+type epgJSONProgramme struct {
+	Start       *time.Time `json:"start,omitempty"`
+	Stop        *time.Time `json:"stop,omitempty"`
+	Title       string     `json:"title"`
+	Description string     `json:"desc,omitempty"`
+}
+
+// GetEpgJSON returns the filtered guide as a list of channels with their
+// programmes nested, with times in ISO-8601.
+func (p *Provider) GetEpgJSON() ([]byte, error) {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	channels := []epgJSONChannel{}
+	if p.epg == nil || p.withholdData() {
+		return json.Marshal(channels)
+	}
+
+	index := make(map[string]int, len(p.epg.Channels))
+	for _, channel := range p.epg.Channels {
+		if _, exists := index[channel.ID]; exists {
+			continue
+		}
+		entry := epgJSONChannel{ID: channel.ID, Programmes: []epgJSONProgramme{}}
+		if len(channel.DisplayNames) > 0 {
+			entry.Name = channel.DisplayNames[0].Value
+		}
+		index[channel.ID] = len(channels)
+		channels = append(channels, entry)
+	}
+
+	for _, programme := range p.epg.Programmes {
+		i, ok := index[programme.Channel]
+		if !ok {
+			continue
+		}
+		entry := epgJSONProgramme{
+			Start: xmltvTime(programme.Start),
+			Stop:  xmltvTime(programme.Stop),
+		}
+		if len(programme.Titles) > 0 {
+			entry.Title = programme.Titles[0].Value
+		}
+		if len(programme.Descriptions) > 0 {
+			entry.Description = programme.Descriptions[0].Value
+		}
+		channels[i].Programmes = append(channels[i].Programmes, entry)
+	}
+
+	return json.Marshal(channels)
+}
+
+func xmltvTime(t *xmltv.Time) *time.Time {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return &t.Time
+}
+
+type trackJSON struct {
+	ID    string            `json:"tvg_id"`
+	Name  string            `json:"name"`
+	Group string            `json:"group_title"`
+	Logo  string            `json:"logo"`
+	URL   string            `json:"url"`
+	Tags  map[string]string `json:"tags"`
+}
+
+// GetTracksJSON returns the tracks of the main playlist, filtered and sorted as
+// in the M3U, with the URLs they are served at.
+func (p *Provider) GetTracksJSON() ([]byte, error) {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	tracks := []trackJSON{}
+	if p.playlist == nil || p.withholdData() {
+		return json.Marshal(tracks)
+	}
+
+	rewriteURL := len(p.playlist.baseAddress) > 0
+	for i := range p.playlist.tracks {
+		track := &p.playlist.tracks[i]
+		tags := make(map[string]string, len(track.Tags))
+		for key, value := range track.Tags {
+			tags[key] = value
+		}
+		tracks = append(tracks, trackJSON{
+			ID:    track.Tags["tvg-id"],
+			Name:  track.Name,
+			Group: track.Tags["group-title"],
+			Logo:  track.Tags["tvg-logo"],
+			URL:   p.playlist.trackURL(i, rewriteURL),
+			Tags:  tags,
+		})
+	}
+
+	return json.Marshal(tracks)
+}
+
+// trackNotFound returns the empty track returned by failed lookups, for which
+// IsEmpty reports true. Each call returns a new value so that a caller
+// modifying it cannot affect later lookups.
+func trackNotFound() *Track {
+	return &Track{}
+}
+
+// trackAt returns the track at idx in pl, or an empty track if there is none.
+func trackAt(pl *playlistLoader, idx int) *Track {
+	if pl == nil || idx < 0 || idx >= len(pl.tracks) {
+		return trackNotFound()
+	}
+	return &pl.tracks[idx]
+}
+
+// GetTrack returns the track at idx in the main playlist, or an empty track if
+// idx is out of range. The track belongs to the published playlist and must
+// not be modified.
+func (p *Provider) GetTrack(idx int) *Track {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.withholdData() {
+		return trackNotFound()
+	}
+	return trackAt(p.playlist, idx)
+}
+
+// GetChannelURLs returns the upstream URLs for a channel, primary first,
+// followed by any alternates collected while deduplicating.
+func (p *Provider) GetChannelURLs(idx int) []string {
+	return p.GetTrack(idx).urls()
+}
+
+// GetLineupTrack returns the track at idx in the named lineup.
+func (p *Provider) GetLineupTrack(name string, idx int) *Track {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.withholdData() {
+		return trackNotFound()
+	}
+	return trackAt(p.lineups[name], idx)
+}
+
+// GetRadioTrack returns the track at idx in the radio playlist.
+func (p *Provider) GetRadioTrack(idx int) *Track {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.withholdData() {
+		return trackNotFound()
+	}
+	return trackAt(p.radio, idx)
+}
+
+// GroupCounts returns the number of channels in the main playlist per
+// group-title. Channels without a group are counted under "".
+func (p *Provider) GroupCounts() map[string]int {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return p.groupCounts()
+}
+
+func (p *Provider) groupCounts() map[string]int {
+	counts := make(map[string]int)
+	if p.playlist == nil {
+		return counts
+	}
+	for i := range p.playlist.tracks {
+		counts[p.playlist.tracks[i].Tags["group-title"]]++
+	}
+	return counts
+}
+
+// LastWarnings returns the data-quality warnings collected by the last
+// successful refresh.
+func (p *Provider) LastWarnings() []Warning {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return append([]Warning(nil), p.warnings...)
+}
+
+// EPGSourceIDs returns the distinct ids of every channel declared by the last
+// loaded guide, including channels dropped for not being in the playlist.
+func (p *Provider) EPGSourceIDs() []string {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return append([]string(nil), p.epgSourceIDs...)
+}
+
+// LastProfile returns the profile of the last successful refresh, or nil if
+// profiling is disabled.
+func (p *Provider) LastProfile() *RefreshProfile {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return p.profile
+}
+
+// EPGCoverage returns the earliest programme start and the latest programme
+// stop in the guide. Both are zero if the guide holds no programmes.
+func (p *Provider) EPGCoverage() (from, to time.Time) {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return p.coverage.from, p.coverage.to
+}
+
+// GetLastRefresh returns when data was last published, which is the same as
+// GetLastSuccessfulRefresh.
+func (p *Provider) GetLastRefresh() time.Time {
+	return p.GetLastSuccessfulRefresh()
+}
+
+// GetLastSuccessfulRefresh returns when the data being served was published,
+// or the zero time if no refresh has succeeded yet.
+func (p *Provider) GetLastSuccessfulRefresh() time.Time {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return p.lastRefresh
+}
+
+// GetLastError returns the error of the last refresh, or nil if it succeeded.
+// An asynchronous EPG that fails to load is reported here as well.
+func (p *Provider) GetLastError() error {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	return p.lastError
+}
+
+// FilterStats returns the number of source tracks each filter of the main
+// playlist matched, keyed by the filter's type and pattern, e.g. "group:News",
+// with exclude filters prefixed by "!".
+func (p *Provider) FilterStats() map[string]int {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	if p.playlist == nil {
+		return make(map[string]int)
+	}
+	return p.playlist.filterStats()
+}
+
+// HealthStatus describes the published data for health checks.
+type HealthStatus struct {
+	Healthy        bool       `json:"healthy"`
+	LastRefresh    *time.Time `json:"lastRefresh"`
+	ChannelCount   int        `json:"channelCount"`
+	ProgrammeCount int        `json:"programmeCount"`
+}
+
+// Health reports whether data has been published, no longer than
+// maxRefreshAge ago if that is set.
+func (p *Provider) Health() HealthStatus {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	var status HealthStatus
+	if p.lastRefresh.IsZero() {
+		return status
+	}
+	lastRefresh := p.lastRefresh
+	status.LastRefresh = &lastRefresh
+	status.Healthy = p.config.MaxRefreshAge <= 0 || p.now().Sub(lastRefresh) <= p.config.MaxRefreshAge
+	if p.playlist != nil {
+		status.ChannelCount = len(p.playlist.tracks)
+	}
+	if p.epg != nil {
+		status.ProgrammeCount = len(p.epg.Programmes)
+	}
+	return status
 }
@@ -1,11 +1,28 @@
 package proxytv
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/csfrancis/proxytv/xmltv"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func createTempFile(content string, pattern string) (*os.File, error) {
@@ -22,6 +39,39 @@ func createTempFile(content string, pattern string) (*os.File, error) {
 	return tmpFile, nil
 }
 
+// newTestProvider creates a provider for config backed by temporary M3U and
+// EPG files and performs an initial refresh.
+func newTestProvider(t *testing.T, config *Config, m3uContent string, epgContent string) *Provider {
+	m3uFile, err := createTempFile(m3uContent, "test_m3u_*.m3u")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(m3uFile.Name()) })
+	config.IPTVUrl = filepath.ToSlash(m3uFile.Name())
+
+	epgFile, err := createTempFile(epgContent, "test_epg_*.xml")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(epgFile.Name()) })
+	config.EPGUrl = filepath.ToSlash(epgFile.Name())
+
+	if err := config.compileFilterRegexps(); err != nil {
+		t.Fatalf("Failed to compile filters: %v", err)
+	}
+
+	provider, err := NewProvider(config)
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+	if err := provider.Refresh(); err != nil {
+		t.Fatalf("Failed to refresh provider: %v", err)
+	}
+	return provider
+}
+
+const emptyEpg = `<?xml version="1.0" encoding="UTF-8"?><tv></tv>`
+
 func TestProviderLoad(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -107,6 +157,139 @@ http://test.com:6078/channel/1
 `,
 			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
 <!DOCTYPE tv SYSTEM "xmltv.dtd">
+`,
+			wantErr: false,
+		},
+		{
+			name: "Preserved comments",
+			config: &Config{
+				PreserveComments: true,
+			},
+			m3uContent: `#EXTM3U
+#PLAYLIST:My Channels
+# first comment
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+# second comment
+# third comment
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+#EXTVLCOPT:http-user-agent=Mozilla/5.0
+# fourth comment
+#EXTGRP:News
+http://example.com/channel2
+# last comment`,
+			expectedM3u: `#EXTM3U
+#PLAYLIST:My Channels
+# first comment
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+# second comment
+# third comment
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+#EXTVLCOPT:http-user-agent=Mozilla/5.0
+# fourth comment
+#EXTGRP:News
+http://example.com/channel2
+# last comment
+`,
+			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE tv SYSTEM "xmltv.dtd">
+`,
+			wantErr: false,
+		},
+		{
+			name:   "Discarded comments",
+			config: &Config{},
+			m3uContent: `#EXTM3U
+#PLAYLIST:My Channels
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+# comment
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+#EXTGRP:News
+http://example.com/channel2
+# last comment`,
+			expectedM3u: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+http://example.com/channel2
+`,
+			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE tv SYSTEM "xmltv.dtd">
+`,
+			wantErr: false,
+		},
+		{
+			name:   "Player options",
+			config: &Config{},
+			m3uContent: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+#EXTVLCOPT:http-user-agent=Mozilla/5.0
+#KODIPROP:inputstream.adaptive.license_type=com.widevine.alpha
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+http://example.com/channel2`,
+			expectedM3u: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+#EXTVLCOPT:http-user-agent=Mozilla/5.0
+#KODIPROP:inputstream.adaptive.license_type=com.widevine.alpha
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+http://example.com/channel2
+`,
+			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE tv SYSTEM "xmltv.dtd">
+`,
+			wantErr: false,
+		},
+		{
+			name: "Canonical attribute order",
+			config: &Config{
+				CanonicalAttributes: true,
+			},
+			m3uContent: `#EXTM3U
+#EXTINF:-1 group-title="News" tvg-logo="http://example.com/1.png" zeta="z" tvg-name="name1" alpha="a" tvg-id="id1",Channel 1
+http://example.com/channel1`,
+			expectedM3u: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" tvg-logo="http://example.com/1.png" group-title="News" alpha="a" zeta="z",Channel 1
+http://example.com/channel1
+`,
+			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE tv SYSTEM "xmltv.dtd">
+`,
+			wantErr: false,
+		},
+		{
+			name:   "URL with spaces",
+			config: &Config{},
+			m3uContent: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/my channel.ts?token=a b`,
+			expectedM3u: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/my%20channel.ts?token=a%20b
+`,
+			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE tv SYSTEM "xmltv.dtd">
+`,
+			wantErr: false,
+		},
+		{
+			name: "EPG header attributes",
+			config: &Config{
+				ServerAddress:       "test.com:6078",
+				EPGHeaderAttributes: []string{"url-tvg", "x-tvg-url"},
+			},
+			m3uContent: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`,
+			expectedM3u: `#EXTM3U url-tvg="http://test.com:6078/epg.xml" x-tvg-url="http://test.com:6078/epg.xml"
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+`,
+			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE tv SYSTEM "xmltv.dtd">
 `,
 			wantErr: false,
 		},
@@ -145,3 +328,2757 @@ http://test.com:6078/channel/1
 		})
 	}
 }
+
+func TestProviderGetTrackNotFound(t *testing.T) {
+	provider, err := NewProvider(&Config{})
+	assert.NoError(t, err)
+
+	assert.True(t, provider.GetTrack(0).IsEmpty(), "empty provider")
+	assert.True(t, provider.GetTrack(-1).IsEmpty(), "empty provider, negative index")
+	assert.True(t, provider.GetRadioTrack(0).IsEmpty(), "empty provider, radio")
+	assert.True(t, provider.GetLineupTrack("news", 0).IsEmpty(), "empty provider, lineup")
+
+	provider = newTestProvider(t, &Config{
+		SplitRadio: true,
+		Lineups:    []*Lineup{{Name: "news", Filters: []*Filter{{Type: "group", Value: "News"}}}},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" radio="true",Radio 1
+http://example.com/radio1`, emptyEpg)
+
+	assert.Equal(t, "Channel 1", provider.GetTrack(0).Name)
+	for _, idx := range []int{-1, -100, 1, 100} {
+		assert.True(t, provider.GetTrack(idx).IsEmpty(), "index %d", idx)
+		assert.True(t, provider.GetRadioTrack(idx).IsEmpty(), "radio index %d", idx)
+		assert.True(t, provider.GetLineupTrack("news", idx).IsEmpty(), "lineup index %d", idx)
+	}
+
+	// Modifying a failed lookup's track does not leak into later lookups.
+	missing := provider.GetTrack(5)
+	missing.Name = "Modified"
+	missing.URI = mustParseURL("http://example.com/modified")
+	assert.True(t, provider.GetTrack(5).IsEmpty())
+	assert.Empty(t, provider.GetTrack(5).Name)
+}
+
+func TestProviderChannelURLs(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1a
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1b
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1 Backup
+http://example.com/channel1c
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+http://example.com/channel2`, emptyEpg)
+
+	assert.Equal(t, []string{
+		"http://example.com/channel1a",
+		"http://example.com/channel1b",
+		"http://example.com/channel1c",
+	}, provider.GetChannelURLs(0))
+	assert.Equal(t, []string{"http://example.com/channel2"}, provider.GetChannelURLs(1))
+	assert.Nil(t, provider.GetChannelURLs(2))
+}
+
+func TestProviderOutputIDCase(t *testing.T) {
+	provider := newTestProvider(t, &Config{OutputIDCase: "lower"}, `#EXTM3U
+#EXTINF:-1 tvg-id="CNN.us" tvg-name="CNN",CNN
+http://example.com/cnn`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="cnn.US"><display-name>CNN</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="Cnn.Us"><title>News</title></programme>
+</tv>`)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="cnn.us" tvg-name="CNN",CNN
+http://example.com/cnn
+`, provider.GetM3u())
+
+	epg := provider.GetEpgXML()
+	assert.Contains(t, epg, `<channel id="cnn.us">`)
+	assert.Contains(t, epg, `channel="cnn.us"`)
+
+	for _, mode := range []string{"preserve", "lower"} {
+		provider = newTestProvider(t, &Config{OutputIDCase: mode}, `#EXTM3U
+#EXTINF:-1 tvg-id=cnn.us tvg-name='CNN',CNN
+http://example.com/cnn`, emptyEpg)
+		assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id=cnn.us tvg-name='CNN',CNN
+http://example.com/cnn
+`, provider.GetM3u(), mode)
+	}
+}
+
+func TestProviderLoadFromBytes(t *testing.T) {
+	config := &Config{
+		Filters: []*Filter{
+			{Type: "group", Value: "News"},
+		},
+	}
+	err := config.compileFilterRegexps()
+	assert.NoError(t, err)
+
+	provider, err := NewProvider(config)
+	assert.NoError(t, err)
+
+	err = provider.LoadFromBytes([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" group-title="Sports",Channel 2
+http://example.com/channel2`), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <channel id="id2"><display-name>Channel 2</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id2"><title>Sports</title></programme>
+</tv>`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="News",Channel 1
+http://example.com/channel1
+`, provider.GetM3u())
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?><!DOCTYPE tv SYSTEM "xmltv.dtd">`+
+		`<tv><channel id="id1"><display-name>Channel 1</display-name></channel>`+
+		`<programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme></tv>`,
+		provider.GetEpgXML())
+	assert.False(t, provider.GetLastRefresh().IsZero())
+	assert.NoError(t, provider.GetLastError())
+
+	err = provider.LoadFromBytes([]byte("not a playlist"), []byte(emptyEpg))
+	assert.ErrorIs(t, err, errMalformedM3U)
+	assert.Equal(t, err, provider.GetLastError())
+
+	// A refresh in progress holds back the load until it finishes.
+	provider.refreshLock.Lock()
+	done := make(chan error, 1)
+	go func() { done <- provider.LoadFromBytes([]byte("#EXTM3U\n"), []byte(emptyEpg)) }()
+	select {
+	case <-done:
+		t.Fatal("LoadFromBytes did not wait for the refresh in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	provider.refreshLock.Unlock()
+	assert.NoError(t, <-done)
+	assert.Equal(t, "#EXTM3U\n", provider.GetM3u())
+}
+
+func TestProviderLogoFromEPG(t *testing.T) {
+	provider := newTestProvider(t, &Config{LogoFromEPG: true}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" tvg-logo="http://example.com/own.png",Channel 2
+http://example.com/channel2`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name><icon src="http://example.com/epg1.png"/></channel>
+  <channel id="id2"><display-name>Channel 2</display-name><icon src="http://example.com/epg2.png"/></channel>
+</tv>`)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" tvg-logo="http://example.com/epg1.png",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" tvg-logo="http://example.com/own.png",Channel 2
+http://example.com/channel2
+`, provider.GetM3u())
+
+	// Without a guide there is nothing to apply.
+	tracks := []Track{provider.GetTrack(0).clone()}
+	assert.NotPanics(t, func() {
+		applyEPGLogos(tracks, nil)
+		applyTvgURLs(tracks, nil, &Config{ServerAddress: "localhost:6078"})
+	})
+}
+
+func TestProviderDedupByURI(t *testing.T) {
+	provider := newTestProvider(t, &Config{DedupByURI: true}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/shared
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+http://example.com/shared
+#EXTINF:-1 tvg-id="id3" tvg-name="name3",Channel 3
+http://example.com/channel3`, emptyEpg)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/shared
+#EXTINF:-1 tvg-id="id3" tvg-name="name3",Channel 3
+http://example.com/channel3
+`, provider.GetM3u())
+}
+
+func TestProviderGetEpgJSON(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>Morning</title><desc>Wake up</desc></programme>
+  <programme start="20240101010000 +0100" channel="id1"><title>Noon</title></programme>
+</tv>`)
+
+	data, err := provider.GetEpgJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+  {
+    "id": "id1",
+    "name": "Channel 1",
+    "programmes": [
+      {"start": "2024-01-01T00:00:00Z", "stop": "2024-01-01T01:00:00Z", "title": "Morning", "desc": "Wake up"},
+      {"start": "2024-01-01T01:00:00+01:00", "title": "Noon"}
+    ]
+  }
+]`, string(data))
+}
+
+func TestProviderGetEpgXMLGzip(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+</tv>`)
+
+	gunzipped := func() string {
+		gz, err := gzip.NewReader(bytes.NewReader(provider.GetEpgXMLGzip()))
+		require.NoError(t, err)
+		data, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, provider.GetEpgXML(), gunzipped())
+	assert.Contains(t, gunzipped(), "Channel 1")
+
+	// A refresh replaces the compressed guide.
+	require.NoError(t, provider.LoadFromBytes([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Renamed</display-name></channel>
+</tv>`)))
+	assert.Equal(t, provider.GetEpgXML(), gunzipped())
+	assert.Contains(t, gunzipped(), "Renamed")
+}
+
+func TestProviderGetTracksJSON(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-logo="http://example.com/logo1.png" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="Sports",Channel 2
+http://example.com/channel2`
+
+	provider := newTestProvider(t, &Config{}, m3u, emptyEpg)
+	data, err := provider.GetTracksJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+  {
+    "tvg_id": "id1",
+    "name": "Channel 1",
+    "group_title": "News",
+    "logo": "http://example.com/logo1.png",
+    "url": "http://example.com/channel1",
+    "tags": {"tvg-id": "id1", "tvg-logo": "http://example.com/logo1.png", "group-title": "News"}
+  },
+  {
+    "tvg_id": "id2",
+    "name": "Channel 2",
+    "group_title": "Sports",
+    "logo": "",
+    "url": "http://example.com/channel2",
+    "tags": {"tvg-id": "id2", "group-title": "Sports"}
+  }
+]`, string(data))
+
+	provider = newTestProvider(t, &Config{ServerAddress: "localhost:6078", UseFFMPEG: true}, m3u, emptyEpg)
+	data, err = provider.GetTracksJSON()
+	assert.NoError(t, err)
+	var tracks []map[string]any
+	assert.NoError(t, json.Unmarshal(data, &tracks))
+	assert.Len(t, tracks, 2)
+	assert.Equal(t, "http://localhost:6078/channel/0", tracks[0]["url"])
+	assert.Equal(t, "http://localhost:6078/channel/1", tracks[1]["url"])
+}
+
+func TestProviderNormalizedFilter(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="España",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" group-title="France",Channel 2
+http://example.com/channel2`
+
+	provider := newTestProvider(t, &Config{
+		Filters: []*Filter{{Type: "group", Value: "^Espana$", Normalize: true}},
+	}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="España",Channel 1
+http://example.com/channel1
+`, provider.GetM3u())
+
+	provider = newTestProvider(t, &Config{
+		Filters: []*Filter{{Type: "group", Value: "^Espana$"}},
+	}, m3u, emptyEpg)
+	assert.Equal(t, "#EXTM3U\n", provider.GetM3u())
+
+	for _, pattern := range []string{"^España$", "^ESPAÑA$"} {
+		provider = newTestProvider(t, &Config{
+			Filters: []*Filter{{Type: "group", Value: pattern, Normalize: true}},
+		}, m3u, emptyEpg)
+		assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="España",Channel 1
+http://example.com/channel1
+`, provider.GetM3u(), pattern)
+	}
+
+	// Regex escapes keep their case, so \D still matches non-digits.
+	filter := &Filter{Type: "name", Value: `^\D+ 2$`, Normalize: true}
+	require.NoError(t, filter.Validate())
+	assert.True(t, filter.matches("Canal Dos 2"))
+	assert.False(t, filter.matches("Canal 22"))
+
+	filter = &Filter{Type: "group", Value: `^\p{Lu}`, Normalize: true}
+	require.NoError(t, filter.Validate())
+	assert.True(t, filter.matches("España"))
+}
+
+func TestProviderHierarchicalGroupFilter(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="Sports / Football / UK",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" group-title="Sports / Tennis / Football",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="name3" group-title="Football",Channel 3
+http://example.com/channel3`
+
+	tests := []struct {
+		name     string
+		filter   *Filter
+		expected []string
+	}{
+		{
+			name:     "Any segment",
+			filter:   &Filter{Type: "group", Value: "^Football$", Separator: "/"},
+			expected: []string{"Channel 1", "Channel 2", "Channel 3"},
+		},
+		{
+			name:     "Mid-level segment",
+			filter:   &Filter{Type: "group", Value: "^Football$", Separator: "/", Depth: 2},
+			expected: []string{"Channel 1"},
+		},
+		{
+			name:     "Full path",
+			filter:   &Filter{Type: "group", Value: "^Sports / Tennis", Separator: "/"},
+			expected: []string{"Channel 2"},
+		},
+		{
+			name:     "Without separator",
+			filter:   &Filter{Type: "group", Value: "^Football$"},
+			expected: []string{"Channel 3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{Filters: []*Filter{tt.filter}}, m3u, emptyEpg)
+
+			var names []string
+			for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+				names = append(names, provider.GetTrack(i).Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestProviderLineups(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		UseFFMPEG:     true,
+		ServerAddress: "localhost:6078",
+		Lineups: []*Lineup{
+			{Name: "news", Filters: []*Filter{{Value: "News", Type: "name"}}},
+			{Name: "sports", Filters: []*Filter{{Value: "Sports", Type: "name"}}},
+		},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="News 1",News 1
+http://example.com/news1
+#EXTINF:-1 tvg-id="id2" tvg-name="Sports 1",Sports 1
+http://example.com/sports1
+#EXTINF:-1 tvg-id="id3" tvg-name="News 2",News 2
+http://example.com/news2`, emptyEpg)
+
+	news, ok := provider.GetM3uForLineup("news")
+	assert.True(t, ok)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="News 1",News 1
+http://localhost:6078/lineup/news/channel/0
+#EXTINF:-1 tvg-id="id3" tvg-name="News 2",News 2
+http://localhost:6078/lineup/news/channel/1
+`, news)
+
+	sports, ok := provider.GetM3uForLineup("sports")
+	assert.True(t, ok)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id2" tvg-name="Sports 1",Sports 1
+http://localhost:6078/lineup/sports/channel/0
+`, sports)
+
+	assert.Equal(t, "http://example.com/news2", provider.GetLineupTrack("news", 1).URI.String())
+	assert.True(t, provider.GetLineupTrack("sports", 1).IsEmpty())
+	assert.True(t, provider.GetLineupTrack("missing", 0).IsEmpty())
+
+	_, ok = provider.GetM3uForLineup("missing")
+	assert.False(t, ok)
+}
+
+func TestProviderContentVersion(t *testing.T) {
+	config := &Config{}
+	provider := newTestProvider(t, config, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	version := provider.ContentVersion()
+	assert.NotEmpty(t, version)
+
+	require.NoError(t, provider.Refresh())
+	assert.Equal(t, version, provider.ContentVersion())
+
+	require.NoError(t, os.WriteFile(config.IPTVUrl, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
+http://example.com/channel2`), 0644))
+	require.NoError(t, provider.Refresh())
+	assert.NotEqual(t, version, provider.ContentVersion())
+}
+
+func TestProviderSetBaseAddress(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		UseFFMPEG:     true,
+		ServerAddress: "localhost:6078",
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	assert.Contains(t, provider.GetM3u(), "http://localhost:6078/channel/0")
+
+	provider.SetBaseAddress("proxy:8080")
+	assert.Contains(t, provider.GetM3u(), "http://localhost:6078/channel/0")
+
+	require.NoError(t, provider.Refresh())
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://proxy:8080/channel/0
+`, provider.GetM3u())
+}
+
+func TestProviderMaxDataAge(t *testing.T) {
+	tests := []struct {
+		policy      string
+		expectedM3u string
+		expectedErr error
+	}{
+		{
+			policy: "serve-stale",
+			expectedM3u: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+`,
+		},
+		{
+			policy: "error",
+			expectedM3u: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+`,
+			expectedErr: ErrDataExpired,
+		},
+		{
+			policy:      "empty",
+			expectedM3u: "#EXTM3U\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			config := &Config{MaxDataAge: time.Hour, OnFailure: tt.policy}
+			provider := newTestProvider(t, config, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+			now := provider.GetLastRefresh()
+			provider.now = func() time.Time { return now }
+
+			require.NoError(t, os.Remove(config.IPTVUrl))
+			for i := 0; i < 3; i++ {
+				now = now.Add(30 * time.Minute)
+				assert.Error(t, provider.Refresh())
+			}
+
+			assert.Equal(t, tt.expectedM3u, provider.GetM3u())
+			assert.Equal(t, tt.expectedErr, provider.DataError())
+			assert.Equal(t, tt.policy == "empty", provider.GetTrack(0).IsEmpty())
+		})
+	}
+}
+
+func TestProviderEPGCoverage(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240105000000 +0000" stop="20240105010000 +0000" channel="id1"><title>Middle</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>First</title></programme>
+  <programme start="20240114230000 +0000" channel="id1"><title>Last</title></programme>
+  <programme start="20231201000000 +0000" stop="20240201000000 +0000" channel="id2"><title>Dropped</title></programme>
+</tv>`)
+
+	from, to := provider.EPGCoverage()
+	assert.True(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Equal(from), from)
+	assert.True(t, time.Date(2024, 1, 14, 23, 0, 0, 0, time.UTC).Equal(to), to)
+
+	empty := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`, emptyEpg)
+	from, to = empty.EPGCoverage()
+	assert.True(t, from.IsZero())
+	assert.True(t, to.IsZero())
+}
+
+func TestProviderLastWarnings(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-name="name2",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="name3",Channel 1
+http://example.com/channel3`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>Good</title></programme>
+  <programme start="yesterday" channel="id1"><title>Bad</title></programme>
+  <programme start="20240101000000 +0000" channel="other"><title>Other</title></programme>
+  <programme start="20240101010000 +0000" channel="id1"><title>After</title></programme>
+</tv>`)
+
+	assert.Equal(t, []Warning{
+		{Kind: "missing-tvg-id", Message: "1 tracks have no tvg-id"},
+		{Kind: "duplicate-name", Message: `duplicate channel name "Channel 1"`, Line: 6},
+		{Kind: "unparseable-timestamp", Message: `unparseable programme timestamp "yesterday"`, Line: 5},
+		{Kind: "dropped-programmes", Message: "1 programmes dropped for channels not in the playlist"},
+	}, provider.LastWarnings())
+
+	data, err := provider.GetEpgJSON()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Good")
+	assert.Contains(t, string(data), "After")
+	assert.NotContains(t, string(data), "Bad")
+}
+
+func TestProviderTimeShift(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		TimeShift: map[string]float64{"id1": 2, "id2": -0.5},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3",Channel 3
+http://example.com/channel3`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"></channel>
+  <channel id="id2"></channel>
+  <channel id="id3"></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>Shifted</title></programme>
+  <programme start="tomorrow" channel="id1"><title>Bad</title></programme>
+  <programme start="20240101000000 +0100" channel="id2"><title>Earlier</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id3"><title>Untouched</title></programme>
+</tv>`)
+
+	data, err := provider.GetEpgJSON()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+  {"id": "id1", "name": "", "programmes": [{"start": "2024-01-01T02:00:00Z", "stop": "2024-01-01T03:00:00Z", "title": "Shifted"}]},
+  {"id": "id2", "name": "", "programmes": [{"start": "2023-12-31T23:30:00+01:00", "title": "Earlier"}]},
+  {"id": "id3", "name": "", "programmes": [{"start": "2024-01-01T00:00:00Z", "stop": "2024-01-01T01:00:00Z", "title": "Untouched"}]}
+]`, string(data))
+	assert.Contains(t, provider.GetEpgXML(), `start="20240101020000 +0000" stop="20240101030000 +0000" channel="id1"`)
+	assert.Contains(t, provider.LastWarnings(), Warning{Kind: "unparseable-timestamp", Message: `unparseable programme timestamp "tomorrow"`, Line: 7})
+
+	provider = newTestProvider(t, &Config{
+		OutputIDCase: "lower",
+		TimeShift:    map[string]float64{"CNN.us": 1},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="CNN.us",CNN
+http://example.com/cnn`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="CNN.us"></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="CNN.us"><title>Shifted</title></programme>
+</tv>`)
+	assert.Contains(t, provider.GetEpgXML(), `start="20240101010000 +0000" stop="20240101020000 +0000" channel="cnn.us"`)
+}
+
+func TestProviderMatchByName(t *testing.T) {
+	const m3u = `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-name="BBC One HD",BBC One
+http://example.com/bbc
+#EXTINF:-1,Sky News
+http://example.com/sky
+#EXTINF:-1 tvg-name="Unknown",Unknown
+http://example.com/unknown`
+	const epg = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <channel id="bbc.uk"><display-name>BBC 1</display-name><display-name>bbc-one hd</display-name></channel>
+  <channel id="sky.uk"><display-name>SKY NEWS!</display-name></channel>
+  <channel id="other.uk"><display-name>Other</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>One</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="bbc.uk"><title>Breakfast</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="sky.uk"><title>Headlines</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="other.uk"><title>Other</title></programme>
+</tv>`
+
+	provider := newTestProvider(t, &Config{MatchByName: true}, m3u, epg)
+	epgXML := provider.GetEpgXML()
+	assert.Contains(t, epgXML, `<channel id="bbc.uk">`)
+	assert.Contains(t, epgXML, "<title>Breakfast</title>")
+	assert.Contains(t, epgXML, `<channel id="sky.uk">`)
+	assert.Contains(t, epgXML, "<title>Headlines</title>")
+	assert.Contains(t, epgXML, "<title>One</title>")
+	assert.NotContains(t, epgXML, "other.uk")
+
+	provider = newTestProvider(t, &Config{}, m3u, epg)
+	epgXML = provider.GetEpgXML()
+	assert.Contains(t, epgXML, "<title>One</title>")
+	assert.NotContains(t, epgXML, "bbc.uk")
+	assert.NotContains(t, epgXML, "sky.uk")
+}
+
+func TestProviderDuplicateProgrammes(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title><desc>First</desc></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title><desc>Repeat</desc></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>Other</title></programme>
+  <programme start="20240101010000 +0000" stop="20240101020000 +0000" channel="id1"><title>News</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`)
+
+	data, err := provider.GetEpgJSON()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+  {
+    "id": "id1",
+    "name": "Channel 1",
+    "programmes": [
+      {"start": "2024-01-01T00:00:00Z", "stop": "2024-01-01T01:00:00Z", "title": "News", "desc": "First"},
+      {"start": "2024-01-01T00:00:00Z", "stop": "2024-01-01T01:00:00Z", "title": "Other"},
+      {"start": "2024-01-01T01:00:00Z", "stop": "2024-01-01T02:00:00Z", "title": "News"}
+    ]
+  }
+]`, string(data))
+}
+
+func TestProviderEPGMaxDays(t *testing.T) {
+	provider := newTestProvider(t, &Config{EPGMaxDays: 2}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>Past</title></programme>
+  <programme start="20240101110000 +0000" stop="20240101130000 +0000" channel="id1"><title>Current</title></programme>
+  <programme start="20240102120000 +0000" stop="20240102130000 +0000" channel="id1"><title>Tomorrow</title></programme>
+  <programme start="20240103120000 +0000" channel="id1"><title>Last</title></programme>
+  <programme start="20240103120001 +0000" stop="20240103130000 +0000" channel="id1"><title>Far</title></programme>
+</tv>`)
+	provider.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	require.NoError(t, provider.Refresh())
+
+	epg := provider.GetEpgXML()
+	assert.NotContains(t, epg, "Past")
+	assert.Contains(t, epg, "Current")
+	assert.Contains(t, epg, "Tomorrow")
+	assert.Contains(t, epg, "Last")
+	assert.NotContains(t, epg, "Far")
+
+	provider.config.EPGMaxDays = 0
+	require.NoError(t, provider.Refresh())
+	assert.Contains(t, provider.GetEpgXML(), "Past")
+	assert.Contains(t, provider.GetEpgXML(), "Far")
+}
+
+func TestProviderDedupKey(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1 Backup
+http://example.com/channel1b
+#EXTINF:-1 tvg-id="id1" group-title="Sports",Channel 1
+http://example.com/channel1s
+#EXTINF:-1 tvg-id="id2" group-title="News",Channel 2
+http://example.com/channel2`
+
+	provider := newTestProvider(t, &Config{DedupKey: "{tvg-id}|{group-title}"}, m3u, emptyEpg)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id1" group-title="Sports",Channel 1
+http://example.com/channel1s
+#EXTINF:-1 tvg-id="id2" group-title="News",Channel 2
+http://example.com/channel2
+`, provider.GetM3u())
+	assert.Equal(t, []string{
+		"http://example.com/channel1",
+		"http://example.com/channel1b",
+	}, provider.GetChannelURLs(0))
+}
+
+func TestProviderSortByRank(t *testing.T) {
+	rankFile, err := createTempFile("tvg-id,score\nid3,90\nid1,10.5\nid4,50\n", "test_rank_*.csv")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(rankFile.Name()) })
+
+	provider := newTestProvider(t, &Config{SortBy: "rank", RankFile: rankFile.Name()}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3",Channel 3
+http://example.com/channel3
+#EXTINF:-1 tvg-id="id4",Channel 4
+http://example.com/channel4
+#EXTINF:-1 tvg-id="id5",Channel 5
+http://example.com/channel5`, emptyEpg)
+
+	var names []string
+	for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+		names = append(names, provider.GetTrack(i).Name)
+	}
+	assert.Equal(t, []string{"Channel 3", "Channel 4", "Channel 1", "Channel 2", "Channel 5"}, names)
+}
+
+func TestProviderSortBy(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-chno="10" group-title="Sports",bravo
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-chno="2" group-title="News",Alpha
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-chno="x",charlie
+http://example.com/channel3
+#EXTINF:-1 tvg-id="id4" group-title="news",Delta
+http://example.com/channel4
+#EXTINF:-1 tvg-id="id5" tvg-chno="1" group-title="Sports",echo
+http://example.com/channel5`
+
+	tests := []struct {
+		sortBy   string
+		expected []string
+	}{
+		{"priority", []string{"bravo", "Alpha", "charlie", "Delta", "echo"}},
+		{"name", []string{"Alpha", "bravo", "charlie", "Delta", "echo"}},
+		{"chno", []string{"echo", "Alpha", "bravo", "charlie", "Delta"}},
+		{"group-then-name", []string{"Alpha", "Delta", "bravo", "echo", "charlie"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sortBy, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{SortBy: tt.sortBy}, m3u, emptyEpg)
+
+			var names []string
+			for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+				names = append(names, provider.GetTrack(i).Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestProviderHTTPTransport(t *testing.T) {
+	provider, err := NewProvider(&Config{
+		HTTP2:              true,
+		HTTPMaxIdleConns:   7,
+		HTTPReadBufferSize: 1 << 20,
+		HTTPTimeout:        time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, provider.client.Timeout)
+
+	transport, ok := provider.client.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, 7, transport.MaxIdleConns)
+	assert.Equal(t, 1<<20, transport.ReadBufferSize)
+
+	provider, err = NewProvider(&Config{})
+	require.NoError(t, err)
+	transport = provider.client.Transport.(*http.Transport)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConns, transport.MaxIdleConns)
+}
+
+func TestProviderEpgParts(t *testing.T) {
+	var m3u, epg strings.Builder
+	m3u.WriteString("#EXTM3U\n")
+	epg.WriteString(`<?xml version="1.0" encoding="UTF-8"?><tv generator-info-name="test">`)
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&m3u, "#EXTINF:-1 tvg-id=\"id%d\",Channel %d\nhttp://example.com/channel%d\n", i, i, i)
+		fmt.Fprintf(&epg, `<channel id="id%d"><display-name>Channel %d</display-name></channel>`, i, i)
+		fmt.Fprintf(&epg, `<programme start="20240101000000 +0000" channel="id%d"><title>Show %d</title></programme>`, i, i)
+		fmt.Fprintf(&epg, `<programme start="20240101010000 +0000" channel="id%d"><title>Late %d</title></programme>`, i, i)
+	}
+	epg.WriteString("</tv>")
+
+	provider := newTestProvider(t, &Config{EPGSplitChannels: 2}, m3u.String(), epg.String())
+	assert.Equal(t, 3, provider.EPGPartCount())
+
+	channels := map[string]bool{}
+	programmes := 0
+	for n := 0; n < provider.EPGPartCount(); n++ {
+		data := provider.GetEpgPart(n)
+		require.NotNil(t, data)
+
+		var part xmltv.TV
+		require.NoError(t, xml.Unmarshal(data, &part), "part %d", n)
+		assert.Equal(t, "test", part.GeneratorInfoName)
+		assert.LessOrEqual(t, len(part.Channels), 2)
+		for _, channel := range part.Channels {
+			channels[channel.ID] = true
+		}
+		for _, programme := range part.Programmes {
+			assert.Contains(t, channels, programme.Channel)
+			programmes++
+		}
+	}
+	assert.Len(t, channels, 5)
+	assert.Equal(t, 10, programmes)
+	assert.Nil(t, provider.GetEpgPart(3))
+
+	whole := newTestProvider(t, &Config{}, m3u.String(), epg.String())
+	assert.Equal(t, 1, whole.EPGPartCount())
+	assert.Equal(t, whole.GetEpgXML(), string(whole.GetEpgPart(0)))
+}
+
+func TestProviderPreviewDiff(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		Filters: []*Filter{{Type: "group", Value: "News"}},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",News 1
+http://example.com/news1
+#EXTINF:-1 tvg-id="id2" group-title="News",News 2
+http://example.com/news2
+#EXTINF:-1 tvg-id="id3" group-title="Sports",Sports 1
+http://example.com/sports1
+#EXTINF:-1 tvg-id="id4" group-title="Sports News",Sports News
+http://example.com/sportsnews`, emptyEpg)
+	before := provider.GetM3u()
+
+	candidate := &Config{Filters: []*Filter{{Type: "group", Value: "^Sports"}, {Type: "id", Value: "^id1$"}}}
+	require.NoError(t, candidate.compileFilterRegexps())
+
+	added, removed, err := provider.PreviewDiff(candidate)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Sports 1"}, added)
+	assert.Equal(t, []string{"News 2"}, removed)
+	assert.Equal(t, before, provider.GetM3u())
+
+	_, _, err = (&Provider{}).PreviewDiff(candidate)
+	assert.Error(t, err)
+}
+
+func TestProviderPreviewDiffBuildsCandidatePlaylist(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",101. News 1
+http://example.com/news1
+#EXTINF:-1 tvg-id="id2" group-title="Radio",Radio 1
+http://example.com/radio1`, emptyEpg)
+
+	// The candidate's filters are compiled and its preparation and radio
+	// split applied.
+	candidate := &Config{
+		Filters:            []*Filter{{Type: "group", Value: "News|Radio"}},
+		StripLeadingNumber: true,
+		SplitRadio:         true,
+		RadioGroups:        []string{"Radio"},
+	}
+	added, removed, err := provider.PreviewDiff(candidate)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"News 1"}, added)
+	assert.Equal(t, []string{"101. News 1", "Radio 1"}, removed)
+
+	// The source is left as parsed for the next preview.
+	added, removed, err = provider.PreviewDiff(&Config{})
+	require.NoError(t, err)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+
+	_, _, err = provider.PreviewDiff(&Config{Filters: []*Filter{{Type: "name", Value: "("}}})
+	assert.Error(t, err)
+}
+
+func TestProviderPerChannelTvgURL(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3",Channel 3
+http://example.com/channel3
+#EXTINF:-1 tvg-id="none",No Guide
+http://example.com/none`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <channel id="id2"><display-name>Channel 2</display-name></channel>
+  <channel id="id3"><display-name>Channel 3</display-name></channel>
+</tv>`
+
+	provider := newTestProvider(t, &Config{
+		ServerAddress:        "localhost:6078",
+		EPGSplitChannels:     2,
+		EmitPerChannelTvgURL: true,
+	}, m3u, epg)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-url="http://localhost:6078/epg/0.xml",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-url="http://localhost:6078/epg/0.xml",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-url="http://localhost:6078/epg/1.xml",Channel 3
+http://example.com/channel3
+#EXTINF:-1 tvg-id="none",No Guide
+http://example.com/none
+`, provider.GetM3u())
+	assert.Contains(t, string(provider.GetEpgPart(1)), `<channel id="id3">`)
+
+	provider = newTestProvider(t, &Config{
+		ServerAddress:        "localhost:6078",
+		EmitPerChannelTvgURL: true,
+	}, m3u, epg)
+	assert.Contains(t, provider.GetM3u(), `#EXTINF:-1 tvg-id="id3" tvg-url="http://localhost:6078/epg.xml",Channel 3`)
+}
+
+func TestProviderDuplicateEPGChannels(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <channel id="id1"><display-name>Channel One</display-name><icon src="http://example.com/1.png"/></channel>
+</tv>`
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{
+			mode:     "first",
+			expected: `<channel id="id1"><display-name>Channel 1</display-name></channel>`,
+		},
+		{
+			mode:     "merge",
+			expected: `<channel id="id1"><display-name>Channel 1</display-name><display-name>Channel One</display-name><icon src="http://example.com/1.png"></icon></channel>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{EPGDuplicateChannels: tt.mode}, m3u, epg)
+			assert.Equal(t, 1, strings.Count(provider.GetEpgXML(), "<channel "))
+			assert.Contains(t, provider.GetEpgXML(), tt.expected)
+		})
+	}
+}
+
+func TestProviderResolutionDedup(t *testing.T) {
+	for _, m3u := range []string{
+		`#EXTM3U
+#EXTINF:-1 tvg-id="cnn",CNN 720p
+http://example.com/cnn720
+#EXTINF:-1 tvg-id="cnn",CNN 1080p
+http://example.com/cnn1080`,
+		`#EXTM3U
+#EXTINF:-1 tvg-id="cnn",CNN 1080p
+http://example.com/cnn1080
+#EXTINF:-1 tvg-id="cnn",CNN 720p
+http://example.com/cnn720`,
+	} {
+		provider := newTestProvider(t, &Config{}, m3u, emptyEpg)
+		assert.Equal(t, "CNN 1080p", provider.GetTrack(0).Name)
+		assert.Equal(t, []string{"http://example.com/cnn1080", "http://example.com/cnn720"}, provider.GetChannelURLs(0))
+		assert.True(t, provider.GetTrack(1).IsEmpty())
+	}
+
+	provider := newTestProvider(t, &Config{
+		Filters: []*Filter{{Type: "resolution", Value: "^(1080|2160)$"}},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="a",A 720p
+http://example.com/a
+#EXTINF:-1 tvg-id="b",B 2160p
+http://example.com/b
+#EXTINF:-1 tvg-id="c",C
+http://example.com/c`, emptyEpg)
+	assert.Equal(t, "B 2160p", provider.GetTrack(0).Name)
+	assert.True(t, provider.GetTrack(1).IsEmpty())
+}
+
+func TestProviderRelativeURLs(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		UseFFMPEG:     true,
+		ServerAddress: "localhost:6078",
+		RelativeURLs:  true,
+		Lineups:       []*Lineup{{Name: "all"}},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`, emptyEpg)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+/channel/0
+#EXTINF:-1 tvg-id="id2",Channel 2
+/channel/1
+`, provider.GetM3u())
+
+	lineup, ok := provider.GetM3uForLineup("all")
+	require.True(t, ok)
+	assert.Contains(t, lineup, "\n/lineup/all/channel/1\n")
+}
+
+func TestProviderEPGLanguages(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1">
+    <title lang="fr">Les Nouvelles</title>
+    <title lang="en">The News</title>
+  </programme>
+  <programme start="20240101010000 +0000" stop="20240101020000 +0000" channel="id1">
+    <title lang="en">The Weather</title>
+    <title lang="de">Das Wetter</title>
+  </programme>
+</tv>`
+
+	provider := newTestProvider(t, &Config{EPGLanguages: []string{"fr", "en"}}, m3u, epg)
+	epgXML := provider.GetEpgXML()
+	assert.Contains(t, epgXML, `<title lang="fr">Les Nouvelles</title>`)
+	assert.NotContains(t, epgXML, "The News")
+	assert.Contains(t, epgXML, `<title lang="en">The Weather</title>`)
+	assert.NotContains(t, epgXML, "Das Wetter")
+}
+
+func TestProviderDefaultDesc(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1">
+    <title lang="en">The News</title>
+    <desc lang="en">Today's headlines.</desc>
+  </programme>
+  <programme start="20240101010000 +0000" stop="20240101020000 +0000" channel="id1">
+    <title lang="en">The Weather</title>
+    <desc lang="en">  </desc>
+  </programme>
+  <programme start="20240101020000 +0000" stop="20240101030000 +0000" channel="id1">
+    <title lang="en">Sports</title>
+  </programme>
+</tv>`
+
+	provider := newTestProvider(t, &Config{}, m3u, epg)
+	assert.NotContains(t, provider.GetEpgXML(), "More about")
+
+	provider = newTestProvider(t, &Config{DefaultDesc: "More about {title}"}, m3u, epg)
+	epgXML := provider.GetEpgXML()
+	assert.Contains(t, epgXML, `<desc lang="en">Today&#39;s headlines.</desc>`)
+	assert.Contains(t, epgXML, `<desc lang="en">More about The Weather</desc>`)
+	assert.Contains(t, epgXML, `<desc lang="en">More about Sports</desc>`)
+}
+
+func TestProviderInferProgrammeStop(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <channel id="id2"><display-name>Channel 2</display-name></channel>
+  <programme start="20240101010000 +0000" stop="20240101020000 +0000" channel="id1"><title>Second</title></programme>
+  <programme start="20240101000000 +0000" channel="id1"><title>First</title></programme>
+  <programme start="20240101003000 +0000" channel="id2"><title>Other</title></programme>
+  <programme start="20240101020000 +0000" channel="id1"><title>Last</title></programme>
+</tv>`
+
+	provider := newTestProvider(t, &Config{}, m3u, epg)
+	assert.Contains(t, provider.GetEpgXML(), `<programme start="20240101000000 +0000" channel="id1">`)
+
+	provider = newTestProvider(t, &Config{InferProgrammeStop: true}, m3u, epg)
+	epgXML := provider.GetEpgXML()
+	assert.Contains(t, epgXML, `<programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>First</title>`)
+	assert.NotContains(t, epgXML, "Other")
+	assert.NotContains(t, epgXML, "Last")
+	assert.Equal(t, 2, strings.Count(epgXML, "<programme "))
+}
+
+func TestProviderLastProfile(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`
+
+	provider := newTestProvider(t, &Config{}, m3u, epg)
+	assert.Nil(t, provider.LastProfile())
+
+	provider = newTestProvider(t, &Config{Profile: true}, m3u, epg)
+	profile := provider.LastProfile()
+	require.NotNil(t, profile)
+
+	var names []string
+	for _, phase := range profile.Phases {
+		names = append(names, phase.Name)
+		assert.Greater(t, phase.Duration, time.Duration(0), phase.Name)
+	}
+	assert.Equal(t, []string{"m3u", "epg", "finish", "publish"}, names)
+	assert.Greater(t, profile.Duration, time.Duration(0))
+	assert.Equal(t, 1, profile.TrackCount)
+	assert.Equal(t, 1, profile.ProgrammeCount)
+	assert.Equal(t, int64(len(m3u)), profile.M3uBytes)
+	assert.Equal(t, int64(len(epg)), profile.EPGBytes)
+}
+
+func TestProviderAnyFilter(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="Movies",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="Movies" tvg-country="[VIP] UK",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" group-title="Sports",Channel 3 [VIP]
+http://example.com/channel3`
+
+	provider := newTestProvider(t, &Config{
+		Filters: []*Filter{{Type: "any", Value: `\[VIP\]`}},
+	}, m3u, emptyEpg)
+
+	var names []string
+	for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+		names = append(names, provider.GetTrack(i).Name)
+	}
+	assert.Equal(t, []string{"Channel 2", "Channel 3 [VIP]"}, names)
+	assert.Equal(t, `Channel 2 id2 Movies [VIP] UK`, allTagValues(provider.GetTrack(0)))
+}
+
+func TestProviderSplitRadio(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" radio="true",Radio 1
+http://example.com/radio1
+#EXTINF:-1 tvg-id="id3" group-title="Music Radio",Radio 2
+http://example.com/radio2`
+
+	provider := newTestProvider(t, &Config{}, m3u, emptyEpg)
+	assert.Contains(t, provider.GetM3u(), "Radio 1")
+	assert.Empty(t, provider.GetRadioM3u())
+
+	provider = newTestProvider(t, &Config{
+		SplitRadio:  true,
+		RadioGroups: []string{"Music Radio"},
+	}, m3u, emptyEpg)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+`, provider.GetM3u())
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id2" radio="true",Radio 1
+http://example.com/radio1
+#EXTINF:-1 tvg-id="id3" group-title="Music Radio",Radio 2
+http://example.com/radio2
+`, provider.GetRadioM3u())
+	assert.Equal(t, "Radio 2", provider.GetRadioTrack(1).Name)
+	assert.True(t, provider.GetTrack(1).IsEmpty())
+}
+
+func TestProviderEPGRetry(t *testing.T) {
+	backoff := httpRetryBackoff
+	httpRetryBackoff = time.Millisecond
+	t.Cleanup(func() { httpRetryBackoff = backoff })
+
+	m3uFile, err := createTempFile(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, "test_m3u_*.m3u")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(m3uFile.Name()) })
+
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>First</title></programme>
+  <programme start="20240101010000 +0000" stop="20240101020000 +0000" channel="id1"><title>Second</title></programme>
+</tv>`
+
+	// The first response is cut short mid-stream, as a dropped connection
+	// would leave it.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", strconv.Itoa(len(epg)))
+		if requests == 1 {
+			w.Write([]byte(epg[:len(epg)/2]))
+			return
+		}
+		w.Write([]byte(epg))
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		maxRetries int
+		wantErr    bool
+	}{
+		{maxRetries: 0, wantErr: true},
+		{maxRetries: 1, wantErr: false},
+	} {
+		requests = 0
+		provider, err := NewProvider(&Config{
+			IPTVUrl:    m3uFile.Name(),
+			EPGUrl:     server.URL,
+			MaxRetries: tt.maxRetries,
+		})
+		require.NoError(t, err)
+
+		err = provider.Refresh()
+		if tt.wantErr {
+			assert.Error(t, err)
+			assert.Empty(t, provider.GetEpgXML())
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, 2, requests)
+		assert.Equal(t, 2, strings.Count(provider.GetEpgXML(), "<programme "))
+	}
+}
+
+func TestProviderEPGRetryOnlyDecodeErrors(t *testing.T) {
+	m3uFile, err := createTempFile(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, "test_m3u_*.m3u")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(m3uFile.Name()) })
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	for _, epgURL := range []string{server.URL, filepath.Join(t.TempDir(), "missing.xml")} {
+		requests = 0
+		provider, err := NewProvider(&Config{
+			IPTVUrl:     m3uFile.Name(),
+			EPGUrl:      epgURL,
+			MaxRetries:  2,
+			HTTPRetries: 2,
+		})
+		require.NoError(t, err)
+
+		assert.Error(t, provider.Refresh())
+		if epgURL == server.URL {
+			assert.Equal(t, 1, requests)
+		}
+	}
+}
+
+func TestProviderDefaultQualityRank(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="cnn",CNN HD
+http://example.com/cnnhd
+#EXTINF:-1 tvg-id="cnn",CNN
+http://example.com/cnn
+#EXTINF:-1 tvg-id="bbc",BBC
+http://example.com/bbc
+#EXTINF:-1 tvg-id="bbc",BBC SD
+http://example.com/bbcsd`
+
+	tests := []struct {
+		rank     string
+		expected []string
+	}{
+		{rank: "", expected: []string{"BBC", "CNN HD"}},
+		{rank: "sd", expected: []string{"BBC", "CNN HD"}},
+		{rank: "lowest", expected: []string{"BBC SD", "CNN HD"}},
+		{rank: "highest", expected: []string{"BBC", "CNN"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rank, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{DefaultQualityRank: tt.rank}, m3u, emptyEpg)
+
+			var names []string
+			for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+				names = append(names, provider.GetTrack(i).Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestProviderPreferPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		titles   []string
+		expected string
+	}{
+		{name: "Default is case-insensitive", titles: []string{"CNN", "CNN hd"}, expected: "CNN hd"},
+		{name: "Default keeps HD over SD", titles: []string{"CNN HD", "CNN"}, expected: "CNN HD"},
+		{name: "FHD over HD", patterns: []string{"FHD", "HD"}, titles: []string{"CNN FHD", "CNN HD"}, expected: "CNN FHD"},
+		{name: "FHD over later HD and SD", patterns: []string{"FHD", "HD"}, titles: []string{"CNN", "CNN FHD", "CNN HD", "CNN SD"}, expected: "CNN FHD"},
+		{name: "HD over SD", patterns: []string{"FHD", "HD"}, titles: []string{"CNN SD", "CNN Hd", "CNN"}, expected: "CNN Hd"},
+		{name: "Later FHD replaces HD", patterns: []string{"FHD", "HD"}, titles: []string{"CNN HD", "CNN fhd"}, expected: "CNN fhd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m3u := "#EXTM3U\n"
+			for i, title := range tt.titles {
+				m3u += fmt.Sprintf("#EXTINF:-1 tvg-id=\"cnn\",%s\nhttp://example.com/cnn%d\n", title, i)
+			}
+
+			provider := newTestProvider(t, &Config{PreferPatterns: tt.patterns}, m3u, emptyEpg)
+			assert.Equal(t, tt.expected, provider.GetTrack(0).Name)
+			assert.True(t, provider.GetTrack(1).IsEmpty())
+		})
+	}
+}
+
+func TestProviderSynthesizeIDs(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 group-title="News",Channel 2
+http://example.com/channel2
+#EXTINF:-1 group-title="Sports",Channel 2
+http://example.com/channel2b`
+
+	provider := newTestProvider(t, &Config{}, m3u, emptyEpg)
+	assert.Empty(t, provider.GetTrack(0).Tags["tvg-id"])
+
+	provider = newTestProvider(t, &Config{SynthesizeIDs: true}, m3u, emptyEpg)
+	assert.Equal(t, "id1", provider.GetTrack(0).Tags["tvg-id"])
+	id := provider.GetTrack(1).Tags["tvg-id"]
+	assert.Regexp(t, `^proxytv-[0-9a-f]{12}$`, id)
+	assert.Contains(t, provider.GetM3u(), fmt.Sprintf(`tvg-id="%s"`, id))
+
+	require.NoError(t, provider.Refresh())
+	assert.Equal(t, id, provider.GetTrack(1).Tags["tvg-id"])
+
+	provider = newTestProvider(t, &Config{SynthesizeIDs: true}, m3u, emptyEpg)
+	assert.Equal(t, id, provider.GetTrack(1).Tags["tvg-id"])
+}
+
+func TestProviderStripLeadingNumber(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="cnn",101. CNN
+http://example.com/cnn
+#EXTINF:-1 tvg-id="bbc" tvg-chno="7",001 | BBC One
+http://example.com/bbc
+#EXTINF:-1 tvg-id="4k",4K Movies
+http://example.com/4k`
+
+	provider := newTestProvider(t, &Config{StripLeadingNumber: true}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="4k",4K Movies
+http://example.com/4k
+#EXTINF:-1 tvg-id="bbc" tvg-chno="7",BBC One
+http://example.com/bbc
+#EXTINF:-1 tvg-id="cnn" tvg-chno="101",CNN
+http://example.com/cnn
+`, provider.GetM3u())
+	assert.Equal(t, "CNN", provider.GetTrack(2).Name)
+	assert.Equal(t, "101", provider.GetTrack(2).Tags["tvg-chno"])
+}
+
+func TestProviderEPGSourceIDs(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <channel id="ID1"><display-name>Channel 1 Upper</display-name></channel>
+  <channel id="id2"><display-name>Channel 2</display-name></channel>
+  <channel id="id2"><display-name>Channel 2 Again</display-name></channel>
+</tv>`
+
+	provider := newTestProvider(t, &Config{}, m3u, epg)
+	assert.Equal(t, []string{"id1", "ID1", "id2"}, provider.EPGSourceIDs())
+	assert.Equal(t, 1, strings.Count(provider.GetEpgXML(), "<channel "))
+}
+
+func TestProviderKeepAttributes(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-rec="3" tvg-id="id1" group-title="News" tvg-logo="http://example.com/1.png" user-token="secret",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" catchup="default",Channel 2
+http://example.com/channel2`
+
+	provider := newTestProvider(t, &Config{
+		KeepAttributes: []string{"tvg-id", "tvg-name", "tvg-logo", "group-title"},
+	}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-logo="http://example.com/1.png" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2
+`, provider.GetM3u())
+	assert.Equal(t, "secret", provider.GetTrack(0).Tags["user-token"])
+}
+
+func TestProviderEPGWindows(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="movies" group-title="Movies",Movies
+http://example.com/movies
+#EXTINF:-1 tvg-id="news" group-title="News",News
+http://example.com/news
+#EXTINF:-1 tvg-id="other" group-title="Other",Other
+http://example.com/other`
+
+	var epg strings.Builder
+	epg.WriteString(`<?xml version="1.0" encoding="UTF-8"?><tv>`)
+	now := time.Now()
+	for _, id := range []string{"movies", "news", "other"} {
+		fmt.Fprintf(&epg, `<channel id="%s"><display-name>%s</display-name></channel>`, id, id)
+		for _, offset := range []time.Duration{time.Hour, 48 * time.Hour, 200 * time.Hour} {
+			fmt.Fprintf(&epg, `<programme start="%s" channel="%s"><title>%s</title></programme>`,
+				now.Add(offset).Format("20060102150405 -0700"), id, offset)
+		}
+	}
+	epg.WriteString(`</tv>`)
+
+	provider := newTestProvider(t, &Config{
+		EPGWindows: []*EPGWindow{
+			{Group: "Movies", Window: 7 * 24 * time.Hour},
+			{Group: "News", Window: 24 * time.Hour},
+		},
+	}, m3u, epg.String())
+
+	counts := map[string]int{}
+	for _, programme := range provider.epg.Programmes {
+		counts[programme.Channel]++
+	}
+	assert.Equal(t, map[string]int{"movies": 2, "news": 1, "other": 3}, counts)
+}
+
+func TestProviderRefreshRejectsNonM3U(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, emptyEpg)
+	m3u := provider.GetM3u()
+
+	require.NoError(t, os.WriteFile(provider.iptvURLs[0], []byte("<!DOCTYPE html>\n<html><body>Service Unavailable</body></html>"), 0644))
+	err := provider.Refresh()
+	assert.ErrorIs(t, err, errMalformedM3U)
+	assert.Contains(t, err.Error(), "<!DOCTYPE html>")
+	assert.Equal(t, m3u, provider.GetM3u())
+}
+
+func TestProviderStableTieBreak(t *testing.T) {
+	sources := []string{`#EXTM3U
+#EXTINF:-1 tvg-id="b" group-title="News",Bravo
+http://example.com/b
+#EXTINF:-1 tvg-id="a" group-title="News",Alpha
+http://example.com/a
+#EXTINF:-1 tvg-id="c" group-title="Sports",Charlie
+http://example.com/c`, `#EXTM3U
+#EXTINF:-1 tvg-id="c" group-title="Sports",Charlie
+http://example.com/c
+#EXTINF:-1 tvg-id="a" group-title="News",Alpha
+http://example.com/a
+#EXTINF:-1 tvg-id="b" group-title="News",Bravo
+http://example.com/b`}
+
+	var outputs []string
+	for _, m3u := range sources {
+		provider := newTestProvider(t, &Config{
+			Filters: []*Filter{{Type: "group", Value: "News"}},
+		}, m3u, emptyEpg)
+		outputs = append(outputs, provider.GetM3u())
+
+		provider = newTestProvider(t, &Config{StableTieBreak: "name"}, m3u, emptyEpg)
+		var names []string
+		for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+			names = append(names, provider.GetTrack(i).Name)
+		}
+		assert.Equal(t, []string{"Alpha", "Bravo", "Charlie"}, names)
+	}
+
+	assert.Equal(t, outputs[0], outputs[1])
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="a" group-title="News",Alpha
+http://example.com/a
+#EXTINF:-1 tvg-id="b" group-title="News",Bravo
+http://example.com/b
+`, outputs[0])
+
+	// Tracks sharing a tvg-id and name fall back to their group and URL.
+	sources = []string{`#EXTM3U
+#EXTINF:-1 tvg-id="a" tvg-chno="2" group-title="UK",Alpha
+http://example.com/a2
+#EXTINF:-1 tvg-id="a" tvg-chno="3" group-title="US",Alpha
+http://example.com/a3
+#EXTINF:-1 tvg-id="a" tvg-chno="1" group-title="UK",Alpha
+http://example.com/a1`, `#EXTM3U
+#EXTINF:-1 tvg-id="a" tvg-chno="1" group-title="UK",Alpha
+http://example.com/a1
+#EXTINF:-1 tvg-id="a" tvg-chno="3" group-title="US",Alpha
+http://example.com/a3
+#EXTINF:-1 tvg-id="a" tvg-chno="2" group-title="UK",Alpha
+http://example.com/a2`}
+	outputs = nil
+	for _, m3u := range sources {
+		provider := newTestProvider(t, &Config{DedupKey: "{tvg-chno}"}, m3u, emptyEpg)
+		outputs = append(outputs, provider.GetM3u())
+	}
+	assert.Equal(t, outputs[0], outputs[1])
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="a" tvg-chno="1" group-title="UK",Alpha
+http://example.com/a1
+#EXTINF:-1 tvg-id="a" tvg-chno="2" group-title="UK",Alpha
+http://example.com/a2
+#EXTINF:-1 tvg-id="a" tvg-chno="3" group-title="US",Alpha
+http://example.com/a3
+`, outputs[0])
+}
+
+func TestProviderGetM3uRaw(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		UseFFMPEG:     true,
+		ServerAddress: "localhost:6078",
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://localhost:6078/channel/0
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://localhost:6078/channel/1
+`, provider.GetM3u())
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2
+`, provider.GetM3uRaw())
+}
+
+func TestNewProviderInvalidFilters(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr string
+	}{
+		{
+			name:    "Invalid regular expression",
+			config:  &Config{Filters: []*Filter{{Type: "group", Value: "News"}, {Type: "name", Value: "news["}}},
+			wantErr: `filter 1: invalid regular expression "news["`,
+		},
+		{
+			name:    "Missing type",
+			config:  &Config{Filters: []*Filter{{Value: "News"}}},
+			wantErr: `filter 0: invalid type ""`,
+		},
+		{
+			name:    "Malformed type",
+			config:  &Config{Filters: []*Filter{{Type: "group title", Value: "News"}}},
+			wantErr: `filter 0: invalid type "group title"`,
+		},
+		{
+			name: "Invalid lineup filter",
+			config: &Config{Lineups: []*Lineup{
+				{Name: "news", Filters: []*Filter{{Type: "group", Value: "(News"}}},
+			}},
+			wantErr: `lineup "news": filter 0: invalid regular expression "(News"`,
+		},
+		{
+			name: "Invalid condition",
+			config: &Config{Filters: []*Filter{{Conditions: []*Filter{
+				{Type: "group", Value: "Sports"},
+				{Type: "name", Value: "4K["},
+			}}}},
+			wantErr: `filter 0: condition 1: invalid regular expression "4K["`,
+		},
+		{
+			name: "Conditions with a pattern",
+			config: &Config{Filters: []*Filter{{Type: "group", Value: "Sports", Conditions: []*Filter{
+				{Type: "name", Value: "4K"},
+			}}}},
+			wantErr: "filter 0: a filter with conditions cannot have a type or pattern",
+		},
+		{
+			name: "Excluded condition",
+			config: &Config{Filters: []*Filter{{Conditions: []*Filter{
+				{Type: "name", Value: "4K", Exclude: true},
+			}}}},
+			wantErr: "filter 0: condition 0: conditions cannot be excluded or nested",
+		},
+		{
+			name:    "Async EPG with EPG logos",
+			config:  &Config{AsyncEPG: true, LogoFromEPG: true},
+			wantErr: errAsyncEPGAttributes.Error(),
+		},
+		{
+			name:    "Async EPG with per-channel tvg-url",
+			config:  &Config{AsyncEPG: true, EmitPerChannelTvgURL: true, ServerAddress: "localhost:6078"},
+			wantErr: errAsyncEPGAttributes.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.IPTVUrl = server.URL
+			tt.config.EPGUrl = server.URL
+			provider, err := NewProvider(tt.config)
+			assert.Nil(t, provider)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+	assert.Zero(t, hits.Load())
+}
+
+func TestProviderRefreshHTTPErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(&Config{IPTVUrl: server.URL, EPGUrl: server.URL})
+	require.NoError(t, err)
+	require.NotPanics(t, func() { err = provider.Refresh() })
+	assert.EqualError(t, err, "invalid url response code: 500")
+
+	// A server that can't be reached fails the refresh instead of panicking.
+	server.Close()
+	require.NotPanics(t, func() { err = provider.Refresh() })
+	assert.ErrorContains(t, err, "requesting "+server.URL)
+}
+
+func TestProviderStdinSource(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	original := stdin
+	stdin = reader
+	t.Cleanup(func() { stdin = original })
+
+	go func() {
+		writer.Write([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`))
+		writer.Close()
+	}()
+
+	epgFile, err := createTempFile(emptyEpg, "test_epg_*.xml")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(epgFile.Name()) })
+
+	provider, err := NewProvider(&Config{IPTVUrl: "-", EPGUrl: filepath.ToSlash(epgFile.Name())})
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+	assert.Contains(t, provider.GetM3u(), "Channel 1")
+
+	// The exhausted stdin is not read again.
+	require.NoError(t, provider.Refresh())
+	assert.Contains(t, provider.GetM3u(), "Channel 1")
+}
+
+func TestProviderSourceAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var authorized bool
+		switch path.Dir(r.URL.Path) {
+		case "/basic":
+			user, password, ok := r.BasicAuth()
+			authorized = ok && user == "user" && password == "secret"
+		case "/bearer":
+			authorized = r.Header.Get("Authorization") == "Bearer token"
+		}
+		if !authorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if path.Ext(r.URL.Path) == ".m3u" {
+			w.Write([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`))
+		} else {
+			w.Write([]byte(emptyEpg))
+		}
+	}))
+	defer server.Close()
+	userinfoURL, err := url.Parse(server.URL + "/basic/iptv.m3u")
+	require.NoError(t, err)
+	userinfoURL.User = url.UserPassword("user", "secret")
+
+	basic := SourceAuth{Username: "user", Password: "secret"}
+	bearer := SourceAuth{Header: "Authorization: Bearer token"}
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{
+			name:    "No credentials",
+			config:  &Config{IPTVUrl: server.URL + "/basic/iptv.m3u", EPGUrl: server.URL + "/basic/epg.xml"},
+			wantErr: true,
+		},
+		{
+			name:   "Basic auth",
+			config: &Config{IPTVUrl: server.URL + "/basic/iptv.m3u", EPGUrl: server.URL + "/basic/epg.xml", IPTVAuth: basic, EPGAuth: basic},
+		},
+		{
+			name:   "Auth header",
+			config: &Config{IPTVUrl: server.URL + "/bearer/iptv.m3u", EPGUrl: server.URL + "/bearer/epg.xml", IPTVAuth: bearer, EPGAuth: bearer},
+		},
+		{
+			name:   "Credentials in the URL win over the auth header",
+			config: &Config{IPTVUrl: userinfoURL.String(), EPGUrl: server.URL + "/bearer/epg.xml", IPTVAuth: bearer, EPGAuth: bearer},
+		},
+		{
+			name: "Auth header replaces basic auth",
+			config: &Config{
+				IPTVUrl:  server.URL + "/bearer/iptv.m3u",
+				EPGUrl:   server.URL + "/bearer/epg.xml",
+				IPTVAuth: SourceAuth{Username: "user", Password: "secret", Header: "Authorization: Bearer token"},
+				EPGAuth:  bearer,
+			},
+		},
+		{
+			name:    "EPG credentials are not sent to the playlist",
+			config:  &Config{IPTVUrl: server.URL + "/bearer/iptv.m3u", EPGUrl: server.URL + "/bearer/epg.xml", EPGAuth: bearer},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewProvider(tt.config)
+			require.NoError(t, err)
+			err = provider.Refresh()
+			if tt.wantErr {
+				assert.EqualError(t, err, "invalid url response code: 401")
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, provider.GetM3u(), "Channel 1")
+		})
+	}
+
+	_, err = NewProvider(&Config{IPTVAuth: SourceAuth{Header: "Bearer token"}})
+	assert.ErrorContains(t, err, "invalid iptvAuth")
+	_, err = NewProvider(&Config{EPGAuth: SourceAuth{Header: "Bearer token"}})
+	assert.ErrorContains(t, err, "invalid epgAuth")
+}
+
+func TestProviderSourceAuthPerSource(t *testing.T) {
+	// Each host only accepts its own credentials, and the rank file host none.
+	authorizations := make(chan string, 3)
+	serve := func(expected string, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorizations <- r.Header.Get("Authorization")
+			if r.Header.Get("Authorization") != expected {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(body))
+		}))
+	}
+	iptv := serve("Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")), `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`)
+	defer iptv.Close()
+	epg := serve("Bearer token", emptyEpg)
+	defer epg.Close()
+	ranks := serve("", "id1,1\n")
+	defer ranks.Close()
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl:  iptv.URL + "/iptv.m3u",
+		EPGUrl:   epg.URL + "/epg.xml",
+		RankFile: ranks.URL + "/ranks.csv",
+		SortBy:   "rank",
+		IPTVAuth: SourceAuth{Username: "user", Password: "secret"},
+		EPGAuth:  SourceAuth{Header: "Authorization: Bearer token"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+	assert.Contains(t, provider.GetM3u(), "Channel 1")
+	assert.Len(t, authorizations, 3)
+}
+
+func TestLoadReaderRetries(t *testing.T) {
+	backoff := httpRetryBackoff
+	httpRetryBackoff = time.Millisecond
+	t.Cleanup(func() { httpRetryBackoff = backoff })
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case requests <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("#EXTM3U\n"))
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: time.Second}
+
+	reader, err := loadReader(client, server.URL, nil, 2)
+	require.NoError(t, err)
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "#EXTM3U\n", string(body))
+	assert.Equal(t, 3, requests)
+
+	requests = 0
+	_, err = loadReader(client, server.URL, nil, 1)
+	assert.EqualError(t, err, "invalid url response code: 503")
+	assert.Equal(t, 2, requests)
+
+	requests = 10
+	_, err = loadReader(client, server.URL+"/missing", nil, 2)
+	assert.EqualError(t, err, "invalid url response code: 404")
+	assert.Equal(t, 11, requests)
+}
+
+func TestProviderExactFilter(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="International News",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" group-title="News / UK",Channel 3
+http://example.com/channel3`
+
+	tests := []struct {
+		name     string
+		filter   *Filter
+		expected []string
+	}{
+		{
+			name:     "Substring",
+			filter:   &Filter{Type: "group", Value: "News"},
+			expected: []string{"Channel 1", "Channel 2", "Channel 3"},
+		},
+		{
+			name:     "Exact",
+			filter:   &Filter{Type: "group", Value: "News", Exact: true},
+			expected: []string{"Channel 1"},
+		},
+		{
+			name:     "Exact alternation",
+			filter:   &Filter{Type: "group", Value: "News|International News", Exact: true},
+			expected: []string{"Channel 1", "Channel 2"},
+		},
+		{
+			name:     "Exact segment",
+			filter:   &Filter{Type: "group", Value: "News", Exact: true, Separator: "/"},
+			expected: []string{"Channel 1", "Channel 3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{Filters: []*Filter{tt.filter}}, m3u, emptyEpg)
+
+			var names []string
+			for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+				names = append(names, provider.GetTrack(i).Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestProviderFilterStats(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		Filters: []*Filter{
+			{Type: "group", Value: "News"},
+			{Type: "group", Value: "Nwes"},
+			{Type: "name", Value: "Two", Exclude: true},
+		},
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="News One" group-title="News",News One
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="News Two" group-title="News",News Two
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="Sports One" group-title="Sports",Sports One
+http://example.com/channel3`, emptyEpg)
+
+	assert.Equal(t, map[string]int{
+		"group:News": 2,
+		"group:Nwes": 0,
+		"!name:Two":  1,
+	}, provider.FilterStats())
+	assert.Contains(t, provider.LastWarnings(), Warning{Kind: "unmatched-filter", Message: "filter group:Nwes matched no tracks"})
+	assert.Len(t, provider.LastWarnings(), 1)
+}
+
+func TestProviderPreviewRefresh(t *testing.T) {
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>News One</display-name></channel>
+  <channel id="id4"><display-name>Sports One</display-name></channel>
+  <channel id="id6"><display-name>Movies One</display-name></channel>
+</tv>`
+	var m3u atomic.Value
+	m3u.Store(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",News One
+http://example.com/channel1`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/iptv.m3u" {
+			w.Write([]byte(m3u.Load().(string)))
+		} else {
+			w.Write([]byte(epg))
+		}
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	provider, err := NewProvider(&Config{
+		IPTVUrl:      server.URL + "/iptv.m3u",
+		EPGUrl:       server.URL + "/epg.xml",
+		CacheDir:     cacheDir,
+		IPTVInterval: time.Hour,
+		EPGInterval:  2 * time.Hour,
+		Filters: []*Filter{
+			{Type: "group", Value: "News"},
+			{Type: "group", Value: "Sports"},
+			{Type: "name", Value: "Two", Exclude: true},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+	manifest := provider.Manifest()
+	cached := provider.sources.get(server.URL + "/iptv.m3u")
+	require.NotNil(t, cached)
+	path, _ := provider.cachePath(server.URL + "/iptv.m3u")
+	onDisk, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	m3u.Store(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",News One
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id1" group-title="News",News One HD
+http://example.com/channel2
+#EXTINF:-1 group-title="News",News Three
+http://example.com/channel3
+#EXTINF:-1 tvg-id="id4" group-title="Sports",Sports One
+http://example.com/channel4
+#EXTINF:-1 tvg-id="id5" tvg-name="Sports Two" group-title="Sports",Sports Two
+http://example.com/channel5
+#EXTINF:-1 tvg-id="id6" group-title="Movies",Movies One
+http://example.com/channel6
+#EXTINF:-1 group-title="Movies",Movies Two
+http://example.com/channel7`)
+
+	report, err := provider.PreviewRefresh()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"group:News":   3,
+		"group:Sports": 2,
+		"!name:Two":    1,
+	}, report.Filters)
+	assert.Equal(t, 3, report.Channels)
+	assert.Equal(t, 1, report.MissingTvgID)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Equal(t, 2, report.EPGChannels)
+	assert.InDelta(t, 2.0/3.0, report.EPGMatchRate, 0.001)
+
+	// Neither the served data nor the caches change.
+	assert.Equal(t, manifest, provider.Manifest())
+	assert.Len(t, provider.playlist.tracks, 1)
+	assert.Equal(t, cached, provider.sources.get(server.URL+"/iptv.m3u"))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, onDisk, data)
+}
+
+func TestProviderExcludeFilters(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Movies One" group-title="Movies",Movies One
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="Movies Adult" group-title="Movies",Movies Adult
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="Late Night" group-title="Adult",Late Night
+http://example.com/channel3
+#EXTINF:-1 tvg-id="id4" tvg-name="News One" group-title="News",News One
+http://example.com/channel4`
+
+	tests := []struct {
+		name     string
+		filters  []*Filter
+		expected []string
+	}{
+		{
+			name: "Exclude wins over include",
+			filters: []*Filter{
+				{Type: "group", Value: "Movies"},
+				{Type: "name", Value: "Adult", Exclude: true},
+			},
+			expected: []string{"Movies One"},
+		},
+		{
+			name: "Exclude listed after include still wins",
+			filters: []*Filter{
+				{Type: "group", Value: "Movies|News"},
+				{Type: "name", Value: "Adult", Exclude: true},
+				{Type: "name", Value: "Movies Adult"},
+			},
+			expected: []string{"Movies One", "News One"},
+		},
+		{
+			name: "Only exclude filters",
+			filters: []*Filter{
+				{Type: "group", Value: "Adult", Exclude: true},
+			},
+			expected: []string{"Movies One", "Movies Adult", "News One"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{Filters: tt.filters}, m3u, emptyEpg)
+
+			var names []string
+			for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+				names = append(names, provider.GetTrack(i).Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestProviderGroupOrder(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="Movies",Movies 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="Kids",Kids 1
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" group-title="News",News 1
+http://example.com/channel3
+#EXTINF:-1 tvg-id="id4" group-title="Movies",Movies 2
+http://example.com/channel4
+#EXTINF:-1 tvg-id="id5" group-title="Sports",Sports 1
+http://example.com/channel5
+#EXTINF:-1 tvg-id="id6" group-title="News",News 2
+http://example.com/channel6`
+
+	provider := newTestProvider(t, &Config{
+		GroupOrder: []string{"News", "Movies"},
+		Filters: []*Filter{
+			{Type: "group", Value: "Sports"},
+			{Type: "group", Value: "Movies|News|Kids"},
+		},
+	}, m3u, emptyEpg)
+
+	var names []string
+	for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+		names = append(names, provider.GetTrack(i).Name)
+	}
+	// Listed groups come first in the configured order, then the unlisted
+	// groups by filter priority.
+	assert.Equal(t, []string{"News 1", "News 2", "Movies 1", "Movies 2", "Sports 1", "Kids 1"}, names)
+
+	// A group listed twice keeps its first position, and the groups listed
+	// after it still come before the unlisted ones.
+	provider = newTestProvider(t, &Config{
+		GroupOrder: []string{"News", "News", "Movies"},
+		Filters: []*Filter{
+			{Type: "group", Value: "Sports"},
+			{Type: "group", Value: "Movies|News|Kids"},
+		},
+	}, m3u, emptyEpg)
+
+	names = nil
+	for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+		names = append(names, provider.GetTrack(i).Name)
+	}
+	assert.Equal(t, []string{"News 1", "News 2", "Movies 1", "Movies 2", "Sports 1", "Kids 1"}, names)
+}
+
+func TestProviderPreserveOrder(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="Movies",Movies 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="News",News 1
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id2" group-title="News",News 1 HD
+http://example.com/channel2hd
+#EXTINF:-1 tvg-id="id3" group-title="Sports",Sports 1
+http://example.com/channel3`
+
+	names := func(preserveOrder bool) []string {
+		provider := newTestProvider(t, &Config{
+			PreserveOrder: preserveOrder,
+			Filters: []*Filter{
+				{Type: "group", Value: "Sports"},
+				{Type: "group", Value: "News"},
+				{Type: "group", Value: "Movies"},
+			},
+		}, m3u, emptyEpg)
+
+		var names []string
+		for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+			names = append(names, provider.GetTrack(i).Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"Sports 1", "News 1 HD", "Movies 1"}, names(false))
+	// Duplicates are still resolved in favour of the preferred variant.
+	assert.Equal(t, []string{"Movies 1", "News 1 HD", "Sports 1"}, names(true))
+}
+
+func TestProviderRenumberChannels(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-chno="7" group-title="Movies",Movies 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-chno="7" group-title="News",News 1
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" group-title="Sports",Sports 1
+http://example.com/channel3`
+	filters := []*Filter{
+		{Type: "group", Value: "News"},
+		{Type: "group", Value: "Movies|Sports"},
+	}
+
+	provider := newTestProvider(t, &Config{Filters: filters}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id2" tvg-chno="7" group-title="News",News 1
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id1" tvg-chno="7" group-title="Movies",Movies 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id3" group-title="Sports",Sports 1
+http://example.com/channel3
+`, provider.GetM3u())
+
+	provider = newTestProvider(t, &Config{Filters: filters, RenumberChannels: true, StartChannel: 100}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id2" tvg-chno="100" group-title="News",News 1
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id1" tvg-chno="101" group-title="Movies",Movies 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id3" group-title="Sports" tvg-chno="102",Sports 1
+http://example.com/channel3
+`, provider.GetM3u())
+}
+
+func TestProviderNormalizeWhitespace(t *testing.T) {
+	m3u := "#EXTM3U\n" +
+		"#EXTINF:-1 tvg-id=\"id1\" tvg-name=\" Channel  1 \" group-title=\"News  \",Channel  1 \n" +
+		"http://example.com/channel1\n" +
+		"#EXTINF:-1 tvg-id=\"id2\" tvg-name=\"Channel 1\" group-title=\"News\",Channel 1\n" +
+		"http://example.com/channel2"
+	filters := []*Filter{{Type: "group", Value: "News", Exact: true}}
+
+	provider := newTestProvider(t, &Config{Filters: filters}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id2" tvg-name="Channel 1" group-title="News",Channel 1
+http://example.com/channel2
+`, provider.GetM3u())
+
+	provider = newTestProvider(t, &Config{Filters: filters, TrimWhitespace: true}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel  1" group-title="News",Channel  1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="Channel 1" group-title="News",Channel 1
+http://example.com/channel2
+`, provider.GetM3u())
+
+	// With both, the tracks share a name and are deduplicated.
+	provider = newTestProvider(t, &Config{Filters: filters, TrimWhitespace: true, CollapseSpaces: true}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel 1" group-title="News",Channel 1
+http://example.com/channel1
+`, provider.GetM3u())
+	assert.Equal(t, []string{"http://example.com/channel1", "http://example.com/channel2"}, provider.GetChannelURLs(0))
+}
+
+func TestProviderFilterConditions(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Sports 4K" group-title="Sports",Sports 4K
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="Sports HD" group-title="Sports",Sports HD
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="Movies 4K" group-title="Movies",Movies 4K
+http://example.com/channel3
+#EXTINF:-1 tvg-id="id4" tvg-name="News HD" group-title="News",News HD
+http://example.com/channel4`
+	sports4K := []*Filter{
+		{Type: "group", Value: "Sports"},
+		{Type: "name", Value: "4K"},
+	}
+
+	tests := []struct {
+		name     string
+		filters  []*Filter
+		expected []string
+	}{
+		{
+			name:     "All conditions must match",
+			filters:  []*Filter{{Conditions: sports4K}},
+			expected: []string{"Sports 4K"},
+		},
+		{
+			name:     "Rule priority",
+			filters:  []*Filter{{Type: "group", Value: "News"}, {Conditions: sports4K}},
+			expected: []string{"News HD", "Sports 4K"},
+		},
+		{
+			name:     "Excluded rule",
+			filters:  []*Filter{{Conditions: sports4K, Exclude: true}},
+			expected: []string{"Sports HD", "Movies 4K", "News HD"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{Filters: tt.filters}, m3u, emptyEpg)
+			var names []string
+			for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+				names = append(names, provider.GetTrack(i).Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+
+	provider := newTestProvider(t, &Config{Filters: []*Filter{{Conditions: []*Filter{
+		{Type: "group", Value: "Movies"},
+		{Type: "name", Value: "HD"},
+	}}}}, m3u, emptyEpg)
+	assert.Contains(t, provider.LastWarnings(), Warning{Kind: "unmatched-filter", Message: "filter group:Movies&name:HD matched no tracks"})
+}
+
+func TestProviderCatchupSource(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" catchup="default" catchup-source="http://example.com/catchup/{utc}/{duration}?token=abc&start={utc}",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" catchup="append" catchup-source="?utc={utc}&lutc=${lutc}",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3",Channel 3
+http://example.com/channel3`
+
+	provider := newTestProvider(t, &Config{}, m3u, emptyEpg)
+	assert.Equal(t, m3u+"\n", provider.GetM3u())
+
+	provider = newTestProvider(t, &Config{UseFFMPEG: true, ServerAddress: "localhost:6078"}, m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" catchup="default" catchup-source="http://localhost:6078/channel/0/catchup?p0={utc}&p1={duration}",Channel 1
+http://localhost:6078/channel/0
+#EXTINF:-1 tvg-id="id2" catchup="append" catchup-source="/catchup?p0={utc}&p1=${lutc}",Channel 2
+http://localhost:6078/channel/1
+#EXTINF:-1 tvg-id="id3",Channel 3
+http://localhost:6078/channel/2
+`, provider.GetM3u())
+
+	assert.Equal(t, "http://example.com/catchup/1700000000/3600?token=abc&start=1700000000",
+		provider.GetTrack(0).catchupURL([]string{"1700000000", "3600"}))
+	assert.Equal(t, "http://example.com/channel2?utc=1700000000&lutc=1700003600",
+		provider.GetTrack(1).catchupURL([]string{"1700000000", "1700003600"}))
+	assert.Empty(t, provider.GetTrack(2).catchupURL(nil))
+}
+
+func TestProviderLogoOverrides(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id 2",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-logo="http://example.com/own.png",Channel 3
+http://example.com/channel3
+#EXTINF:-1 tvg-name="Channel 4",Channel 4
+http://example.com/channel4`
+	config := func() *Config {
+		return &Config{
+			Logos:       map[string]string{"id1": "http://example.com/one.png", "id3": "http://example.com/three.png"},
+			LogoBaseURL: "https://logos.example.com/",
+		}
+	}
+
+	provider := newTestProvider(t, config(), m3u, emptyEpg)
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-name="Channel 4",Channel 4
+http://example.com/channel4
+#EXTINF:-1 tvg-id="id 2" tvg-logo="https://logos.example.com/id%202.png",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id1" tvg-logo="http://example.com/one.png",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id3" tvg-logo="http://example.com/own.png",Channel 3
+http://example.com/channel3
+`, provider.GetM3u())
+
+	forced := config()
+	forced.ForceLogo = true
+	provider = newTestProvider(t, forced, m3u, emptyEpg)
+	assert.Equal(t, "http://example.com/three.png", provider.GetTrack(3).Tags["tvg-logo"])
+	assert.Contains(t, provider.GetM3u(), `#EXTINF:-1 tvg-id="id3" tvg-logo="http://example.com/three.png",Channel 3`)
+	assert.Empty(t, provider.GetTrack(0).Tags["tvg-logo"])
+}
+
+func TestProviderTagFilters(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="News One" tvg-chno="101" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="Sports One" tvg-chno="205" group-title="Sports",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="News Two" group-title="News",Channel 3
+http://example.com/channel3`
+
+	tests := []struct {
+		name     string
+		filter   *Filter
+		expected []string
+	}{
+		{
+			name:     "Channel number",
+			filter:   &Filter{Type: "tvg-chno", Value: "^1[0-9]{2}$"},
+			expected: []string{"Channel 1"},
+		},
+		{
+			name:     "Id alias",
+			filter:   &Filter{Type: "id", Value: "^id2$"},
+			expected: []string{"Channel 2"},
+		},
+		{
+			name:     "Group alias",
+			filter:   &Filter{Type: "group", Value: "News"},
+			expected: []string{"Channel 1", "Channel 3"},
+		},
+		{
+			name:     "Name alias",
+			filter:   &Filter{Type: "name", Value: "Two"},
+			expected: []string{"Channel 3"},
+		},
+		{
+			name:     "Unknown tag",
+			filter:   &Filter{Type: "x-missing", Value: ".*"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{Filters: []*Filter{tt.filter}}, m3u, emptyEpg)
+
+			var names []string
+			for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+				names = append(names, provider.GetTrack(i).Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestProviderGzipEPG(t *testing.T) {
+	m3uFile, err := createTempFile(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, "test_m3u_*.m3u")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(m3uFile.Name()) })
+
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write([]byte(epg))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	gzFile, err := os.CreateTemp("", "test_epg_*.xml.gz")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(gzFile.Name()) })
+	_, err = gzFile.Write(compressed.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gzFile.Close())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/encoded.xml" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	for name, epgURL := range map[string]string{
+		"gz file":          gzFile.Name(),
+		"gz url":           server.URL + "/epg.xml.gz",
+		"Content-Encoding": server.URL + "/encoded.xml",
+	} {
+		t.Run(name, func(t *testing.T) {
+			provider, err := NewProvider(&Config{IPTVUrl: m3uFile.Name(), EPGUrl: epgURL})
+			require.NoError(t, err)
+			require.NoError(t, provider.Refresh())
+			assert.Contains(t, provider.GetEpgXML(), "<title>News</title>")
+		})
+	}
+}
+
+func TestGunzipClosesBody(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("data"))
+	gz.Close()
+
+	for _, content := range [][]byte{compressed.Bytes(), []byte("plain")} {
+		body := &closeRecorder{Reader: bytes.NewReader(content)}
+		reader, err := gunzip(body)
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		assert.True(t, body.closed)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestProviderAsyncEPG(t *testing.T) {
+	m3uFile, err := createTempFile(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, "test_m3u_*.m3u")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(m3uFile.Name()) })
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`))
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(&Config{IPTVUrl: m3uFile.Name(), EPGUrl: server.URL + "/epg.xml", AsyncEPG: true})
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	// The playlist is served while the EPG download is still blocked.
+	assert.Contains(t, provider.GetM3u(), "Channel 1")
+	assert.Empty(t, provider.GetEpgXML())
+	version := provider.ContentVersion()
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(provider.GetEpgXML(), "<title>News</title>")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, version, provider.ContentVersion())
+	from, _ := provider.EPGCoverage()
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), from.UTC())
+}
+
+func newBenchmarkProvider(b *testing.B) *Provider {
+	var m3u strings.Builder
+	m3u.WriteString("#EXTM3U\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&m3u, "#EXTINF:-1 tvg-id=\"id%d\" group-title=\"Group %d\",Channel %d\nhttp://example.com/channel%d\n", i, i%20, i, i)
+	}
+
+	provider, err := NewProvider(&Config{ServerAddress: "proxytv:8080", UseFFMPEG: true})
+	require.NoError(b, err)
+	require.NoError(b, provider.LoadFromBytes([]byte(m3u.String()), []byte(emptyEpg)))
+	return provider
+}
+
+func BenchmarkGetM3u(b *testing.B) {
+	provider := newBenchmarkProvider(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.WriteString(io.Discard, provider.GetM3u())
+	}
+}
+
+func BenchmarkWriteM3u(b *testing.B) {
+	provider := newBenchmarkProvider(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		provider.WriteM3u(io.Discard)
+	}
+}
+
+func TestProviderWriteM3u(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	var m3u bytes.Buffer
+	require.NoError(t, provider.WriteM3u(&m3u))
+	assert.Equal(t, provider.GetM3u(), m3u.String())
+	assert.Contains(t, m3u.String(), "Channel 1")
+}
+
+// blockingWriter blocks its first write until release is closed.
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	select {
+	case <-w.writing:
+	default:
+		close(w.writing)
+	}
+	<-w.release
+	return len(b), nil
+}
+
+func TestProviderWriteM3uDoesNotBlockRefresh(t *testing.T) {
+	provider := newTestProvider(t, &Config{}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	w := &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	written := make(chan error)
+	go func() { written <- provider.WriteM3u(w) }()
+	<-w.writing
+
+	refreshed := make(chan error)
+	go func() { refreshed <- provider.Refresh() }()
+	select {
+	case err := <-refreshed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("refresh blocked by a slow playlist writer")
+	}
+
+	close(w.release)
+	assert.NoError(t, <-written)
+}
+
+func TestProviderStripTags(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 xui-id="{abc}" tvg-id="id1" catchup-source="http://example.com/catchup",Channel 1
+http://example.com/channel1`
+
+	tests := []struct {
+		name      string
+		stripTags []string
+		expected  string
+	}{
+		{
+			name:      "Default",
+			stripTags: []string{"xui-id"},
+			expected:  `#EXTINF:-1 tvg-id="id1" catchup-source="http://example.com/catchup",Channel 1`,
+		},
+		{
+			name:      "Empty",
+			stripTags: []string{},
+			expected:  `#EXTINF:-1 xui-id="{abc}" tvg-id="id1" catchup-source="http://example.com/catchup",Channel 1`,
+		},
+		{
+			name:      "Custom",
+			stripTags: []string{"catchup-source"},
+			expected:  `#EXTINF:-1 xui-id="{abc}" tvg-id="id1",Channel 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t, &Config{StripTags: tt.stripTags}, m3u, emptyEpg)
+			assert.Contains(t, provider.GetM3u(), tt.expected+"\n")
+		})
+	}
+
+	// Bare values are stripped too, including one right before the title.
+	provider := newTestProvider(t, &Config{StripTags: []string{"xui-id", "tvg-rec"}}, `#EXTM3U
+#EXTINF:-1 xui-id=123 tvg-id="id1" tvg-rec=3,Channel 1
+http://example.com/channel1`, emptyEpg)
+	assert.Contains(t, provider.GetM3u(), "#EXTINF:-1 tvg-id=\"id1\",Channel 1\n")
+}
+
+func TestProviderMultipleSources(t *testing.T) {
+	second, err := createTempFile(`#EXTM3U
+#EXTINF:-1 tvg-id="id2" group-title="News",Channel 2
+http://example.com/second/channel2
+#EXTINF:-1 tvg-id="id3" group-title="News",Channel 3 HD
+http://example.com/second/channel3hd
+#EXTINF:-1 tvg-id="id4" group-title="News",Channel 4
+http://example.com/second/channel4`, "test_m3u_*.m3u")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(second.Name()) })
+
+	provider := newTestProvider(t, &Config{
+		IPTVUrls:      []string{second.Name()},
+		UseFFMPEG:     true,
+		ServerAddress: "proxytv:8080",
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" group-title="News",Channel 1
+http://example.com/first/channel1
+#EXTINF:-1 tvg-id="id2" group-title="News",Channel 2
+http://example.com/first/channel2
+#EXTINF:-1 tvg-id="id3" group-title="News",Channel 3
+http://example.com/first/channel3`, emptyEpg)
+
+	var names, urls []string
+	for i := 0; !provider.GetTrack(i).IsEmpty(); i++ {
+		names = append(names, provider.GetTrack(i).Name)
+		urls = append(urls, provider.GetTrack(i).URI.String())
+	}
+	// The first source wins ties, and the HD variant from the second source
+	// replaces its counterpart in place.
+	assert.Equal(t, []string{"Channel 1", "Channel 2", "Channel 3 HD", "Channel 4"}, names)
+	assert.Equal(t, []string{
+		"http://example.com/first/channel1",
+		"http://example.com/first/channel2",
+		"http://example.com/second/channel3hd",
+		"http://example.com/second/channel4",
+	}, urls)
+
+	m3u := provider.GetM3u()
+	for i := range names {
+		assert.Equal(t, 1, strings.Count(m3u, fmt.Sprintf("http://proxytv:8080/channel/%d\n", i)))
+	}
+	assert.NotContains(t, m3u, "/channel/4")
+}
+
+func TestProviderMultipleEPGSources(t *testing.T) {
+	second, err := createTempFile(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Other Name</display-name><icon src="http://example.com/id1.png"/></channel>
+  <channel id="id2"><display-name>Channel 2</display-name></channel>
+  <channel id="id9"><display-name>Not In Playlist</display-name></channel>
+  <programme start="20240101010000 +0000" stop="20240101020000 +0000" channel="id1"><title>Second</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id2"><title>Other</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id9"><title>Dropped</title></programme>
+</tv>`, "test_epg_*.xml")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(second.Name()) })
+
+	provider := newTestProvider(t, &Config{EPGUrls: []string{second.Name()}}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`, `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101020000 +0000" stop="20240101030000 +0000" channel="id1"><title>Third</title></programme>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>First</title></programme>
+</tv>`)
+
+	epg := provider.epg
+	require.Len(t, epg.Channels, 2)
+	assert.Equal(t, "id1", epg.Channels[0].ID)
+	assert.Equal(t, "Channel 1", epg.Channels[0].DisplayNames[0].Value)
+	require.Len(t, epg.Channels[0].Icons, 1)
+	assert.Equal(t, "http://example.com/id1.png", epg.Channels[0].Icons[0].Source)
+	assert.Equal(t, "id2", epg.Channels[1].ID)
+
+	var titles []string
+	for _, programme := range epg.Programmes {
+		titles = append(titles, programme.Channel+":"+programme.Titles[0].Value)
+	}
+	assert.Equal(t, []string{"id1:First", "id1:Second", "id1:Third", "id2:Other"}, titles)
+
+	from, to := provider.EPGCoverage()
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), from.UTC())
+	assert.Equal(t, time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC), to.UTC())
+	assert.Equal(t, []string{"id1", "id2", "id9"}, provider.EPGSourceIDs())
+}
+
+func TestProviderConcurrentFetch(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+
+		switch r.URL.Path {
+		case "/iptv.m3u":
+			w.Write([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`))
+		case "/epg.xml":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`))
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl: server.URL + "/iptv.m3u",
+		EPGUrl:  server.URL + "/epg.xml",
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, provider.Refresh())
+	assert.Less(t, time.Since(start), 2*delay)
+	assert.Equal(t, int32(2), maxInFlight.Load())
+	assert.Contains(t, provider.GetEpgXML(), "<title>News</title>")
+}
+
+func TestProviderSkippedLinesWarning(t *testing.T) {
+	const m3u = `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`
+	provider := newTestProvider(t, &Config{}, m3u, emptyEpg)
+
+	assert.Contains(t, provider.LastWarnings(), Warning{Kind: "skipped-lines", Message: "1 malformed playlist lines skipped"})
+	assert.NotContains(t, provider.GetM3u(), "Channel 1")
+	assert.Contains(t, provider.GetM3u(), "http://example.com/channel2")
+}
@@ -0,0 +1,114 @@
+package proxytv
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (p *Provider) m3uInterval() time.Duration {
+	if p.config.IPTVInterval > 0 {
+		return p.config.IPTVInterval
+	}
+	return p.config.RefreshInterval
+}
+
+func (p *Provider) epgInterval() time.Duration {
+	if p.config.EPGInterval > 0 {
+		return p.config.EPGInterval
+	}
+	return p.config.RefreshInterval
+}
+
+// refreshDelay returns how long to wait before retrying a source refreshed
+// every interval after the given number of consecutive failures. The interval
+// doubles with each failure, up to refreshBackoffMax.
+func (p *Provider) refreshDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	if p.config.RefreshBackoffMax <= delay {
+		return delay
+	}
+	for i := 0; i < failures && delay < p.config.RefreshBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, p.config.RefreshBackoffMax)
+}
+
+// refreshJitter returns a random delay of up to refreshJitter to add to a wait
+// between refreshes.
+func (p *Provider) refreshJitter() time.Duration {
+	if p.config.RefreshJitter <= 0 {
+		return 0
+	}
+	return rand.N(p.config.RefreshJitter)
+}
+
+// StartAutoRefresh refreshes the playlist every iptvInterval and the EPG every
+// epgInterval until ctx is done, calling onSuccess after each successful
+// refresh. While refreshes keep failing, the wait between them grows as
+// configured by refreshBackoffMax so that a struggling upstream is not
+// hammered.
+func (p *Provider) StartAutoRefresh(ctx context.Context, onSuccess func()) {
+	go p.autoRefresh(ctx, p.m3uInterval(), p.epgInterval(), onSuccess)
+}
+
+// Start refreshes the provider once and then every interval until ctx is done,
+// for applications that do not otherwise call Refresh. Failed refreshes are
+// logged and retried with the backoff of StartAutoRefresh, and the data of the
+// last successful refresh is served in the meantime.
+func (p *Provider) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		if err := p.refresh(true, true); err != nil {
+			log.WithError(err).Error("failed to refresh provider")
+		}
+		p.autoRefresh(ctx, interval, interval, nil)
+	}()
+}
+
+func (p *Provider) autoRefresh(ctx context.Context, m3uInterval, epgInterval time.Duration, onSuccess func()) {
+	failures := 0
+	untilM3u, untilEPG := m3uInterval, epgInterval
+	for {
+		delay := min(untilM3u, untilEPG)
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.after(delay + p.refreshJitter()):
+		}
+		untilM3u -= delay
+		untilEPG -= delay
+		reloadM3u, reloadEPG := untilM3u <= 0, untilEPG <= 0
+
+		log.WithFields(log.Fields{
+			"m3u": reloadM3u,
+			"epg": reloadEPG,
+		}).Info("refreshing provider")
+		if err := p.refresh(reloadM3u, reloadEPG); err != nil {
+			failures++
+			if reloadM3u {
+				untilM3u = p.refreshDelay(m3uInterval, failures)
+			}
+			if reloadEPG {
+				untilEPG = p.refreshDelay(epgInterval, failures)
+			}
+			log.WithError(err).WithFields(log.Fields{
+				"failures":  failures,
+				"nextDelay": min(untilM3u, untilEPG),
+			}).Error("failed to refresh provider")
+			continue
+		}
+
+		failures = 0
+		if reloadM3u {
+			untilM3u = m3uInterval
+		}
+		if reloadEPG {
+			untilEPG = epgInterval
+		}
+		if onSuccess != nil {
+			onSuccess()
+		}
+	}
+}
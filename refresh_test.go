@@ -0,0 +1,362 @@
+package proxytv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshDelay(t *testing.T) {
+	p := &Provider{config: &Config{RefreshInterval: time.Hour, RefreshBackoffMax: 6 * time.Hour}}
+	assert.Equal(t, time.Hour, p.refreshDelay(time.Hour, 0))
+	assert.Equal(t, 2*time.Hour, p.refreshDelay(time.Hour, 1))
+	assert.Equal(t, 4*time.Hour, p.refreshDelay(time.Hour, 2))
+	assert.Equal(t, 6*time.Hour, p.refreshDelay(time.Hour, 3))
+	assert.Equal(t, 6*time.Hour, p.refreshDelay(time.Hour, 100))
+
+	p.config.RefreshBackoffMax = 0
+	assert.Equal(t, time.Hour, p.refreshDelay(time.Hour, 3))
+}
+
+func TestStartAutoRefreshBackoff(t *testing.T) {
+	const m3u = `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`
+	provider := newTestProvider(t, &Config{
+		RefreshInterval:   time.Hour,
+		RefreshBackoffMax: 3 * time.Hour,
+	}, m3u, emptyEpg)
+
+	// The fake clock reports each requested wait and fires when ticked.
+	waits := make(chan time.Duration)
+	tick := make(chan time.Time)
+	provider.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return tick
+	}
+
+	successes := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider.StartAutoRefresh(ctx, func() { successes <- struct{}{} })
+
+	nextWait := func() time.Duration {
+		select {
+		case d := <-waits:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatal("auto-refresh did not wait again")
+			return 0
+		}
+	}
+
+	assert.Equal(t, time.Hour, nextWait())
+
+	require.NoError(t, os.WriteFile(provider.iptvURLs[0], []byte("not a playlist"), 0644))
+	tick <- time.Now()
+	assert.Equal(t, 2*time.Hour, nextWait())
+	tick <- time.Now()
+	assert.Equal(t, 3*time.Hour, nextWait())
+	tick <- time.Now()
+	assert.Equal(t, 3*time.Hour, nextWait())
+	assert.Empty(t, successes)
+
+	require.NoError(t, os.WriteFile(provider.iptvURLs[0], []byte(m3u), 0644))
+	tick <- time.Now()
+	assert.Equal(t, time.Hour, nextWait())
+	assert.Len(t, successes, 1)
+}
+
+func TestStartAutoRefreshPerSourceIntervals(t *testing.T) {
+	var m3uHits, epgHits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/iptv.m3u":
+			m3uHits.Add(1)
+			w.Write([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`))
+		case "/epg.xml":
+			epgHits.Add(1)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`))
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl:      server.URL + "/iptv.m3u",
+		EPGUrl:       server.URL + "/epg.xml",
+		IPTVInterval: time.Hour,
+		EPGInterval:  3 * time.Hour,
+	})
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	waits := make(chan time.Duration)
+	tick := make(chan time.Time)
+	provider.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return tick
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider.StartAutoRefresh(ctx, nil)
+
+	nextWait := func() time.Duration {
+		select {
+		case d := <-waits:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatal("auto-refresh did not wait again")
+			return 0
+		}
+	}
+
+	expected := []struct{ m3u, epg int32 }{{2, 1}, {3, 1}, {4, 2}, {5, 2}}
+	assert.Equal(t, time.Hour, nextWait())
+	for _, counts := range expected {
+		tick <- time.Now()
+		assert.Equal(t, time.Hour, nextWait())
+		assert.Equal(t, counts.m3u, m3uHits.Load())
+		assert.Equal(t, counts.epg, epgHits.Load())
+		// The cached guide is reused while only the playlist is refreshed.
+		assert.Contains(t, provider.GetEpgXML(), "<title>News</title>")
+	}
+}
+
+func TestStartAutoRefreshJitter(t *testing.T) {
+	provider := newTestProvider(t, &Config{
+		RefreshInterval: time.Hour,
+		RefreshJitter:   30 * time.Minute,
+	}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	waits := make(chan time.Duration)
+	tick := make(chan time.Time)
+	provider.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return tick
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider.StartAutoRefresh(ctx, nil)
+
+	for i := 0; i < 5; i++ {
+		select {
+		case d := <-waits:
+			assert.GreaterOrEqual(t, d, time.Hour)
+			assert.Less(t, d, 90*time.Minute)
+		case <-time.After(5 * time.Second):
+			t.Fatal("auto-refresh did not wait again")
+		}
+		tick <- time.Now()
+	}
+}
+
+func TestProviderStart(t *testing.T) {
+	var m3uHits atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/iptv.m3u":
+			m3uHits.Add(1)
+			if failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`))
+		case "/epg.xml":
+			w.Write([]byte(emptyEpg))
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl: server.URL + "/iptv.m3u",
+		EPGUrl:  server.URL + "/epg.xml",
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	provider.Start(ctx, 10*time.Millisecond)
+
+	// Readers run alongside the refreshes.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			provider.GetM3u()
+			provider.GetEpgXML()
+		}
+	}()
+
+	require.Eventually(t, func() bool { return m3uHits.Load() >= 3 }, 3*time.Second, 5*time.Millisecond)
+	assert.Contains(t, provider.GetM3u(), "http://example.com/channel1")
+
+	// Failed refreshes keep the last good data served.
+	failing.Store(true)
+	hits := m3uHits.Load()
+	require.Eventually(t, func() bool { return m3uHits.Load() >= hits+2 }, 3*time.Second, 5*time.Millisecond)
+	assert.Contains(t, provider.GetM3u(), "http://example.com/channel1")
+
+	cancel()
+	<-done
+	time.Sleep(50 * time.Millisecond)
+	hits = m3uHits.Load()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, hits, m3uHits.Load(), "refreshed after the context was done")
+}
+
+func TestProviderConcurrentRefresh(t *testing.T) {
+	// Each refresh fetches the playlist and the guide once, and every other
+	// refresh gets a second channel along with a guide from a later year.
+	var m3uHits, epgHits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/iptv.m3u":
+			m3u := "#EXTM3U\n#EXTINF:-1 tvg-id=\"id1\",Channel 1\nhttp://example.com/channel1\n"
+			if m3uHits.Add(1)%2 == 0 {
+				m3u += "#EXTINF:-1 tvg-id=\"id2\",Channel 2\nhttp://example.com/channel2\n"
+			}
+			w.Write([]byte(m3u))
+		case "/epg.xml":
+			year := "2024"
+			if epgHits.Add(1)%2 == 0 {
+				year = "2025"
+			}
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <channel id="id2"><display-name>Channel 2</display-name></channel>
+  <programme start="` + year + `0101000000 +0000" stop="` + year + `0101010000 +0000" channel="id1"><title>News</title></programme>
+  <programme start="` + year + `0101000000 +0000" stop="` + year + `0101010000 +0000" channel="id2"><title>News</title></programme>
+</tv>`))
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl: server.URL + "/iptv.m3u",
+		EPGUrl:  server.URL + "/epg.xml",
+	})
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				assert.NoError(t, provider.Refresh())
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	readers := make(chan struct{})
+	go func() {
+		defer close(readers)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			var m manifest
+			require.NoError(t, json.Unmarshal(provider.Manifest(), &m))
+			require.NotNil(t, m.EPG.From)
+			if m.ChannelCount == 2 {
+				assert.Equal(t, 2025, m.EPG.From.Year(), "playlist and guide from different refreshes")
+			} else {
+				assert.Equal(t, 1, m.ChannelCount)
+				assert.Equal(t, 2024, m.EPG.From.Year(), "playlist and guide from different refreshes")
+			}
+
+			m3u := provider.GetM3u()
+			assert.True(t, strings.HasPrefix(m3u, "#EXTM3U"))
+			assert.Contains(t, m3u, "http://example.com/channel1")
+			assert.Contains(t, provider.GetEpgXML(), "<title>News</title>")
+			assert.Equal(t, "Channel 1", provider.GetTrack(0).Name)
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-readers
+	assert.Equal(t, int32(21), m3uHits.Load())
+	assert.Equal(t, int32(21), epgHits.Load())
+}
+
+func TestProviderRefreshFailureKeepsLastGoodData(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		switch r.URL.Path {
+		case "/iptv.m3u":
+			w.Write([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`))
+		case "/epg.xml":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`))
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(&Config{
+		IPTVUrl: server.URL + "/iptv.m3u",
+		EPGUrl:  server.URL + "/epg.xml",
+	})
+	require.NoError(t, err)
+	assert.True(t, provider.GetLastSuccessfulRefresh().IsZero())
+
+	require.NoError(t, provider.Refresh())
+	assert.NoError(t, provider.GetLastError())
+	m3u := provider.GetM3u()
+	epg := provider.GetEpgXML()
+	refreshed := provider.GetLastSuccessfulRefresh()
+	assert.False(t, refreshed.IsZero())
+	assert.Contains(t, m3u, "http://example.com/channel1")
+	assert.Contains(t, epg, "News")
+
+	failing.Store(true)
+	err = provider.Refresh()
+	require.Error(t, err)
+	assert.Equal(t, err, provider.GetLastError())
+	assert.Equal(t, m3u, provider.GetM3u())
+	assert.Equal(t, epg, provider.GetEpgXML())
+	assert.Equal(t, refreshed, provider.GetLastSuccessfulRefresh())
+	assert.Equal(t, refreshed, provider.GetLastRefresh())
+
+	failing.Store(false)
+	require.NoError(t, provider.Refresh())
+	assert.NoError(t, provider.GetLastError())
+}
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
 	"path"
 	"strconv"
@@ -32,6 +35,12 @@ import (
 
 const channelURIPrefix = "/channel/"
 
+const defaultStreamStallTimeout = 30 * time.Second
+
+// ffmpegCommand is the binary used to remux streams. It is a variable so tests
+// can substitute a fake implementation.
+var ffmpegCommand = "ffmpeg"
+
 var startTime = time.Now()
 
 type Server struct {
@@ -40,15 +49,41 @@ type Server struct {
 	server        *http.Server
 	provider      *Provider
 	useFfmpeg     bool
+	splitRadio    bool
 	streamsSem    *semaphore.Weighted
 	maxStreams    int64
 	totalStreams  int64
+	rotation      uint64
 	streams       map[*http.Request]*streamInfo
 	lock          sync.Mutex
 	version       string
 	headContent   template.HTML
+
+	streamStallTimeout  time.Duration
+	streamStallRestarts int
+	streamFormat        streamFormat
+}
+
+// streamFormat describes an FFMPEG output muxer and the content type of the
+// stream it produces.
+type streamFormat struct {
+	args        []string
+	contentType string
+}
+
+var streamFormats = map[string]streamFormat{
+	"mpegts": {
+		args:        []string{"-f", "mpegts"},
+		contentType: `video/mpeg; codecs="avc1.4D401E"`,
+	},
+	"fmp4": {
+		args:        []string{"-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4"},
+		contentType: "video/mp4",
+	},
 }
 
+const defaultStreamFormat = "mpegts"
+
 type streamInfo struct {
 	ClientIP  string    `json:"clientIP"`
 	ChannelID int       `json:"channelID"`
@@ -57,8 +92,8 @@ type streamInfo struct {
 	StartTime time.Time `json:"startTime"`
 }
 
-func newStreamInfo(request *http.Request) (*streamInfo, error) {
-	channelID, err := strconv.Atoi(request.RequestURI[len(channelURIPrefix):])
+func newStreamInfo(request *http.Request, channelIDParam string) (*streamInfo, error) {
+	channelID, err := strconv.Atoi(channelIDParam)
 	if err != nil {
 		return nil, err
 	}
@@ -109,13 +144,27 @@ func NewServer(config *Config, provider *Provider, version string) (*Server, err
 		router:        gin.New(),
 		provider:      provider,
 		useFfmpeg:     config.UseFFMPEG,
+		splitRadio:    config.SplitRadio,
 		streamsSem:    semaphore.NewWeighted(int64(config.MaxStreams)),
 		maxStreams:    int64(config.MaxStreams),
 		totalStreams:  0,
 		streams:       make(map[*http.Request]*streamInfo),
 		version:       version,
 		headContent:   headContent(version),
+
+		streamStallTimeout:  config.StreamStallTimeout,
+		streamStallRestarts: config.StreamStallRestarts,
+	}
+
+	if server.streamStallTimeout <= 0 {
+		server.streamStallTimeout = defaultStreamStallTimeout
+	}
+
+	format, ok := streamFormats[config.StreamFormat]
+	if !ok {
+		format = streamFormats[defaultStreamFormat]
 	}
+	server.streamFormat = format
 
 	server.router.Use(gin.LoggerWithFormatter(logrusLogFormatter))
 	server.router.Use(gin.Recovery())
@@ -128,21 +177,178 @@ func NewServer(config *Config, provider *Provider, version string) (*Server, err
 	return server, nil
 }
 
+// dataUnavailable responds with 503 if the provider's data has expired and
+// the onFailure policy is "error".
+func (s *Server) dataUnavailable(c *gin.Context) bool {
+	if err := s.provider.DataError(); err != nil {
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return true
+	}
+	return false
+}
+
+// notModified sets the ETag for the current provider content and reports
+// whether the client already holds it, in which case a 304 has been sent.
+func (s *Server) notModified(c *gin.Context) bool {
+	version := s.provider.ContentVersion()
+	if len(version) == 0 {
+		return false
+	}
+	etag := fmt.Sprintf("\"%s\"", version)
+	c.Header("ETag", etag)
+	for _, candidate := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) getIptvM3u() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if s.dataUnavailable(c) || s.notModified(c) {
+			return
+		}
 		c.Header("Content-Disposition", "attachment; filename=tv_channels.m3u")
 		c.Header("Content-Description", "File Transfer")
 		c.Header("Cache-Control", "no-cache")
-		c.Data(200, "application/octet-stream", []byte(s.provider.GetM3u()))
+		c.Header("Content-Type", "application/octet-stream")
+		c.Status(200)
+		if err := s.provider.WriteM3u(c.Writer); err != nil {
+			log.WithError(err).Debug("unable to write m3u")
+		}
+	}
+}
+
+func (s *Server) getRadioM3u() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.splitRadio {
+			c.String(404, "Radio playlist not enabled")
+			return
+		}
+		if s.dataUnavailable(c) || s.notModified(c) {
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=radio_channels.m3u")
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Cache-Control", "no-cache")
+		c.Data(200, "application/octet-stream", []byte(s.provider.GetRadioM3u()))
+	}
+}
+
+func (s *Server) getMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.provider.MetricsHandler().ServeHTTP(c.Writer, c.Request)
 	}
 }
 
 func (s *Server) getEpgXML() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if s.dataUnavailable(c) || s.notModified(c) {
+			return
+		}
+		c.Header("Vary", "Accept-Encoding")
+		if acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Header("Content-Encoding", "gzip")
+			c.Data(200, "application/xml", s.provider.GetEpgXMLGzip())
+			return
+		}
 		c.Data(200, "application/xml", []byte(s.provider.GetEpgXML()))
 	}
 }
 
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if name = strings.TrimSpace(name); name != "gzip" && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (s *Server) getEpgPart() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		part, err := strconv.Atoi(strings.TrimSuffix(c.Param("part"), ".xml"))
+		if err != nil {
+			c.String(400, "Invalid EPG part")
+			return
+		}
+		if s.dataUnavailable(c) || s.notModified(c) {
+			return
+		}
+		data := s.provider.GetEpgPart(part)
+		if data == nil {
+			c.String(404, "EPG part not found")
+			return
+		}
+		c.Data(200, "application/xml", data)
+	}
+}
+
+func (s *Server) getEpgJSON() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.dataUnavailable(c) || s.notModified(c) {
+			return
+		}
+		data, err := s.provider.GetEpgJSON()
+		if err != nil {
+			log.WithError(err).Error("error encoding epg json")
+			c.String(500, "Error encoding EPG")
+			return
+		}
+		c.Data(200, "application/json", data)
+	}
+}
+
+func (s *Server) getHealthz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := s.provider.Health()
+		if !status.Healthy {
+			c.JSON(http.StatusServiceUnavailable, status)
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+func (s *Server) getManifest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.dataUnavailable(c) || s.notModified(c) {
+			return
+		}
+		c.Data(200, "application/json", s.provider.Manifest())
+	}
+}
+
+func (s *Server) getXtream() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.dataUnavailable(c) {
+			return
+		}
+		data, err := s.provider.GetXtreamJSON(c.Query("action"), c.Query("category_id"))
+		if errors.Is(err, errUnknownXtreamAction) {
+			c.String(400, "Unsupported action")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("error encoding xtream json")
+			c.String(500, "Error encoding response")
+			return
+		}
+		c.Data(200, "application/json", data)
+	}
+}
+
 func (s *Server) remuxStream(c *gin.Context, track *Track, channelID int) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -175,12 +381,62 @@ func (s *Server) remuxStream(c *gin.Context, track *Track, channelID int) {
 
 	start := time.Now()
 
-	run := exec.Command("ffmpeg", "-i", track.URI.String(), "-c:v", "copy", "-f", "mpegts", "pipe:1")
+	atomic.AddInt64(&s.totalStreams, 1)
+
+	// Rotate the starting URL per stream so load is spread across alternates,
+	// failing over to the next URL when one produces no data.
+	urls := track.urls()
+	offset := int(atomic.AddUint64(&s.rotation, 1) - 1)
+
+	bytesWritten := int64(0)
+	restarts := 0
+	failovers := 0
+	c.Header("Content-Type", s.streamFormat.contentType)
+
+	c.Stream(func(w io.Writer) bool {
+		uri := urls[(offset+failovers)%len(urls)]
+		n, err := s.runFfmpeg(c.Request.Context(), w, uri, logger)
+		bytesWritten += n
+
+		if n == 0 && failovers+1 < len(urls) {
+			failovers++
+			logger.WithField("failovers", failovers).Warn("failing over to alternate stream url")
+			return true
+		}
+
+		if err == ErrTimeout && restarts < s.streamStallRestarts {
+			restarts++
+			logger.WithField("restarts", restarts).Warn("restarting stalled stream")
+			return true
+		}
+
+		return false
+	})
+
+	logger.WithFields(log.Fields{
+		"duration": time.Since(start),
+		"bytes":    bytesWritten,
+	}).Info("stopped streaming")
+}
+
+// ffmpegArgs returns the FFMPEG arguments that remux uri to stdout in the
+// configured stream format.
+func (s *Server) ffmpegArgs(uri string) []string {
+	args := []string{"-i", uri, "-c:v", "copy"}
+	args = append(args, s.streamFormat.args...)
+	return append(args, "pipe:1")
+}
+
+// runFfmpeg remuxes uri to w until the upstream ends, ctx is done because the
+// client went away, or no bytes are produced for the configured stall timeout.
+// FFMPEG is killed when ctx is done.
+func (s *Server) runFfmpeg(ctx context.Context, w io.Writer, uri string, logger *log.Entry) (int64, error) {
+	run := exec.CommandContext(ctx, ffmpegCommand, s.ffmpegArgs(uri)...)
 	logger.WithField("cmd", strings.Join(run.Args, " ")).Debug("executing ffmpeg")
 	ffmpegout, err := run.StdoutPipe()
 	if err != nil {
 		logger.WithError(err).Error("error creating ffmpeg stdout pipe")
-		return
+		return 0, err
 	}
 
 	stderr, stderrErr := run.StderrPipe()
@@ -190,51 +446,38 @@ func (s *Server) remuxStream(c *gin.Context, track *Track, channelID int) {
 
 	if startErr := run.Start(); startErr != nil {
 		log.WithError(startErr).Errorln("error starting ffmpeg")
-		return
+		return 0, startErr
 	}
 	defer run.Wait()
-
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		scanner.Split(split)
-		for scanner.Scan() {
-			log.Debugln(scanner.Text())
+	defer func() {
+		if killErr := run.Process.Kill(); killErr != nil && !errors.Is(killErr, os.ErrProcessDone) {
+			logger.WithError(killErr).Error("error killing ffmpeg")
 		}
 	}()
 
-	atomic.AddInt64(&s.totalStreams, 1)
-
-	bytesWritten := int64(0)
-	continueStream := true
-	c.Header("Content-Type", `video/mpeg; codecs="avc1.4D401E"`)
-
-	c.Stream(func(w io.Writer) bool {
-		defer func() {
-			logger.WithFields(log.Fields{
-				"duration": time.Since(start),
-				"bytes":    bytesWritten,
-			}).Info("stopped streaming")
-			if killErr := run.Process.Kill(); killErr != nil {
-				logger.WithError(killErr).Error("error killing ffmpeg")
+	if stderr != nil {
+		go func() {
+			scanner := bufio.NewScanner(stderr)
+			scanner.Split(split)
+			for scanner.Scan() {
+				log.Debugln(scanner.Text())
 			}
-			continueStream = false
 		}()
+	}
 
-		timeoutReader := NewTimeoutReader(ffmpegout, 30*time.Second)
-		timeoutWriter := NewTimeoutWriter(w, 30*time.Second)
+	timeoutReader := NewTimeoutReader(ffmpegout, s.streamStallTimeout)
+	timeoutWriter := NewTimeoutWriter(w, 30*time.Second)
 
-		if bytesWritten, err = io.Copy(timeoutWriter, timeoutReader); err != nil {
-			if err == ErrTimeout {
-				logger.Warn("timeout occurred during stream copy")
-			} else if !errors.Is(err, syscall.EPIPE) {
-				logger.WithError(err).Error("error when copying data")
-			}
-			continueStream = false
-			return false
+	bytesWritten, err := io.Copy(timeoutWriter, timeoutReader)
+	if err != nil {
+		if err == ErrTimeout {
+			logger.WithField("bytes", bytesWritten).Warn("timeout occurred during stream copy")
+		} else if !errors.Is(err, syscall.EPIPE) {
+			logger.WithError(err).Error("error when copying data")
 		}
+	}
 
-		return continueStream
-	})
+	return bytesWritten, err
 }
 
 func split(data []byte, atEOF bool) (advance int, token []byte, spliterror error) {
@@ -271,37 +514,148 @@ func (s *Server) refresh() gin.HandlerFunc {
 	}
 }
 
-func (s *Server) streamChannel() gin.HandlerFunc {
+func (s *Server) purgeCaches() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		channelIDParam := c.Param("channelId")
-		channelID, err := strconv.Atoi(channelIDParam)
+		s.provider.PurgeCaches()
+		c.String(200, "Caches purged successfully")
+	}
+}
+
+func (s *Server) lookupChannel(c *gin.Context, channelID int) *Track {
+	return s.provider.GetTrack(channelID)
+}
+
+func (s *Server) lookupLineupChannel(c *gin.Context, channelID int) *Track {
+	return s.provider.GetLineupTrack(c.Param("lineup"), channelID)
+}
+
+func (s *Server) lookupRadioChannel(c *gin.Context, channelID int) *Track {
+	return s.provider.GetRadioTrack(channelID)
+}
+
+func (s *Server) streamTrack(lookup func(c *gin.Context, channelID int) *Track) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		track, channelID, ok := s.findTrack(c, lookup)
+		if !ok {
+			return
+		}
+		s.serveTrack(c, track, channelID)
+	}
+}
+
+// streamCatchup serves the catchup of a channel whose catchup-source was
+// rewritten to point at proxytv, filling the upstream template's placeholders
+// with the p0, p1, ... query parameters.
+func (s *Server) streamCatchup(lookup func(c *gin.Context, channelID int) *Track) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		track, channelID, ok := s.findTrack(c, lookup)
+		if !ok {
+			return
+		}
+
+		values := make([]string, len(catchupPlaceholders(track.Tags["catchup-source"])))
+		for i := range values {
+			values[i] = c.Query(fmt.Sprintf("p%d", i))
+		}
+		uri, err := url.Parse(track.catchupURL(values))
+		if err != nil || !isURL(uri.String()) {
+			log.WithField("channelId", channelID).Warn("catchup not available")
+			c.String(404, "Catchup not available")
+			return
+		}
+
+		catchup := track.clone()
+		catchup.URI = uri
+		catchup.AltURIs = nil
+		s.serveTrack(c, &catchup, channelID)
+	}
+}
+
+// findTrack looks up the track of the request's channelId, responding with an
+// error and returning false if there is none.
+func (s *Server) findTrack(c *gin.Context, lookup func(c *gin.Context, channelID int) *Track) (*Track, int, bool) {
+	channelIDParam := c.Param("channelId")
+	channelID, err := strconv.Atoi(channelIDParam)
+	if err != nil {
+		log.WithError(err).Warn("invalid channelId")
+		c.String(400, "Invalid channel id")
+		return nil, 0, false
+	}
+
+	if s.dataUnavailable(c) {
+		return nil, 0, false
+	}
+
+	track := lookup(c, channelID)
+	if track.IsEmpty() {
+		log.WithField("channelId", channelID).Warn("channel not found")
+		c.String(404, "Channel not found")
+		return nil, 0, false
+	}
+	return track, channelID, true
+}
+
+// serveTrack remuxes the track's stream through FFMPEG, or redirects the
+// client to it when FFMPEG is disabled.
+func (s *Server) serveTrack(c *gin.Context, track *Track, channelID int) {
+	if !s.useFfmpeg {
+		c.Redirect(http.StatusFound, track.URI.String())
+		return
+	}
+
+	s.remuxStream(c, track, channelID)
+}
+
+func (s *Server) getLogo() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The parameter is not named channelId so that streamTracker does not
+		// count logo requests as streams.
+		channelID, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
-			log.WithError(err).Warn("invalid channelId")
 			c.String(400, "Invalid channel id")
 			return
 		}
 
-		if !s.useFfmpeg {
-			c.String(404, "Channel not found")
+		logoURL := s.provider.GetTrack(channelID).Tags["tvg-logo"]
+		if len(logoURL) == 0 {
+			c.String(404, "Logo not found")
 			return
 		}
 
-		track := s.provider.GetTrack(channelID)
-		if track.URI == nil {
-			log.WithField("channelId", channelID).Warn("channel not found")
-			c.String(404, "Channel not found")
+		data, contentType, err := s.provider.GetLogo(c.Request.Context(), logoURL)
+		if err != nil {
+			log.WithError(err).WithField("url", logoURL).Warn("unable to fetch logo")
+			c.String(502, "Unable to fetch logo")
 			return
 		}
+		c.Header("Cache-Control", "max-age=86400")
+		c.Data(200, contentType, data)
+	}
+}
 
-		s.remuxStream(c, track, channelID)
+func (s *Server) getLineupM3u() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m3u, ok := s.provider.GetM3uForLineup(c.Param("lineup"))
+		if !ok {
+			c.String(404, "Lineup not found")
+			return
+		}
+		if s.dataUnavailable(c) || s.notModified(c) {
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=tv_channels.m3u")
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Cache-Control", "no-cache")
+		c.Data(200, "application/octet-stream", []byte(m3u))
 	}
 }
 
 func (s *Server) streamTracker(c *gin.Context) {
-	isStream := strings.HasPrefix(c.Request.RequestURI, channelURIPrefix)
+	channelIDParam := c.Param("channelId")
+	isStream := len(channelIDParam) > 0
 	if isStream {
 		s.lock.Lock()
-		if streamInfo, err := newStreamInfo(c.Request); err != nil {
+		if streamInfo, err := newStreamInfo(c.Request, channelIDParam); err != nil {
 			log.WithError(err).Error("error creating stream info")
 		} else {
 			s.streams[c.Request] = streamInfo
@@ -360,6 +714,21 @@ func (s *Server) debug() gin.HandlerFunc {
 			},
 		}
 
+		if err := s.provider.GetLastError(); err != nil {
+			metrics["lastError"] = err.Error()
+		}
+
+		if stats := s.provider.FilterStats(); len(stats) > 0 {
+			metrics["filters"] = stats
+		}
+
+		if from, to := s.provider.EPGCoverage(); !from.IsZero() {
+			metrics["guide"] = gin.H{
+				"from": from.Format(time.RFC3339),
+				"to":   to.Format(time.RFC3339),
+			}
+		}
+
 		c.JSON(200, metrics)
 	}
 }
@@ -429,21 +798,41 @@ func (s *Server) getStreamInfo() gin.HandlerFunc {
 	}
 }
 
-func (s *Server) Start(provider *Provider) chan error {
+func (s *Server) setupRoutes() {
 	s.router.GET("/ping", func(c *gin.Context) {
 		c.String(200, "PONG")
 	})
 
+	s.router.GET("/healthz", s.getHealthz())
+
 	s.router.Use(s.streamTracker)
 
 	s.router.GET("/", s.homePage())
 	s.router.GET("/iptv.m3u", s.getIptvM3u())
 	s.router.GET("/epg.xml", s.getEpgXML())
-	s.router.GET(fmt.Sprintf("%s:channelId", channelURIPrefix), s.streamChannel())
+	s.router.GET("/epg.json", s.getEpgJSON())
+	s.router.GET("/manifest.json", s.getManifest())
+	s.router.GET("/player_api.php", s.getXtream())
+	s.router.GET(fmt.Sprintf("%s:channelId", channelURIPrefix), s.streamTrack(s.lookupChannel))
+	s.router.GET(fmt.Sprintf("%s:channelId/catchup", channelURIPrefix), s.streamCatchup(s.lookupChannel))
+	s.router.GET("/epg/:part", s.getEpgPart())
+	s.router.GET("/logo/:id", s.getLogo())
+	s.router.GET("/lineup/:lineup/iptv.m3u", s.getLineupM3u())
+	s.router.GET("/lineup/:lineup/channel/:channelId", s.streamTrack(s.lookupLineupChannel))
+	s.router.GET("/lineup/:lineup/channel/:channelId/catchup", s.streamCatchup(s.lookupLineupChannel))
+	s.router.GET("/radio.m3u", s.getRadioM3u())
+	s.router.GET("/radio/channel/:channelId", s.streamTrack(s.lookupRadioChannel))
+	s.router.GET("/radio/channel/:channelId/catchup", s.streamCatchup(s.lookupRadioChannel))
 	s.router.PUT("/refresh", s.refresh())
+	s.router.PUT("/purge", s.purgeCaches())
 	s.router.GET("/debug", s.debug())
+	s.router.GET("/metrics", s.getMetrics())
 	s.router.GET("/stream-info", s.getStreamInfo())
 	s.router.StaticFS("/static", static.AssetFile())
+}
+
+func (s *Server) Start(provider *Provider) chan error {
+	s.setupRoutes()
 
 	s.server = &http.Server{
 		Addr:    s.listenAddress,
@@ -454,8 +843,15 @@ func (s *Server) Start(provider *Provider) chan error {
 
 	errChan := make(chan error, 1)
 
+	listener, err := net.Listen("tcp", s.listenAddress)
+	if err != nil {
+		log.WithError(err).Error("failed to listen")
+		errChan <- err
+		return errChan
+	}
+
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.WithError(err).Error("failed to listen and serve")
 			errChan <- err
 		}
@@ -493,7 +889,7 @@ func NewTimeoutReader(r io.Reader, timeout time.Duration) *TimeoutReader {
 }
 
 func (tr *TimeoutReader) Read(p []byte) (int, error) {
-	ch := make(chan readResult)
+	ch := make(chan readResult, 1)
 	go func() {
 		n, err := tr.r.Read(p)
 		ch <- readResult{n: n, err: err}
@@ -517,7 +913,7 @@ func NewTimeoutWriter(w io.Writer, timeout time.Duration) *TimeoutWriter {
 }
 
 func (tw *TimeoutWriter) Write(p []byte) (int, error) {
-	ch := make(chan writeResult)
+	ch := make(chan writeResult, 1)
 	go func() {
 		n, err := tw.w.Write(p)
 		ch <- writeResult{n: n, err: err}
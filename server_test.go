@@ -1,8 +1,18 @@
 package proxytv
 
 import (
+	"bufio"
+	"compress/gzip"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -57,3 +67,367 @@ func TestServerStartStop(t *testing.T) {
 	default:
 	}
 }
+
+func newTestStreamServer(t *testing.T, config *Config) *httptest.Server {
+	config.UseFFMPEG = true
+	return newTestServer(t, config)
+}
+
+func newTestServer(t *testing.T, config *Config) *httptest.Server {
+	config.MaxStreams = 1
+	config.ServerAddress = "localhost:6078"
+
+	provider := newTestProvider(t, config, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`, emptyEpg)
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	ts := httptest.NewServer(server.router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func useFakeFfmpeg(t *testing.T, script string) {
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755))
+
+	orig := ffmpegCommand
+	ffmpegCommand = path
+	t.Cleanup(func() { ffmpegCommand = orig })
+}
+
+func TestStreamStallTimeout(t *testing.T) {
+	useFakeFfmpeg(t, "printf data\nexec sleep 10\n")
+
+	tests := []struct {
+		name     string
+		restarts int
+		expected string
+	}{
+		{name: "Stall stops stream", restarts: 0, expected: "data"},
+		{name: "Stall restarts stream", restarts: 1, expected: "datadata"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestStreamServer(t, &Config{
+				StreamStallTimeout:  200 * time.Millisecond,
+				StreamStallRestarts: tt.restarts,
+			})
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			start := time.Now()
+			resp, err := client.Get(ts.URL + "/channel/0")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(body))
+			assert.Less(t, time.Since(start), 3*time.Second)
+		})
+	}
+}
+
+func TestStreamChannelNotFound(t *testing.T) {
+	ts := newTestStreamServer(t, &Config{})
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	for _, path := range []string{"/channel/5", "/channel/-1", "/radio/channel/-1", "/lineup/news/channel/-1"} {
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+		assert.Equal(t, "Channel not found", string(body), path)
+	}
+}
+
+func TestStreamChannelRedirect(t *testing.T) {
+	ts := newTestServer(t, &Config{})
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(ts.URL + "/channel/0")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://example.com/channel1", resp.Header.Get("Location"))
+
+	resp, err = client.Get(ts.URL + "/channel/5")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStreamCatchup(t *testing.T) {
+	config := &Config{ServerAddress: "localhost:6078"}
+	provider := newTestProvider(t, config, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" catchup="default" catchup-source="http://example.com/catchup/{utc}?duration={duration}",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`, emptyEpg)
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(ts.URL + "/channel/0/catchup?p0=1700000000&p1=3600")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://example.com/catchup/1700000000?duration=3600", resp.Header.Get("Location"))
+
+	// Values cannot change the upstream host, path or query.
+	query := url.Values{"p0": {"@evil.com/x?y#z"}, "p1": {"1&admin=1"}}
+	resp, err = client.Get(ts.URL + "/channel/0/catchup?" + query.Encode())
+	require.NoError(t, err)
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", location.Host)
+	assert.Equal(t, "/catchup/%40evil.com%2Fx%3Fy%23z", location.EscapedPath())
+	assert.Equal(t, url.Values{"duration": {"1&admin=1"}}, location.Query())
+	assert.Empty(t, location.Fragment)
+
+	for path, status := range map[string]int{
+		"/channel/1/catchup?p0=1": http.StatusNotFound,
+		"/channel/5/catchup":      http.StatusNotFound,
+		"/channel/x/catchup":      http.StatusBadRequest,
+	} {
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, path)
+	}
+}
+
+func TestStreamClientDisconnect(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	useFakeFfmpeg(t, "echo $$ > "+pidFile+"\nhead -c 65536 /dev/zero\nexec sleep 10\n")
+	ts := newTestStreamServer(t, &Config{StreamStallTimeout: 10 * time.Second})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /channel/0 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	// FFMPEG is idle once the client has read all it wrote, so only the
+	// disconnect can stop it.
+	_, err = io.ReadFull(resp.Body, make([]byte, 65536))
+	require.NoError(t, err)
+	conn.Close()
+
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return syscall.Kill(pid, 0) != nil
+	}, 3*time.Second, 20*time.Millisecond, "ffmpeg was not stopped")
+}
+
+func TestServerLogoNotTrackedAsStream(t *testing.T) {
+	release := make(chan struct{})
+	requested := make(chan struct{})
+	logos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer logos.Close()
+
+	config := &Config{ServerAddress: "localhost:6078"}
+	provider := newTestProvider(t, config, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-logo="`+logos.URL+`/logo.png",Channel 1
+http://example.com/channel1`, emptyEpg)
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(ts.URL + "/logo/0")
+		assert.NoError(t, err)
+		done <- resp
+	}()
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logo was not requested")
+	}
+	assert.Empty(t, server.getActiveStreams())
+	close(release)
+
+	resp := <-done
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServerNotModified(t *testing.T) {
+	ts := newTestStreamServer(t, &Config{})
+
+	for _, path := range []string{"/iptv.m3u", "/epg.xml"} {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		etag := resp.Header.Get("ETag")
+		require.NotEmpty(t, etag)
+
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("If-None-Match", etag)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, path)
+
+		req.Header.Set("If-None-Match", `"stale"`)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
+
+func TestStreamFormat(t *testing.T) {
+	useFakeFfmpeg(t, `printf '%s ' "$@"`+"\n")
+
+	tests := []struct {
+		format      string
+		args        string
+		contentType string
+	}{
+		{
+			format:      "mpegts",
+			args:        "-i http://example.com/channel1 -c:v copy -f mpegts pipe:1 ",
+			contentType: `video/mpeg; codecs="avc1.4D401E"`,
+		},
+		{
+			format:      "fmp4",
+			args:        "-i http://example.com/channel1 -c:v copy -movflags frag_keyframe+empty_moov+default_base_moof -f mp4 pipe:1 ",
+			contentType: "video/mp4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			ts := newTestStreamServer(t, &Config{StreamFormat: tt.format})
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Get(ts.URL + "/channel/0")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.args, string(body))
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"))
+		})
+	}
+}
+
+func TestServerHealthz(t *testing.T) {
+	config := &Config{MaxRefreshAge: time.Hour}
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	provider.now = func() time.Time { return now }
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	get := func() (int, string) {
+		resp, err := http.Get(ts.URL + "/healthz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"healthy": false, "lastRefresh": null, "channelCount": 0, "programmeCount": 0}`, body)
+
+	require.NoError(t, provider.LoadFromBytes([]byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+http://example.com/channel1`), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="id1"><display-name>Channel 1</display-name></channel>
+  <programme start="20240101000000 +0000" stop="20240101010000 +0000" channel="id1"><title>News</title></programme>
+</tv>`)))
+
+	now = now.Add(30 * time.Minute)
+	code, body = get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"healthy": true, "lastRefresh": "2024-01-01T12:00:00Z", "channelCount": 1, "programmeCount": 1}`, body)
+
+	now = now.Add(time.Hour)
+	code, body = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"healthy": false, "lastRefresh": "2024-01-01T12:00:00Z", "channelCount": 1, "programmeCount": 1}`, body)
+}
+
+func TestServerEpgGzip(t *testing.T) {
+	ts := newTestStreamServer(t, &Config{})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	get := func(acceptEncoding string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/epg.xml", nil)
+		require.NoError(t, err)
+		if len(acceptEncoding) > 0 {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	plain, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(plain), "<tv")
+
+	for _, acceptEncoding := range []string{"gzip", "deflate, gzip;q=0.5"} {
+		resp = get(acceptEncoding)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/xml", resp.Header.Get("Content-Type"))
+		gz, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+		data, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		assert.Equal(t, plain, data)
+	}
+
+	resp = get("gzip;q=0")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+}
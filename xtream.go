@@ -0,0 +1,75 @@
+package proxytv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// xtreamCategory is a live category of the Xtream Codes player API.
+type xtreamCategory struct {
+	ID       string `json:"category_id"`
+	Name     string `json:"category_name"`
+	ParentID int    `json:"parent_id"`
+}
+
+// xtreamStream is a live stream of the Xtream Codes player API.
+type xtreamStream struct {
+	Num          int    `json:"num"`
+	Name         string `json:"name"`
+	StreamType   string `json:"stream_type"`
+	StreamID     int    `json:"stream_id"`
+	StreamIcon   string `json:"stream_icon"`
+	EPGChannelID string `json:"epg_channel_id"`
+	CategoryID   string `json:"category_id"`
+	DirectSource string `json:"direct_source"`
+}
+
+var errUnknownXtreamAction = errors.New("unknown action")
+
+// GetXtreamJSON answers an action of the Xtream Codes player API from the main
+// playlist. get_live_categories lists its group-titles and get_live_streams
+// its tracks, whose stream_id is their channel id, optionally limited to the
+// category with the given id.
+func (p *Provider) GetXtreamJSON(action string, categoryID string) ([]byte, error) {
+	p.dataLock.RLock()
+	defer p.dataLock.RUnlock()
+
+	categories := []xtreamCategory{}
+	streams := []xtreamStream{}
+	if p.playlist != nil && !p.withholdData() {
+		// Categories are numbered from 1 in order of first appearance.
+		ids := make(map[string]string)
+		for i := range p.playlist.tracks {
+			track := &p.playlist.tracks[i]
+			group := track.Tags["group-title"]
+			if _, ok := ids[group]; !ok && len(group) > 0 {
+				ids[group] = strconv.Itoa(len(categories) + 1)
+				categories = append(categories, xtreamCategory{ID: ids[group], Name: group})
+			}
+			if len(categoryID) > 0 && ids[group] != categoryID {
+				continue
+			}
+			streams = append(streams, xtreamStream{
+				Num:          len(streams) + 1,
+				Name:         track.Name,
+				StreamType:   "live",
+				StreamID:     i,
+				StreamIcon:   track.Tags["tvg-logo"],
+				EPGChannelID: track.Tags["tvg-id"],
+				CategoryID:   ids[group],
+				DirectSource: p.endpointURL(fmt.Sprintf("%s%d", channelURIPrefix, i)),
+			})
+		}
+	}
+
+	switch action {
+	case "get_live_categories":
+		return json.Marshal(categories)
+	case "get_live_streams":
+		return json.Marshal(streams)
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownXtreamAction, action)
+	}
+}
@@ -0,0 +1,68 @@
+package proxytv
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderGetXtreamJSON(t *testing.T) {
+	provider := newTestProvider(t, &Config{ServerAddress: "proxytv:8080"}, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-logo="http://example.com/1.png" group-title="News",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" group-title="Sports",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" group-title="News",Channel 3
+http://example.com/channel3
+#EXTINF:-1,Channel 4
+http://example.com/channel4`, emptyEpg)
+
+	data, err := provider.GetXtreamJSON("get_live_categories", "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+  {"category_id": "1", "category_name": "News", "parent_id": 0},
+  {"category_id": "2", "category_name": "Sports", "parent_id": 0}
+]`, string(data))
+
+	data, err = provider.GetXtreamJSON("get_live_streams", "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+  {"num": 1, "name": "Channel 4", "stream_type": "live", "stream_id": 0, "stream_icon": "", "epg_channel_id": "", "category_id": "", "direct_source": "http://proxytv:8080/channel/0"},
+  {"num": 2, "name": "Channel 1", "stream_type": "live", "stream_id": 1, "stream_icon": "http://example.com/1.png", "epg_channel_id": "id1", "category_id": "1", "direct_source": "http://proxytv:8080/channel/1"},
+  {"num": 3, "name": "Channel 2", "stream_type": "live", "stream_id": 2, "stream_icon": "", "epg_channel_id": "id2", "category_id": "2", "direct_source": "http://proxytv:8080/channel/2"},
+  {"num": 4, "name": "Channel 3", "stream_type": "live", "stream_id": 3, "stream_icon": "", "epg_channel_id": "id3", "category_id": "1", "direct_source": "http://proxytv:8080/channel/3"}
+]`, string(data))
+
+	data, err = provider.GetXtreamJSON("get_live_streams", "1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+  {"num": 1, "name": "Channel 1", "stream_type": "live", "stream_id": 1, "stream_icon": "http://example.com/1.png", "epg_channel_id": "id1", "category_id": "1", "direct_source": "http://proxytv:8080/channel/1"},
+  {"num": 2, "name": "Channel 3", "stream_type": "live", "stream_id": 3, "stream_icon": "", "epg_channel_id": "id3", "category_id": "1", "direct_source": "http://proxytv:8080/channel/3"}
+]`, string(data))
+
+	_, err = provider.GetXtreamJSON("get_vod_streams", "")
+	assert.ErrorIs(t, err, errUnknownXtreamAction)
+}
+
+func TestServerXtream(t *testing.T) {
+	ts := newTestServer(t, &Config{})
+
+	resp, err := http.Get(ts.URL + "/player_api.php?username=u&password=p&action=get_live_streams")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `[
+  {"num": 1, "name": "Channel 1", "stream_type": "live", "stream_id": 0, "stream_icon": "", "epg_channel_id": "id1", "category_id": "", "direct_source": "http://localhost:6078/channel/0"}
+]`, string(body))
+
+	resp, err = http.Get(ts.URL + "/player_api.php")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}